@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/freeport"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// activationListener returns the listener passed by systemd socket
+// activation, or nil when the process was not socket activated
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// the environment must not leak into child processes
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds > 1 {
+		return nil, errors.Errorf("expected a single socket activated listener, got %d", fds)
+	}
+	file := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer func() {
+		_ = file.Close()
+	}()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not use socket activated listener")
+	}
+	return listener, nil
+}
+
+// listenerPort describes the address of an already bound tcp listener
+func listenerPort(l net.Listener) (*freeport.Port, error) {
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.Errorf("socket activated listener %s is not tcp", l.Addr())
+	}
+	return &freeport.Port{Address: addr.IP.String(), Port: addr.Port, Protocol: freeport.TCP, NetListenAddress: addr.String()}, nil
+}
@@ -0,0 +1,106 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	socks5 "github.com/things-go/go-socks5"
+)
+
+// TestActivatedProcess is the socket activated child of TestSocketActivation,
+// it serves socks5 on the listener passed as fd 3
+func TestActivatedProcess(t *testing.T) {
+	if os.Getenv("TUNNELX_TEST_ACTIVATED") != "1" {
+		t.Skip("run by TestSocketActivation")
+	}
+	// systemd sets LISTEN_PID to the pid it starts
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listener, err := activationListener()
+	if err != nil || listener == nil {
+		t.Fatalf("no socket activated listener: %v", err)
+	}
+	port, err := listenerPort(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port.NetListenAddress != os.Getenv("TUNNELX_TEST_ADDR") {
+		t.Fatalf("activated listener on %s, want %s", port.NetListenAddress, os.Getenv("TUNNELX_TEST_ADDR"))
+	}
+	setForTest(t, &socks5proxyPort, port)
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+	})
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// serve the first connection, then let the server stop once it is closed
+	shuttingDown.Store(true)
+	close(teardownDone)
+	single := &singleConnListener{Listener: listener, conn: conn}
+	if err := serveSocks5(socks5.NewServer(), "127.0.0.1", single); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// singleConnListener returns conn once, then closes once the socks5
+// connections are done
+type singleConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	socks5Conns.Wait()
+	_ = l.Listener.Close()
+	return nil, net.ErrClosed
+}
+
+func TestSocketActivation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	child := exec.Command(os.Args[0], "-test.run=^TestActivatedProcess$")
+	child.Env = append(os.Environ(), "TUNNELX_TEST_ACTIVATED=1", "TUNNELX_TEST_ADDR="+listener.Addr().String(), "LISTEN_FDS=1")
+	child.ExtraFiles = []*os.File{file}
+	output := make(chan []byte, 1)
+	go func() {
+		out, err := child.CombinedOutput()
+		if err != nil {
+			t.Errorf("activated process failed: %v\n%s", err, out)
+		}
+		output <- out
+	}()
+	// the socks5 server of the child answers on the passed listener
+	socks5Handshake(t, listener.Addr().String())
+	<-output
+}
+
+func TestActivationListenerOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if listener, err := activationListener(); listener != nil || err != nil {
+		t.Fatalf("used the fds passed to another process: %v, %v", listener, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// agentID is the id in use, AgentID namespaced once the configuration is
+// resolved and replaced when the server reports an id conflict
+var agentID atomic.Value
+
+// currentAgentID returns the id in use, AgentID until one was set
+func currentAgentID() string {
+	if id, ok := agentID.Load().(string); ok {
+		return id
+	}
+	return AgentID
+}
+
+// setAgentID replaces the id in use
+func setAgentID(id string) {
+	agentID.Store(id)
+}
+
+// idPrefix namespaces AgentID in control plane calls, e.g. us-east/<xid>
+var idPrefix string
+
+// idPrefixPattern allows slash separated segments of letters, digits, '.', '_' and '-'
+var idPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(/[A-Za-z0-9][A-Za-z0-9._-]*)*$`)
+
+// maxIDPrefixLength keeps namespaced ids reasonably short
+const maxIDPrefixLength = 64
+
+// validateIDPrefix checks -id-prefix
+func validateIDPrefix() error {
+	if idPrefix == "" {
+		return nil
+	}
+	if len(idPrefix) > maxIDPrefixLength || !idPrefixPattern.MatchString(idPrefix) {
+		return errors.Errorf("invalid -id-prefix %q: must be up to %d letters, digits, '.', '_' or '-', in '/' separated segments", idPrefix, maxIDPrefixLength)
+	}
+	return nil
+}
+
+// namespacedID prepends idPrefix to id, ids that already carry it, e.g.
+// from AGENT_ID, are kept as is
+func namespacedID(id string) string {
+	if idPrefix == "" || strings.HasPrefix(id, idPrefix+"/") {
+		return id
+	}
+	return idPrefix + "/" + id
+}
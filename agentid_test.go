@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAgentIDConflictRegenerates(t *testing.T) {
+	setForTest(t, &httpScheme, "http")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &onIDConflict, idConflictRegenerate)
+	setForTest(t, &idPrefix, "us-east")
+	setAgentIDForTest(t, "us-east/conflicting")
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	setForTest(t, &cancelSession, cancelCtx)
+
+	var mu sync.Mutex
+	var ids []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		ids = append(ids, req.URL.Query().Get("id"))
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusConflict, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+
+	// readers of the id run alongside the conflict, as the heartbeat,
+	// status page and events do
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = currentStatus().AgentID
+				}
+			}
+		}()
+	}
+	err := In(ctx, client)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("In returned %v on an id conflict", err)
+	}
+
+	id := currentAgentID()
+	if id == "us-east/conflicting" || !strings.HasPrefix(id, "us-east/") {
+		t.Fatalf("agent id is %s after the conflict, want a new namespaced id", id)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("the tunnel was not re-established with the new id")
+	}
+	if len(ids) == 0 || ids[0] != "us-east/conflicting" {
+		t.Fatalf("registered as %v", ids)
+	}
+}
+
+func TestNamespacedID(t *testing.T) {
+	setForTest(t, &idPrefix, "us-east")
+	for id, want := range map[string]string{
+		"cq2v1ib1vd6f5l0on3ng":         "us-east/cq2v1ib1vd6f5l0on3ng",
+		"us-east/cq2v1ib1vd6f5l0on3ng": "us-east/cq2v1ib1vd6f5l0on3ng",
+		"us-west/cq2v1ib1vd6f5l0on3ng": "us-east/us-west/cq2v1ib1vd6f5l0on3ng",
+	} {
+		if got := namespacedID(id); got != want {
+			t.Errorf("namespacedID(%q) = %q, want %q", id, got, want)
+		}
+	}
+	for prefix, valid := range map[string]bool{
+		"":                      true,
+		"us-east":               true,
+		"eu/west-1":             true,
+		"/us-east":              false,
+		"us-east/":              false,
+		"us east":               false,
+		strings.Repeat("a", 65): false,
+	} {
+		setForTest(t, &idPrefix, prefix)
+		if err := validateIDPrefix(); (err == nil) != valid {
+			t.Errorf("-id-prefix %q: got error %v, want valid=%v", prefix, err, valid)
+		}
+	}
+}
+
+func TestNamespacedIDInControlPlaneCalls(t *testing.T) {
+	setForTest(t, &httpScheme, "http")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &idPrefix, "us-east")
+	setForTest(t, &connectionSucceededCount, 2)
+	setAgentIDForTest(t, namespacedID("cq2v1ib1vd6f5l0on3ng"))
+
+	ids := make(map[string]string)
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ids[req.URL.Path] = req.URL.Query().Get("id")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+	ctx := context.Background()
+	if err := inFunctionTickCallback(ctx, client, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameAgent(ctx, client, "edge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Out(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/in", "/rename", "/out"} {
+		if got := ids[path]; got != "us-east/cq2v1ib1vd6f5l0on3ng" {
+			t.Errorf("%s called with id %q, want the namespaced id", path, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/projectdiscovery/gologger"
+)
+
+var (
+	// secondaryAPIKey is used once the primary key is rejected, for key rotation
+	secondaryAPIKey string
+	// useSecondaryKey is set once the primary key was rejected
+	useSecondaryKey atomic.Bool
+)
+
+// currentAPIKey returns the api key in use
+func currentAPIKey() string {
+	if useSecondaryKey.Load() {
+		return secondaryAPIKey
+	}
+	return proxyPassword
+}
+
+// rejectAPIKey switches to the other configured key when key is the one in
+// use, it reports whether the key changed
+func rejectAPIKey(key string) bool {
+	if secondaryAPIKey == "" || key != currentAPIKey() {
+		return false
+	}
+	secondary := !useSecondaryKey.Load()
+	if !useSecondaryKey.CompareAndSwap(!secondary, secondary) {
+		return false
+	}
+	if secondary {
+		gologger.Warning().Msgf("primary api key was rejected, using the secondary api key")
+	} else {
+		gologger.Warning().Msgf("secondary api key was rejected, using the primary api key")
+	}
+	return true
+}
+
+// isAuthError reports whether err is the ssh server rejecting the credentials.
+// x/crypto/ssh has no typed error for it, the handshake fails with "ssh:
+// unable to authenticate" once every auth method was tried, so callers also
+// check the key was actually offered.
+func isAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// apiKeyTransport retries control plane requests rejected as unauthorized
+// once with the other configured api key
+type apiKeyTransport struct {
+	http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	key := req.Header.Get("X-API-Key")
+	if key == "" || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	if !rejectAPIKey(key) {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("X-API-Key", currentAPIKey())
+	_ = resp.Body.Close()
+	return t.RoundTripper.RoundTrip(retry)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// useAPIKeys configures a primary and a secondary api key for the test
+func useAPIKeys(t *testing.T, primary, secondary string) {
+	t.Helper()
+	setForTest(t, &proxyPassword, primary)
+	setForTest(t, &secondaryAPIKey, secondary)
+	useSecondaryKey.Store(false)
+	t.Cleanup(func() {
+		useSecondaryKey.Store(false)
+	})
+}
+
+func TestSecondaryAPIKeySSH(t *testing.T) {
+	useAPIKeys(t, "primary", "secondary")
+	srv := startPunchHoleServer(t)
+	var mu sync.Mutex
+	var tried []string
+	srv.password = func(_, password string) error {
+		mu.Lock()
+		tried = append(tried, password)
+		mu.Unlock()
+		if password != "secondary" {
+			return errors.New("invalid api key")
+		}
+		return nil
+	}
+	usePunchHole(t, srv, startEchoTarget(t))
+
+	if err := connectTunnel(context.Background(), false); !isAuthError(err) {
+		t.Fatalf("connect with the primary key returned %v, want it rejected", err)
+	}
+	if key := currentAPIKey(); key != "secondary" {
+		t.Fatalf("using %q after the primary key was rejected, want the secondary key", key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- connectTunnel(ctx, false)
+	}()
+	echoThrough(t, srv.nextForward(), "hello")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tried) < 2 || tried[0] != "primary" || tried[len(tried)-1] != "secondary" {
+		t.Fatalf("authenticated with %v, want the primary then the secondary key", tried)
+	}
+}
+
+func TestSecondaryAPIKeyControlPlane(t *testing.T) {
+	useAPIKeys(t, "primary", "secondary")
+	var mu sync.Mutex
+	var keys []string
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		mu.Lock()
+		keys = append(keys, key)
+		mu.Unlock()
+		if key != "secondary" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	client := &http.Client{Transport: &apiKeyTransport{RoundTripper: http.DefaultTransport}}
+
+	for range 2 {
+		if err := inFunctionTickCallback(context.Background(), client, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// the rejected request is retried once, later ones use the secondary key
+	if len(keys) != 3 || keys[0] != "primary" || keys[1] != "secondary" || keys[2] != "secondary" {
+		t.Fatalf("/in called with %v, want primary, then secondary from then on", keys)
+	}
+}
+
+func TestRejectAPIKeyWithoutSecondary(t *testing.T) {
+	useAPIKeys(t, "primary", "")
+	if rejectAPIKey("primary") || currentAPIKey() != "primary" {
+		t.Fatal("switched keys without a secondary key")
+	}
+}
+
+// TestIsAuthError pins the x/crypto/ssh error isAuthError matches, which is
+// not a typed error and could change with an upgrade
+func TestIsAuthError(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	srv.password = func(_, _ string) error {
+		return errors.New("invalid api key")
+	}
+	config := &ssh.ClientConfig{
+		User:            "agent",
+		Auth:            []ssh.AuthMethod{ssh.Password("primary")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	_, err := ssh.Dial("tcp", srv.listener.Addr().String(), config)
+	if !isAuthError(err) {
+		t.Fatalf("rejected password failed the handshake with %v, not detected as an auth error", err)
+	}
+
+	// a server going away is not a rejection
+	addr := srv.listener.Addr().String()
+	_ = srv.listener.Close()
+	if _, err := ssh.Dial("tcp", addr, config); err == nil || isAuthError(err) {
+		t.Fatalf("dial of a closed server returned %v, want a non auth error", err)
+	}
+}
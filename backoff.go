@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backoff policies of -reconnect-backoff
+const (
+	backoffConstant    = "constant"
+	backoffLinear      = "linear"
+	backoffExponential = "exponential"
+)
+
+// controlPlaneRetryDelay and controlPlaneMaxRetryDelay bound the delays
+// between retried control plane calls
+const (
+	controlPlaneRetryDelay    = time.Second
+	controlPlaneMaxRetryDelay = 10 * time.Second
+)
+
+// BackoffPolicy returns the delay before retry attempt, starting at 1
+type BackoffPolicy interface {
+	NextDelay(attempt int) time.Duration
+}
+
+var (
+	// reconnectBackoff is the -reconnect-backoff policy name
+	reconnectBackoff string
+	// reconnectDelay is the base delay of the reconnect policy
+	reconnectDelay time.Duration
+	// reconnectMaxDelay caps the delay of the reconnect policy
+	reconnectMaxDelay time.Duration
+
+	// tunnelBackoff paces tunnel reconnects
+	tunnelBackoff BackoffPolicy = linearBackoff{step: 5 * time.Second, max: time.Minute}
+	// controlPlaneBackoff paces retried /freeport, /rename and /out calls
+	controlPlaneBackoff BackoffPolicy = linearBackoff{step: controlPlaneRetryDelay, max: controlPlaneMaxRetryDelay}
+)
+
+// constantBackoff waits the same delay before every attempt
+type constantBackoff struct {
+	delay time.Duration
+}
+
+func (b constantBackoff) NextDelay(int) time.Duration {
+	return b.delay
+}
+
+// linearBackoff waits step more before every attempt, up to max
+type linearBackoff struct {
+	step, max time.Duration
+}
+
+func (b linearBackoff) NextDelay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	if b.step > 0 && time.Duration(attempt) > b.max/b.step {
+		return b.max
+	}
+	return time.Duration(attempt) * b.step
+}
+
+// exponentialBackoff doubles the delay before every attempt, up to max, and
+// waits a random half to all of it so clients failing together spread out
+type exponentialBackoff struct {
+	base, max time.Duration
+}
+
+func (b exponentialBackoff) NextDelay(attempt int) time.Duration {
+	delay := b.base
+	for i := 1; i < attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.max)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// waitBackoff waits the delay of policy before attempt and reports false
+// when ctx is done first
+func waitBackoff(ctx context.Context, policy BackoffPolicy, attempt int) bool {
+	timer := time.NewTimer(policy.NextDelay(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newBackoffPolicy returns the policy called name with the given base delay and cap
+func newBackoffPolicy(name string, base, maxDelay time.Duration) (BackoffPolicy, error) {
+	switch name {
+	case backoffConstant:
+		return constantBackoff{delay: base}, nil
+	case backoffLinear:
+		return linearBackoff{step: base, max: maxDelay}, nil
+	case backoffExponential:
+		return exponentialBackoff{base: base, max: maxDelay}, nil
+	}
+	return nil, errors.Errorf("invalid -reconnect-backoff %q: must be %s, %s or %s", name, backoffConstant, backoffLinear, backoffExponential)
+}
+
+// configureBackoff builds tunnelBackoff and controlPlaneBackoff from the
+// -reconnect-backoff flags. Control plane retries use the same policy with
+// shorter delays.
+func configureBackoff() error {
+	if reconnectDelay <= 0 {
+		return errors.Errorf("invalid -reconnect-delay %s: must be positive", reconnectDelay)
+	}
+	if reconnectMaxDelay < reconnectDelay {
+		return errors.Errorf("invalid -reconnect-max-delay %s: must be at least -reconnect-delay", reconnectMaxDelay)
+	}
+	policy, err := newBackoffPolicy(reconnectBackoff, reconnectDelay, reconnectMaxDelay)
+	if err != nil {
+		return err
+	}
+	tunnelBackoff = policy
+	controlPlaneBackoff, _ = newBackoffPolicy(reconnectBackoff, controlPlaneRetryDelay, controlPlaneMaxRetryDelay)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	policy := constantBackoff{delay: 3 * time.Second}
+	for attempt := 1; attempt <= 5; attempt++ {
+		if got := policy.NextDelay(attempt); got != 3*time.Second {
+			t.Fatalf("attempt %d waits %s, want 3s", attempt, got)
+		}
+	}
+}
+
+func TestLinearBackoff(t *testing.T) {
+	policy := linearBackoff{step: 5 * time.Second, max: 12 * time.Second}
+	for attempt, want := range []time.Duration{5 * time.Second, 5 * time.Second, 10 * time.Second, 12 * time.Second, 12 * time.Second} {
+		// attempt 0 waits as the first one
+		if got := policy.NextDelay(attempt); got != want {
+			t.Fatalf("attempt %d waits %s, want %s", attempt, got, want)
+		}
+	}
+	// large attempts do not overflow past the cap
+	if got := policy.NextDelay(1 << 62); got != 12*time.Second {
+		t.Fatalf("attempt 1<<62 waits %s, want the 12s cap", got)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	policy := exponentialBackoff{base: time.Second, max: 10 * time.Second}
+	for attempt, full := range map[int]time.Duration{
+		1:    time.Second,
+		2:    2 * time.Second,
+		3:    4 * time.Second,
+		4:    8 * time.Second,
+		5:    10 * time.Second,
+		1000: 10 * time.Second,
+	} {
+		// the jitter keeps the delay within the upper half
+		for range 100 {
+			if got := policy.NextDelay(attempt); got < full/2 || got > full {
+				t.Fatalf("attempt %d waits %s, want %s to %s", attempt, got, full/2, full)
+			}
+		}
+	}
+}
+
+func TestNewBackoffPolicy(t *testing.T) {
+	for name, want := range map[string]BackoffPolicy{
+		backoffConstant:    constantBackoff{delay: time.Second},
+		backoffLinear:      linearBackoff{step: time.Second, max: time.Minute},
+		backoffExponential: exponentialBackoff{base: time.Second, max: time.Minute},
+	} {
+		policy, err := newBackoffPolicy(name, time.Second, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy != want {
+			t.Errorf("-reconnect-backoff %s built %#v, want %#v", name, policy, want)
+		}
+	}
+	if _, err := newBackoffPolicy("fibonacci", time.Second, time.Minute); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
+
+func TestConfigureBackoff(t *testing.T) {
+	setForTest(t, &tunnelBackoff, tunnelBackoff)
+	setForTest(t, &controlPlaneBackoff, controlPlaneBackoff)
+	setForTest(t, &reconnectBackoff, backoffExponential)
+	setForTest(t, &reconnectDelay, 2*time.Second)
+	setForTest(t, &reconnectMaxDelay, time.Minute)
+	if err := configureBackoff(); err != nil {
+		t.Fatal(err)
+	}
+	if want := (exponentialBackoff{base: 2 * time.Second, max: time.Minute}); tunnelBackoff != want {
+		t.Fatalf("tunnel reconnects use %#v, want %#v", tunnelBackoff, want)
+	}
+	// control plane retries share the policy with their own delays
+	if want := (exponentialBackoff{base: controlPlaneRetryDelay, max: controlPlaneMaxRetryDelay}); controlPlaneBackoff != want {
+		t.Fatalf("control plane retries use %#v, want %#v", controlPlaneBackoff, want)
+	}
+
+	setForTest(t, &reconnectMaxDelay, time.Second)
+	if err := configureBackoff(); err == nil {
+		t.Fatal("-reconnect-max-delay below -reconnect-delay accepted")
+	}
+}
+
+func TestWaitBackoffCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := time.Now()
+	if waitBackoff(ctx, constantBackoff{delay: time.Minute}, 1) {
+		t.Fatal("waited out the delay of a cancelled context")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("returned after %s", elapsed)
+	}
+	if !waitBackoff(context.Background(), constantBackoff{delay: time.Millisecond}, 1) {
+		t.Fatal("did not wait out the delay")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/projectdiscovery/gologger"
+)
+
+// configField is a named value of the effective configuration
+type configField struct {
+	name  string
+	value string
+}
+
+// effectiveConfig returns the configuration resolved from flags, env and
+// defaults, with the API key redacted
+func effectiveConfig() []configField {
+	listen := ""
+	if socks5proxyPort != nil {
+		listen = socks5proxyPort.NetListenAddress
+	}
+	return []configField{
+		{"version", version},
+		{"agent_id", currentAgentID()},
+		{"agent_name", AgentName},
+		{"agent_name_source", agentNameSource},
+		{"mode", agentMode},
+		{"host", PunchHoleHost},
+		{"host_ip", currentPunchHoleIP()},
+		{"ssh_port", PunchHolePort},
+		{"http_port", PunchHoleHTTPPort},
+		{"listen", listen},
+		{"api_key", redactKey(proxyPassword)},
+	}
+}
+
+// secretFlags hold api keys, redacted by -print-config
+var secretFlags = []string{"auth", "auth-secondary"}
+
+// printConfig writes the resolved value of every flag, from the command line,
+// env or defaults, as a json object
+func printConfig(w io.Writer, flags *flag.FlagSet) error {
+	config := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if slices.Contains(secretFlags, f.Name) {
+			value = redactKey(value)
+		} else if f.Name == "upstream-socks" {
+			value = redactURL(value)
+		}
+		config[f.Name] = value
+	})
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config)
+}
+
+// redactKey keeps only the last characters of key, enough to tell keys apart
+func redactKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+	return strings.Repeat("*", len(key)-4) + key[len(key)-4:]
+}
+
+// printStartupBanner prints the effective configuration, as a single
+// structured event with -json
+func printStartupBanner() {
+	fields := effectiveConfig()
+	if jsonOutput {
+		event := gologger.Info()
+		for _, field := range fields {
+			event = event.Str(field.name, field.value)
+		}
+		event.Msg("Resolved configuration")
+		return
+	}
+
+	width := 0
+	for _, field := range fields {
+		width = max(width, len(field.name)+1)
+	}
+	gologger.Info().Msg("Resolved configuration:")
+	for _, field := range fields {
+		gologger.Print().Msgf("  %-*s %s", width, field.name+":", field.value)
+	}
+}
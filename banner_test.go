@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/projectdiscovery/freeport"
+	"github.com/projectdiscovery/gologger/levels"
+)
+
+func TestStartupBanner(t *testing.T) {
+	setForTest(t, &proxyPassword, "0123456789abcdef")
+	setForTest(t, &AgentName, "scanner")
+	setForTest(t, &agentNameSource, nameSourceFlag)
+	setForTest(t, &agentMode, modeTunnel)
+	setForTest(t, &PunchHoleHost, "proxy.projectdiscovery.io")
+	setForTest(t, &PunchHolePort, "20022")
+	setForTest(t, &PunchHoleHTTPPort, "8880")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &socks5proxyPort, &freeport.Port{Port: 1080, NetListenAddress: "0.0.0.0:1080"})
+	setAgentIDForTest(t, "agent-1")
+
+	for _, json := range []bool{false, true} {
+		setForTest(t, &jsonOutput, json)
+		logs := captureLogs(t, levels.LevelInfo)
+		printStartupBanner()
+		banner := logs.String()
+		for _, want := range []string{version, "agent-1", "scanner", nameSourceFlag, modeTunnel, "proxy.projectdiscovery.io", "192.0.2.1", "20022", "8880", "0.0.0.0:1080", "************cdef"} {
+			if !strings.Contains(banner, want) {
+				t.Errorf("banner with json %t lacks %q:\n%s", json, want, banner)
+			}
+		}
+		if strings.Contains(banner, "0123456789abcdef") {
+			t.Errorf("banner with json %t shows the api key:\n%s", json, banner)
+		}
+	}
+}
+
+func TestRedactKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"":                 "",
+		"short":            "*****",
+		"12345678":         "********",
+		"0123456789abcdef": "************cdef",
+	} {
+		if got := redactKey(key); got != want {
+			t.Errorf("redactKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	out := parseArgumentsProcess(t, "-name scanner -ssh-port 3333 -auth-secondary secondary-key-5678",
+		"PDCP_API_KEY=primary-key-1234", "PUNCH_HOLE_HOST=env.example.com", "TUNNELX_TEST_PRINT_CONFIG=1")
+	// the config is printed before the test result
+	end := bytes.Index(out, []byte("\n}\n"))
+	if end < 0 {
+		t.Fatalf("no config printed:\n%s", out)
+	}
+	var config map[string]string
+	if err := json.Unmarshal(out[:end+2], &config); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+
+	for name, want := range map[string]string{
+		"name":           "scanner",
+		"ssh-port":       "3333",
+		"host":           "env.example.com",
+		"http-port":      "8880",
+		"auth":           "************1234",
+		"auth-secondary": "**************5678",
+	} {
+		if config[name] != want {
+			t.Errorf("-print-config %s is %q, want %q", name, config[name], want)
+		}
+	}
+	if bytes.Contains(out, []byte("primary-key")) || bytes.Contains(out, []byte("secondary-key")) {
+		t.Fatalf("api key printed:\n%s", out)
+	}
+}
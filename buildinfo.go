@@ -0,0 +1,25 @@
+package main
+
+import "runtime/debug"
+
+// commit is the vcs revision of the build, set with
+// -ldflags "-X main.commit=<revision>"
+var commit string
+
+// buildCommit returns commit, or the vcs revision go build recorded when it
+// was not set
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
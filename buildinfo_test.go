@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRegisterBuildInfo(t *testing.T) {
+	setForTest(t, &httpScheme, "http")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &connectionSucceededCount, 2)
+	setForTest(t, &commit, "4f2b7d3c0a1e")
+	setAgentIDForTest(t, "cq2v1ib1vd6f5l0on3ng")
+
+	var query url.Values
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		query = req.URL.Query()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+	if err := inFunctionTickCallback(context.Background(), client, false); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"id":      "cq2v1ib1vd6f5l0on3ng",
+		"version": version,
+		"go":      runtime.Version(),
+		"commit":  "4f2b7d3c0a1e",
+	} {
+		if got := query.Get(key); got != want {
+			t.Errorf("/in sent %s=%q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// clockSkewThreshold is the drift between the wall and monotonic clocks
+// taken as a suspend and resume or a wall clock jump
+const clockSkewThreshold = 10 * time.Second
+
+var (
+	// clockCheckInterval is how often the wall clock is compared to the monotonic clock
+	clockCheckInterval = 5 * time.Second
+
+	// wallClock reads the wall clock without its monotonic reading
+	wallClock = func() time.Time { return time.Now().Round(0) }
+)
+
+// clockMonitor detects wall clock jumps between observations. The monotonic
+// clock does not advance while the host is suspended, the wall clock does.
+type clockMonitor struct {
+	last     time.Time
+	lastWall time.Time
+}
+
+func newClockMonitor() *clockMonitor {
+	return &clockMonitor{last: time.Now(), lastWall: wallClock()}
+}
+
+// observe returns how far the wall clock moved beyond the monotonic clock
+// since the previous observation, and whether that is a jump
+func (m *clockMonitor) observe() (time.Duration, bool) {
+	now, wall := time.Now(), wallClock()
+	skew := wall.Sub(m.lastWall) - now.Sub(m.last)
+	m.last, m.lastWall = now, wall
+	return skew, skew > clockSkewThreshold || skew < -clockSkewThreshold
+}
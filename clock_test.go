@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClockJumpSendsHeartbeat(t *testing.T) {
+	setForTest(t, &httpScheme, "http")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &connectionSucceededCount, 2)
+	setForTest(t, &noMetrics, true)
+	setForTest(t, &AgentName, "")
+	setForTest(t, &selfTest, false)
+	setForTest(t, &reachabilityURL, "")
+	setForTest(t, &clockCheckInterval, 10*time.Millisecond)
+	var jump atomic.Int64
+	setForTest(t, &wallClock, func() time.Time {
+		return time.Now().Round(0).Add(time.Duration(jump.Load()))
+	})
+
+	heartbeats := make(chan struct{}, 16)
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/in" {
+			heartbeats <- struct{}{}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- In(ctx, client)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-heartbeats:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not registered")
+	}
+	// no heartbeat is due for a minute without a jump
+	select {
+	case <-heartbeats:
+		t.Fatal("heartbeat sent before the clock jumped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the host resumes from a suspend, the wall clock moved on alone
+	jump.Store(int64(time.Minute))
+	select {
+	case <-heartbeats:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat after the clock jumped")
+	}
+}
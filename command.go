@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+// subcommands, flags follow the subcommand
+const (
+	commandConnect = "connect"
+	commandCheck   = "check"
+	commandVersion = "version"
+	commandService = "service"
+)
+
+// command is the subcommand being run, commandConnect when none is given
+var command = commandConnect
+
+// splitCommand returns the subcommand args start with and the arguments
+// left for the flags. Without a subcommand, as in tunnelx -auth <key>,
+// commandConnect is used. The service subcommand also returns its action.
+func splitCommand(args []string) (name, action string, rest []string, err error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commandConnect, "", args, nil
+	}
+	switch args[0] {
+	case commandConnect, commandCheck, commandVersion:
+		return args[0], "", args[1:], nil
+	case commandService:
+		if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+			return "", "", nil, errors.New("usage: tunnelx service <install|uninstall|run> [flags]")
+		}
+		return commandService, args[1], args[2:], nil
+	}
+	return "", "", nil, errors.Errorf("unknown command %q: must be %s, %s, %s or %s", args[0], commandConnect, commandCheck, commandVersion, commandService)
+}
+
+// runCheck validates the configuration and checks that the punch-hole
+// server accepts connections on its ssh port, without registering the agent
+func runCheck() error {
+	if err := prepare(); err != nil {
+		return err
+	}
+	address := net.JoinHostPort(PunchHoleHost, PunchHolePort)
+	ctx, cancel := context.WithTimeout(context.Background(), sshTimeout)
+	defer cancel()
+	conn, err := sshDialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to the punch-hole server %s", address)
+	}
+	_ = conn.Close()
+	gologger.Info().Msgf("Configuration is valid and the punch-hole server %s is reachable", address)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		args         []string
+		name, action string
+		rest         []string
+	}{
+		// no subcommand connects, as before subcommands existed
+		{args: nil, name: commandConnect},
+		{args: []string{"-auth", "key", "-name", "edge"}, name: commandConnect, rest: []string{"-auth", "key", "-name", "edge"}},
+		{args: []string{"connect", "-auth", "key"}, name: commandConnect, rest: []string{"-auth", "key"}},
+		{args: []string{"check", "-auth", "key"}, name: commandCheck, rest: []string{"-auth", "key"}},
+		{args: []string{"version"}, name: commandVersion, rest: []string{}},
+		{args: []string{"service", "install", "-auth", "key"}, name: commandService, action: "install", rest: []string{"-auth", "key"}},
+	}
+	for _, test := range tests {
+		name, action, rest, err := splitCommand(test.args)
+		if err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		if name != test.name || action != test.action || !slices.Equal(rest, test.rest) {
+			t.Errorf("%v split into %q %q %v, want %q %q %v", test.args, name, action, rest, test.name, test.action, test.rest)
+		}
+	}
+
+	for _, args := range [][]string{{"run"}, {"service"}, {"service", "-auth", "key"}} {
+		if _, _, _, err := splitCommand(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+func TestCommandDispatch(t *testing.T) {
+	for args, want := range map[string]string{
+		"":                               "connect  version=false",
+		"-host example.com -ssh-port 22": "connect  version=false",
+		"connect -host example.com":      "connect  version=false",
+		"check -host example.com":        "check  version=false",
+		"version":                        "version  version=true",
+		"-version":                       "connect  version=true",
+		"service uninstall":              "service uninstall version=false",
+	} {
+		parseArgumentsProcess(t, args, "TUNNELX_TEST_WANT_COMMAND="+want)
+	}
+	// flags after the subcommand are parsed
+	parseArgumentsProcess(t, "check -host example.com -ssh-port 2200 -http-port 8443", "TUNNELX_TEST_WANT=example.com 2200 8443")
+}
+
+func TestRunCheck(t *testing.T) {
+	useAPIKeys(t, "key", "")
+	setForTest(t, &sshDialer, sshDialer)
+	setForTest(t, &tunnelRoutes, tunnelRoutes)
+	setForTest(t, &discoveryURL, "")
+	setForTest(t, &remoteBind, "0.0.0.0")
+	setForTest(t, &onIDConflict, idConflictRegenerate)
+	setForTest(t, &sighupAction, sighupReregister)
+	setForTest(t, &sshTimeout, 5*time.Second)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	setForTest(t, &PunchHoleHost, "127.0.0.1")
+	setForTest(t, &PunchHolePort, port)
+	if err := runCheck(); err != nil {
+		t.Fatalf("check failed against a listening punch-hole server: %v", err)
+	}
+
+	_ = listener.Close()
+	if err := runCheck(); err == nil {
+		t.Fatal("check passed without a punch-hole server")
+	}
+}
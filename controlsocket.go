@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/tunnelx/sshr"
+)
+
+// controlResponse is written as a single JSON line for every command
+type controlResponse struct {
+	OK     bool         `json:"ok"`
+	Error  string       `json:"error,omitempty"`
+	Status *agentStatus `json:"status,omitempty"`
+	// Connections are the active tunneled connections, for the connections command
+	Connections []sshr.ConnectionInfo `json:"connections,omitempty"`
+}
+
+// serveControlSocket listens on a unix socket for line based commands:
+//
+//	status       report the agent status
+//	connections  list the active tunneled connections
+//	kill <id>    close the tunneled connection with the given id
+//	reconnect    re-establish the tunnel
+//	reset-stats  reset the connection and byte counters
+//	shutdown     deregister and exit
+func serveControlSocket(path string) error {
+	// a stale socket from a previous run would make listen fail
+	_ = os.Remove(path)
+	// the socket is created owner only, not with the umask until the chmod
+	restore := restrictUmask()
+	listener, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				gologger.Warning().Msgf("control socket stopped: %v", err)
+				return
+			}
+			go handleControlConn(conn)
+		}
+	}()
+	return nil
+}
+
+func handleControlConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		if args[0] == "shutdown" {
+			_ = encoder.Encode(controlResponse{OK: true})
+			_ = conn.Close()
+			gologger.Print().Msg("Received shutdown command, deregistering tunnel...")
+			shutdown()
+			os.Exit(0)
+		}
+		_ = encoder.Encode(runControlCommand(args[0], args[1:]))
+	}
+}
+
+func runControlCommand(command string, args []string) controlResponse {
+	switch command {
+	case "status":
+		status := currentStatus()
+		return controlResponse{OK: true, Status: &status}
+	case "connections":
+		tunnelMu.Lock()
+		tunnel := currentTunnel
+		tunnelMu.Unlock()
+		if tunnel == nil {
+			return controlResponse{OK: true}
+		}
+		return controlResponse{OK: true, Connections: tunnel.Connections()}
+	case "kill":
+		if len(args) != 1 {
+			return controlResponse{Error: "usage: kill <id>"}
+		}
+		tunnelMu.Lock()
+		tunnel := currentTunnel
+		tunnelMu.Unlock()
+		if tunnel == nil || !tunnel.CloseConnection(args[0]) {
+			return controlResponse{Error: "no active connection " + args[0]}
+		}
+		return controlResponse{OK: true}
+	case "reconnect":
+		if !requestReconnect() {
+			return controlResponse{Error: "no tunnel session to reconnect"}
+		}
+		return controlResponse{OK: true}
+	case "reset-stats":
+		resetStats()
+		return controlResponse{OK: true}
+	default:
+		return controlResponse{Error: "unknown command " + command}
+	}
+}
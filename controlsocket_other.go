@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// restrictUmask makes files created until the returned func is called
+// accessible by the owner only. The umask is process wide, files created
+// meanwhile by other goroutines get the restricted mode too.
+func restrictUmask() func() {
+	previous := syscall.Umask(0077)
+	return func() {
+		syscall.Umask(previous)
+	}
+}
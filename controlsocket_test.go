@@ -0,0 +1,151 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlSocket(t *testing.T) {
+	// socket paths are limited to about 100 bytes, t.TempDir may be longer
+	dir, err := os.MkdirTemp("", "tunnelx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	path := filepath.Join(dir, "control.sock")
+	if err := serveControlSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("control socket mode is %o, want 600", perm)
+	}
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("status\nbogus\n")); err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	var status, unknown controlResponse
+	if err := decoder.Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.OK || status.Status == nil {
+		t.Fatalf("status command answered %+v", status)
+	}
+	if err := decoder.Decode(&unknown); err != nil {
+		t.Fatal(err)
+	}
+	if unknown.OK || unknown.Error != "unknown command bogus" {
+		t.Fatalf("unknown command answered %+v", unknown)
+	}
+}
+
+func TestRestrictUmask(t *testing.T) {
+	dir := t.TempDir()
+	restore := restrictUmask()
+	f, err := os.OpenFile(filepath.Join(dir, "restricted"), os.O_CREATE|os.O_WRONLY, 0666)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("file created with mode %o under the restricted umask, want 600", perm)
+	}
+}
+
+func TestControlKill(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	accepted := make(chan net.Conn, 1)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	usePunchHole(t, srv, target.Addr().String())
+
+	if resp := runControlCommand("kill", nil); resp.OK || resp.Error != "usage: kill <id>" {
+		t.Fatalf("kill without an id answered %+v", resp)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- connectTunnel(ctx, false)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	select {
+	case c := <-accepted:
+		defer func() {
+			_ = c.Close()
+		}()
+	case <-time.After(5 * time.Second):
+		t.Fatal("local target not reached")
+	}
+
+	var listed controlResponse
+	for deadline := time.Now().Add(5 * time.Second); len(listed.Connections) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		listed = runControlCommand("connections", nil)
+	}
+	if len(listed.Connections) != 1 {
+		t.Fatalf("connections answered %+v, want the active connection", listed)
+	}
+	id := listed.Connections[0].ID
+	if resp := runControlCommand("kill", []string{id}); !resp.OK {
+		t.Fatalf("kill %s answered %+v", id, resp)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("killed connection still open: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(runControlCommand("connections", nil).Connections) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("killed connection still listed")
+		}
+	}
+	if resp := runControlCommand("kill", []string{id}); resp.OK || resp.Error != "no active connection "+id {
+		t.Fatalf("second kill %s answered %+v", id, resp)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+// restrictUmask is a no-op, windows has no umask
+func restrictUmask() func() {
+	return func() {}
+}
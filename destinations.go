@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/projectdiscovery/gologger"
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// maxTrackedDestinations caps the number of distinct destinations counted,
+// further destinations are aggregated under otherDestinations
+const maxTrackedDestinations = 1000
+
+const otherDestinations = "other"
+
+// destinationStats counts socks5 CONNECT requests per destination host:port
+type destinationStats struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+var destinations = &destinationStats{counts: make(map[string]uint64)}
+
+func (d *destinationStats) record(dest string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.counts[dest]; !ok && len(d.counts) >= maxTrackedDestinations {
+		dest = otherDestinations
+	}
+	d.counts[dest]++
+}
+
+// snapshot returns a copy of the counters
+func (d *destinationStats) snapshot() map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make(map[string]uint64, len(d.counts))
+	for dest, count := range d.counts {
+		counts[dest] = count
+	}
+	return counts
+}
+
+// destinationCounts returns the destination counters, nil unless -log-destinations is set
+func destinationCounts() map[string]uint64 {
+	if !logDestinations {
+		return nil
+	}
+	return destinations.snapshot()
+}
+
+// destinationRule records the destination of CONNECT requests before
+// allowing them, it never denies a request
+type destinationRule struct{}
+
+// Allow implements socks5.RuleSet
+func (destinationRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command == statute.CommandConnect {
+		dest := requestDestination(req)
+		destinations.record(dest)
+		gologger.Info().Str("source", req.RemoteAddr.String()).Msgf("CONNECT %s", dest)
+	}
+	return ctx, true
+}
+
+// requestDestination is the host:port the client asked for, preferring the
+// requested hostname over the resolved address
+func requestDestination(req *socks5.Request) string {
+	port := strconv.Itoa(req.RawDestAddr.Port)
+	if req.RawDestAddr.FQDN != "" {
+		return net.JoinHostPort(req.RawDestAddr.FQDN, port)
+	}
+	return net.JoinHostPort(req.RawDestAddr.IP.String(), port)
+}
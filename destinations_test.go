@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestDestinationRecorded(t *testing.T) {
+	setForTest(t, &destinations, &destinationStats{counts: make(map[string]uint64)})
+	setForTest(t, &logDestinations, true)
+	addr := startSocks5(t, socks5.WithRule(destinationRule{}))
+	_, port, _ := net.SplitHostPort(startEchoTarget(t))
+	dest := net.JoinHostPort("127.0.0.1", port)
+
+	for range 2 {
+		conn := socks5Request(t, addr, statute.CommandConnect, dest)
+		if rep, _ := readSocks5Reply(t, conn); rep != statute.RepSuccess {
+			t.Fatalf("CONNECT replied %d", rep)
+		}
+		_ = conn.Close()
+	}
+	if counts := destinationCounts(); counts[dest] != 2 {
+		t.Fatalf("destination counts %v, want 2 CONNECTs to %s", counts, dest)
+	}
+
+	setForTest(t, &logDestinations, false)
+	if counts := destinationCounts(); counts != nil {
+		t.Fatalf("destination counts %v reported without -log-destinations", counts)
+	}
+}
+
+func TestDestinationStatsCap(t *testing.T) {
+	stats := &destinationStats{counts: make(map[string]uint64)}
+	for i := range maxTrackedDestinations + 10 {
+		stats.record(net.JoinHostPort("10.0.0.1", strconv.Itoa(i+1)))
+	}
+	counts := stats.snapshot()
+	if len(counts) != maxTrackedDestinations+1 || counts[otherDestinations] != 10 {
+		t.Fatalf("tracked %d destinations with %d other, want %d and 10", len(counts), counts[otherDestinations], maxTrackedDestinations)
+	}
+}
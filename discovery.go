@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+// discoveryTimeout bounds fetching the discovery document
+const discoveryTimeout = 10 * time.Second
+
+// discoveryURL serves the punch-hole server settings, fetched at startup when set
+var discoveryURL string
+
+// discoveryDocument holds the punch-hole server settings, empty fields keep
+// the current value
+type discoveryDocument struct {
+	Host     string `json:"host"`
+	SSHPort  int    `json:"ssh_port"`
+	HTTPPort int    `json:"http_port"`
+}
+
+// applyDiscovery fetches the discovery document and uses its settings in
+// place of the built-in defaults. Settings given by flags or env are kept,
+// and the defaults are used when discovery fails.
+func applyDiscovery(ctx context.Context) {
+	doc, err := fetchDiscovery(ctx)
+	if err != nil {
+		gologger.Warning().Msgf("%v, using %s", err, PunchHoleHost)
+		return
+	}
+
+	explicit := make(map[string]bool)
+	if commandLine != nil {
+		commandLine.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+	}
+	settings := []struct {
+		value *string
+		found string
+		flag  string
+		env   string
+	}{
+		{&PunchHoleHost, doc.Host, "host", "PUNCH_HOLE_HOST"},
+		{&PunchHolePort, discoveredPort(doc.SSHPort), "ssh-port", "PUNCH_HOLE_SSH_PORT"},
+		{&PunchHoleHTTPPort, discoveredPort(doc.HTTPPort), "http-port", "PUNCH_HOLE_HTTP_PORT"},
+	}
+	for _, setting := range settings {
+		if _, ok := os.LookupEnv(setting.env); ok || explicit[setting.flag] || setting.found == "" {
+			continue
+		}
+		*setting.value = setting.found
+	}
+	gologger.Info().Msgf("Discovered punch-hole server %s (ssh port %s, http port %s)", PunchHoleHost, PunchHolePort, PunchHoleHTTPPort)
+}
+
+func discoveredPort(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(port)
+}
+
+func fetchDiscovery(ctx context.Context) (*discoveryDocument, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -discovery-url")
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	// the api key is not sent, the discovery url may be served by anyone
+	client := &http.Client{Timeout: discoveryTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "discovery failed")
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("discovery failed with status code %d", resp.StatusCode)
+	}
+	var doc discoveryDocument
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "invalid discovery document")
+	}
+	return &doc, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApplyDiscovery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "" {
+			t.Error("the api key was sent to the discovery url")
+		}
+		_, _ = w.Write([]byte(`{"host":"backup.example.com","ssh_port":2222,"http_port":9443}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("PUNCH_HOLE_HTTP_PORT", "8880")
+	setForTest(t, &discoveryURL, server.URL)
+	setForTest(t, &commandLine, nil)
+	setForTest(t, &PunchHoleHost, defaultPunchHoleHost)
+	setForTest(t, &PunchHolePort, "20022")
+	setForTest(t, &PunchHoleHTTPPort, "8880")
+
+	applyDiscovery(context.Background())
+	if PunchHoleHost != "backup.example.com" || PunchHolePort != "2222" {
+		t.Fatalf("discovered %s:%s, want backup.example.com:2222", PunchHoleHost, PunchHolePort)
+	}
+	// settings from the environment win over discovery
+	if PunchHoleHTTPPort != "8880" {
+		t.Fatalf("http port %s overrode PUNCH_HOLE_HTTP_PORT", PunchHoleHTTPPort)
+	}
+}
+
+func TestApplyDiscoveryFallsBack(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	setForTest(t, &discoveryURL, server.URL)
+	setForTest(t, &commandLine, nil)
+	setForTest(t, &PunchHoleHost, defaultPunchHoleHost)
+	setForTest(t, &PunchHolePort, "20022")
+
+	applyDiscovery(context.Background())
+	if PunchHoleHost != defaultPunchHoleHost || PunchHolePort != "20022" {
+		t.Fatalf("failed discovery changed the server to %s:%s", PunchHoleHost, PunchHolePort)
+	}
+}
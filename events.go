@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/projectdiscovery/gologger"
+)
+
+// lifecycle events sent to -event-webhook
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventReconnecting = "reconnecting"
+	eventRegistered   = "registered"
+	eventDeregistered = "deregistered"
+)
+
+// eventTimeout bounds the delivery of a single event
+const eventTimeout = 5 * time.Second
+
+var (
+	// eventWebhook receives lifecycle events when set
+	eventWebhook string
+
+	eventClient = &http.Client{Timeout: eventTimeout}
+)
+
+// tunnelEvent is the body posted to the event webhook
+type tunnelEvent struct {
+	Event     string    `json:"event"`
+	AgentID   string    `json:"agent_id"`
+	AgentName string    `json:"agent_name,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// emitEvent delivers the event in the background, failures are only logged
+func emitEvent(event string, err error) {
+	if eventWebhook == "" {
+		return
+	}
+	payload := newTunnelEvent(event, err)
+	go sendEvent(payload)
+}
+
+// emitEventSync delivers the event before returning, for events emitted
+// right before the agent exits
+func emitEventSync(event string, err error) {
+	if eventWebhook == "" {
+		return
+	}
+	sendEvent(newTunnelEvent(event, err))
+}
+
+func newTunnelEvent(event string, err error) tunnelEvent {
+	payload := tunnelEvent{
+		Event:     event,
+		AgentID:   currentAgentID(),
+		AgentName: AgentName,
+		Timestamp: time.Now().UTC(),
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	return payload
+}
+
+func sendEvent(payload tunnelEvent) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		gologger.Debug().Msgf("could not marshal %s event: %v", payload.Event, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, eventWebhook, bytes.NewReader(body))
+	if err != nil {
+		gologger.Debug().Msgf("could not create %s event request: %v", payload.Event, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		gologger.Debug().Msgf("could not deliver %s event: %v", payload.Event, err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		gologger.Debug().Msgf("event webhook answered %s event with status %d", payload.Event, resp.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startEventReceiver runs a webhook receiver and points -event-webhook to it
+func startEventReceiver(t *testing.T) <-chan tunnelEvent {
+	t.Helper()
+	events := make(chan tunnelEvent, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("event delivered with %s and content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var event tunnelEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding event: %v", err)
+			return
+		}
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+	setForTest(t, &eventWebhook, server.URL)
+	return events
+}
+
+// nextEvent returns the next event delivered to the receiver
+func nextEvent(t *testing.T, events <-chan tunnelEvent) tunnelEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+		return tunnelEvent{}
+	}
+}
+
+func TestEventWebhook(t *testing.T) {
+	events := startEventReceiver(t)
+	setAgentIDForTest(t, "agent-1")
+	setForTest(t, &AgentName, "scanner")
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- connectTunnel(context.Background(), false)
+	}()
+	srv.nextForward()
+	connected := nextEvent(t, events)
+	if connected.Event != eventConnected || connected.Error != "" {
+		t.Fatalf("got %+v, want a connected event", connected)
+	}
+
+	srv.closeConns()
+	if err := <-done; err == nil {
+		t.Fatal("tunnel returned no error once the server closed it")
+	}
+	disconnected := nextEvent(t, events)
+	if disconnected.Event != eventDisconnected || disconnected.Error == "" {
+		t.Fatalf("got %+v, want a disconnected event with the error", disconnected)
+	}
+
+	for _, event := range []tunnelEvent{connected, disconnected} {
+		if event.AgentID != "agent-1" || event.AgentName != "scanner" {
+			t.Fatalf("%s event for agent %q named %q, want agent-1 named scanner", event.Event, event.AgentID, event.AgentName)
+		}
+		if event.Timestamp.Before(started.Add(-time.Second)) || event.Timestamp.After(time.Now()) {
+			t.Fatalf("%s event timestamp %s out of range", event.Event, event.Timestamp)
+		}
+	}
+	if disconnected.Timestamp.Before(connected.Timestamp) {
+		t.Fatal("disconnected event timestamp before the connected one")
+	}
+}
+
+func TestEventWebhookUnreachable(t *testing.T) {
+	setForTest(t, &eventWebhook, "http://127.0.0.1:1/events")
+	setForTest(t, &eventClient, &http.Client{Timeout: 100 * time.Millisecond})
+
+	started := time.Now()
+	emitEventSync(eventDeregistered, nil)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("undeliverable event blocked for %s", elapsed)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/projectdiscovery/goflags"
+	"github.com/projectdiscovery/gologger"
+)
+
+// failoverThreshold is how many connection attempts in a row may fail
+// before the next punch-hole server is tried
+const failoverThreshold = 3
+
+var (
+	// backupHosts are punch-hole servers (host:ssh-port) tried in order
+	// when the one in use keeps failing
+	backupHosts goflags.StringSlice
+
+	// failoverMu guards failoverHosts, the primary server followed by
+	// backupHosts, failoverIndex, the one in use, and failedAttempts
+	failoverMu     sync.Mutex
+	failoverHosts  []string
+	failoverIndex  int
+	failedAttempts int
+)
+
+// configureFailover records the punch-hole server in use as the primary one
+func configureFailover() {
+	failoverMu.Lock()
+	defer failoverMu.Unlock()
+	failoverHosts = append([]string{net.JoinHostPort(PunchHoleHost, PunchHolePort)}, backupHosts...)
+	failoverIndex = 0
+	failedAttempts = 0
+}
+
+// activeHost returns the punch-hole server in use as host:ssh-port
+func activeHost() string {
+	failoverMu.Lock()
+	defer failoverMu.Unlock()
+	if len(failoverHosts) == 0 {
+		return net.JoinHostPort(PunchHoleHost, PunchHolePort)
+	}
+	return failoverHosts[failoverIndex]
+}
+
+// activePunchHole returns the host and ssh port of the punch-hole server in
+// use. PunchHoleHost and PunchHolePort stay the primary one after a failover.
+func activePunchHole() (host, port string) {
+	host, port, _ = net.SplitHostPort(activeHost())
+	return host, port
+}
+
+// resetFailover clears the failure count once a session is established
+func resetFailover() {
+	failoverMu.Lock()
+	failedAttempts = 0
+	failoverMu.Unlock()
+}
+
+// failover counts a failed connection attempt. Past failoverThreshold it
+// switches to the next server that resolves, cycling back to the primary
+// one after the last backup, and reports whether it did.
+func failover(ctx context.Context) bool {
+	failoverMu.Lock()
+	failedAttempts++
+	if len(failoverHosts) < 2 || failedAttempts < failoverThreshold {
+		failoverMu.Unlock()
+		return false
+	}
+	failedAttempts = 0
+	hosts, current := failoverHosts, failoverIndex
+	failoverMu.Unlock()
+
+	for i := 1; i < len(hosts); i++ {
+		index := (current + i) % len(hosts)
+		host, _, _ := net.SplitHostPort(hosts[index])
+		ips, err := resolvePunchHole(ctx, host)
+		if err != nil {
+			gologger.Warning().Msgf("Not failing over to %s: %v", hosts[index], err)
+			continue
+		}
+		// only the reconnect loop fails over, nothing moved the index meanwhile
+		failoverMu.Lock()
+		failoverIndex = index
+		failoverMu.Unlock()
+		setPunchHoleIPs(ips)
+		// the reverse port was handed out by the previous server
+		reverseProxyPort.Store(nil)
+		gologger.Warning().Msgf("%s failed %d connection attempts in a row, failing over to %s", hosts[current], failoverThreshold, hosts[index])
+		return true
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/projectdiscovery/goflags"
+)
+
+func TestFailover(t *testing.T) {
+	setForTest(t, &PunchHoleHost, "127.0.0.1")
+	setForTest(t, &PunchHolePort, "20022")
+	setForTest(t, &backupHosts, goflags.StringSlice{"127.0.0.2:20023"})
+	setForTest(t, &punchHoleIP, "127.0.0.1")
+	setForTest(t, &punchHoleIPs, []string{"127.0.0.1"})
+	setReverseProxyPortForTest(t, nil)
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &failoverIndex, 0)
+	configureFailover()
+
+	ctx := context.Background()
+	for i := 1; i < failoverThreshold; i++ {
+		if failover(ctx) {
+			t.Fatalf("failed over after %d attempts", i)
+		}
+	}
+	if !failover(ctx) {
+		t.Fatal("did not fail over to the backup host")
+	}
+	if host, port := activePunchHole(); host != "127.0.0.2" || port != "20023" {
+		t.Fatalf("active server is %s:%s, want the backup host", host, port)
+	}
+	if ip := currentPunchHoleIP(); ip != "127.0.0.2" {
+		t.Fatalf("dialing %s, want the backup host", ip)
+	}
+	if PunchHoleHost != "127.0.0.1" {
+		t.Fatalf("failover rewrote PunchHoleHost to %s", PunchHoleHost)
+	}
+
+	// a successful session restarts the count on the backup host
+	failover(ctx)
+	resetFailover()
+	for i := 1; i < failoverThreshold; i++ {
+		failover(ctx)
+	}
+	if got := activeHost(); got != "127.0.0.2:20023" {
+		t.Fatalf("active server is %s after a reset, want the backup host", got)
+	}
+	if !failover(ctx) {
+		t.Fatal("did not cycle back to the primary host")
+	}
+	if got := activeHost(); got != "127.0.0.1:20022" {
+		t.Fatalf("active server is %s, want the primary host", got)
+	}
+}
+
+func TestFailoverWithoutBackups(t *testing.T) {
+	setForTest(t, &PunchHoleHost, "127.0.0.1")
+	setForTest(t, &backupHosts, nil)
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &failoverIndex, 0)
+	configureFailover()
+
+	for i := 0; i < 2*failoverThreshold; i++ {
+		if failover(context.Background()) {
+			t.Fatal("failed over without backup hosts")
+		}
+	}
+}
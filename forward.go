@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/tunnelx/sshr"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// forwardOnly reverse forwards localTarget to remoteAddr on sshServer
+	// without the control plane and the socks5 proxy
+	forwardOnly bool
+	sshServer   string
+	remoteAddr  string
+	localTarget string
+
+	// sshUser, sshKeyFile and sshKnownHosts authenticate -forward-only to
+	// sshServer, the PDCP key is never sent to it
+	sshUser       string
+	sshKeyFile    string
+	sshKnownHosts string
+)
+
+// validateForwardOnly checks the addresses required by -forward-only
+func validateForwardOnly() error {
+	for name, addr := range map[string]string{"-ssh-server": sshServer, "-remote-addr": remoteAddr, "-local-target": localTarget} {
+		if addr == "" {
+			return errors.Errorf("-forward-only requires %s", name)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Wrapf(err, "invalid %s %q", name, addr)
+		}
+	}
+	return nil
+}
+
+// runForwardOnly keeps the reverse tunnel of -forward-only up, reconnecting
+// with a backoff whenever it fails. No control plane calls are made.
+func runForwardOnly() error {
+	if err := validateForwardOnly(); err != nil {
+		return err
+	}
+	sshConfig, err := forwardSSHConfig()
+	if err != nil {
+		return err
+	}
+	agentMode = modeTunnel
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	// shutdown waits for the last session to drain
+	tunnelDone = make(chan struct{})
+	defer close(tunnelDone)
+
+	for retryCount := 0; ; {
+		started := time.Now()
+		err := runForwardTunnel(ctx, sshConfig)
+		if shuttingDown.Load() {
+			return nil
+		}
+		// a tunnel that was up for a while is not failing to connect
+		if time.Since(started) > time.Minute {
+			retryCount = 0
+		}
+		retryCount++
+		if retryCount > 10 {
+			return errors.Wrap(err, "exceeded maximum retry attempts for the tunnel")
+		}
+		gologger.Error().Msgf("error forwarding %s to %s: %v", localTarget, remoteAddr, err)
+		if !waitBackoff(ctx, tunnelBackoff, retryCount) {
+			return nil
+		}
+	}
+}
+
+// forwardSSHConfig authenticates as -ssh-user with -ssh-key and the keys of
+// the ssh agent, and checks the host key of -ssh-server against known_hosts
+func forwardSSHConfig() (*ssh.ClientConfig, error) {
+	if sshUser == "" {
+		return nil, errors.New("-forward-only requires -ssh-user")
+	}
+	var auth []ssh.AuthMethod
+	if sshKeyFile != "" {
+		key, err := os.ReadFile(sshKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading -ssh-key")
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing -ssh-key %s", sshKeyFile)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			gologger.Warning().Msgf("error connecting to the ssh agent: %v", err)
+		} else {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("-forward-only requires -ssh-key or an ssh agent (SSH_AUTH_SOCK)")
+	}
+
+	knownHosts := sshKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "error locating known_hosts, set -ssh-known-hosts")
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading known_hosts")
+	}
+	return &ssh.ClientConfig{
+		Config:          sshAlgorithms,
+		User:            sshUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshTimeout,
+	}, nil
+}
+
+func runForwardTunnel(ctx context.Context, sshConfig *ssh.ClientConfig) error {
+	s, err := sshr.New(sshr.Config{
+		SSHServer:               sshServer,
+		RemoteListenAddr:        remoteAddr,
+		LocalTarget:             localTarget,
+		Dialer:                  sshDialer.DialContext,
+		SSHClientConfig:         sshConfig,
+		Logger:                  slog.Default(),
+		Stats:                   tunnelStats,
+		Compression:             sshr.Compression(compression),
+		DrainTimeout:            drainTimeout,
+		DrainConnectionTimeout:  drainConnectionTimeout,
+		OperationDeadline:       operationDeadline,
+		ConnectionDeadline:      connectionDeadline,
+		Routes:                  tunnelRoutes,
+		HealthCheckTimeout:      healthCheckTimeout,
+		LocalDialRetries:        localDialRetries,
+		AcceptBacklog:           acceptBacklog,
+		AcceptProxyProtocol:     acceptProxyProtocol,
+		MaxConnectionsPerSource: maxConnectionsPerSource,
+		TraceBytes:              traceBytes,
+		SuccessHook: func() {
+			setTunnelConnected(true)
+			publicEndpoint.Store(remoteAddr)
+			gologger.Info().Msgf("Forwarding %s to %s on %s", remoteAddr, localTarget, sshServer)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// published so shutdown stops accepting on the remote listener
+	tunnelMu.Lock()
+	currentTunnel = s
+	tunnelMu.Unlock()
+	defer setTunnelConnected(false)
+	return s.Run(ctx)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startKeyServer runs an ssh server accepting only clientKey, it returns
+// its address and host key
+func startKeyServer(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for ch := range chans {
+						_ = ch.Reject(ssh.Prohibited, "no channels")
+					}
+				}()
+				_ = sshConn.Wait()
+			}()
+		}
+	}()
+	return listener.Addr().String(), hostKey.PublicKey()
+}
+
+// writeClientKey writes a new private key to dir and returns its path
+func writeClientKey(t *testing.T, dir string) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, signer.PublicKey()
+}
+
+func TestForwardSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, clientKey := writeClientKey(t, dir)
+	addr, hostKey := startKeyServer(t, clientKey)
+	otherAddr, _ := startKeyServer(t, clientKey)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr), knownhosts.Normalize(otherAddr)}, hostKey) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSH_AUTH_SOCK", "")
+	setForTest(t, &sshUser, "deploy")
+	setForTest(t, &sshKeyFile, keyFile)
+	setForTest(t, &sshKnownHosts, knownHosts)
+
+	config, err := forwardSSHConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("error authenticating with -ssh-key: %v", err)
+	}
+	_ = client.Close()
+
+	// the other server presents a host key missing from known_hosts
+	if client, err := ssh.Dial("tcp", otherAddr, config); err == nil {
+		_ = client.Close()
+		t.Fatal("connected to a server with an unknown host key")
+	}
+}
+
+func TestForwardSSHConfigRequiresKeys(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	setForTest(t, &sshUser, "deploy")
+	setForTest(t, &sshKeyFile, "")
+	if _, err := forwardSSHConfig(); err == nil {
+		t.Fatal("no error without -ssh-key and an ssh agent")
+	}
+	setForTest(t, &sshUser, "")
+	if _, err := forwardSSHConfig(); err == nil {
+		t.Fatal("no error without -ssh-user")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/projectdiscovery/gologger"
+	"github.com/things-go/go-socks5"
+)
+
+// holdOnReconnect is how long socks5 requests arriving while the tunnel is
+// down wait for it to come back, disabled when zero
+var holdOnReconnect time.Duration
+
+// tunnelUp is open while a tunnel session is established
+var tunnelUp = newTunnelGate()
+
+// servingDirect is set once the proxy is served without the tunnel after
+// fallBackToDirect, requests are not held then
+var servingDirect atomic.Bool
+
+// tunnelGate lets callers wait for the tunnel to be established
+type tunnelGate struct {
+	mu sync.Mutex
+	up chan struct{}
+}
+
+func newTunnelGate() *tunnelGate {
+	return &tunnelGate{up: make(chan struct{})}
+}
+
+// set opens the gate when connected and closes it otherwise
+func (g *tunnelGate) set(connected bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-g.up:
+		if !connected {
+			g.up = make(chan struct{})
+		}
+	default:
+		if connected {
+			close(g.up)
+		}
+	}
+}
+
+// wait blocks until the tunnel is established, ctx is done or timeout
+// elapses, and reports whether the tunnel is established
+func (g *tunnelGate) wait(ctx context.Context, timeout time.Duration) bool {
+	g.mu.Lock()
+	up := g.up
+	g.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-up:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// setTunnelConnected records whether a tunnel session is established
+func setTunnelConnected(connected bool) {
+	tunnelConnected.Store(connected)
+	tunnelUp.set(connected)
+}
+
+// holdRule delays socks5 requests made while the tunnel is reconnecting by
+// up to holdOnReconnect, then hands them to next. It never denies a request.
+type holdRule struct {
+	next socks5.RuleSet
+}
+
+// Allow implements socks5.RuleSet
+func (r holdRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if !tunnelConnected.Load() && !servingDirect.Load() {
+		started := time.Now()
+		if tunnelUp.wait(ctx, holdOnReconnect) {
+			gologger.Debug().Msgf("held socks5 request from %s for %s while the tunnel reconnected", req.RemoteAddr, time.Since(started).Round(time.Millisecond))
+		}
+	}
+	if r.next == nil {
+		return ctx, true
+	}
+	return r.next.Allow(ctx, req)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/freeport"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestHoldRule(t *testing.T) {
+	setForTest(t, &holdOnReconnect, 100*time.Millisecond)
+	setTunnelConnected(false)
+	req := &socks5.Request{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+
+	started := time.Now()
+	if _, ok := (holdRule{}).Allow(context.Background(), req); !ok {
+		t.Fatal("held request was denied")
+	}
+	if elapsed := time.Since(started); elapsed < holdOnReconnect {
+		t.Fatalf("request held for %s, want %s", elapsed, holdOnReconnect)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		_, _ = (holdRule{}).Allow(context.Background(), req)
+	}()
+	setForTest(t, &holdOnReconnect, time.Minute)
+	setTunnelConnected(true)
+	t.Cleanup(func() {
+		setTunnelConnected(false)
+	})
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still held after the tunnel came up")
+	}
+}
+
+func TestHoldRuleAfterSwitchToDirect(t *testing.T) {
+	setForTest(t, &holdOnReconnect, time.Minute)
+	setForTest(t, &agentMode, modeTunnel)
+	setForTest(t, &socks5proxyPort, &freeport.Port{Port: 1080})
+	t.Cleanup(func() {
+		servingDirect.Store(false)
+	})
+	setTunnelConnected(false)
+
+	if endpoint := switchToDirect("203.0.113.7"); endpoint != "203.0.113.7:1080" {
+		t.Fatalf("serving on %s", endpoint)
+	}
+	if agentMode != modeDirect {
+		t.Fatalf("agent mode is %s after the switch", agentMode)
+	}
+	if !currentStatus().Connected {
+		t.Fatal("status reports the agent disconnected in direct mode")
+	}
+
+	req := &socks5.Request{RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = (holdRule{}).Allow(context.Background(), req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request held for the tunnel in direct mode")
+	}
+}
+
+func TestHoldServedOnReconnect(t *testing.T) {
+	setForTest(t, &holdOnReconnect, time.Minute)
+	setTunnelConnected(false)
+	t.Cleanup(func() {
+		setTunnelConnected(false)
+	})
+	addr := startSocks5(t, socks5.WithRule(holdRule{}))
+
+	conn := socks5Request(t, addr, statute.CommandConnect, startEchoTarget(t))
+	replied := make(chan byte, 1)
+	go func() {
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err == nil {
+			replied <- reply[1]
+		}
+		close(replied)
+	}()
+	select {
+	case <-replied:
+		t.Fatal("request answered while the tunnel was reconnecting")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the session is established again within the hold window
+	setTunnelConnected(true)
+	select {
+	case rep, ok := <-replied:
+		if !ok || rep != statute.RepSuccess {
+			t.Fatalf("held request replied %d, want success", rep)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still held after the tunnel came up")
+	}
+	// the rest of the reply, the ipv4 bound address
+	if _, err := io.ReadFull(conn, make([]byte, 2+net.IPv4len+2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("held connection echoed %q: %v", buf, err)
+	}
+}
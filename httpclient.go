@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// controlPlaneTimeout bounds every control plane request
+const controlPlaneTimeout = 10 * time.Second
+
+// controlPlaneClient is passed to the control plane calls of the agent, it
+// is built by parseArguments once the configuration is resolved
+var controlPlaneClient = newHTTPClient()
+
+// publicIPClient detects the public ip, it does not use -tls-server-name
+var publicIPClient = &http.Client{
+	Timeout:   controlPlaneTimeout,
+	Transport: &http.Transport{TLSClientConfig: tlsConfig},
+}
+
+// controlPlaneDialer dials the control plane
+var controlPlaneDialer = &net.Dialer{Timeout: controlPlaneTimeout, KeepAlive: 30 * time.Second}
+
+// dialControlPlane dials the punch-hole ip in use for the punch-hole host.
+// https urls carry the host name, so the certificate is verified for it
+// while the connection goes to the same address as the tunnel.
+func dialControlPlane(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if active, _ := activePunchHole(); host == active {
+			if ip := currentPunchHoleIP(); ip != "" {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+	}
+	return controlPlaneDialer.DialContext(ctx, network, addr)
+}
+
+// newHTTPClient builds a control plane client from the current tls and
+// -max-idle-conns settings. Its transport keeps connections alive across
+// heartbeats and negotiates HTTP/2 with servers supporting it.
+func newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		DialContext:         dialControlPlane,
+		TLSClientConfig:     controlPlaneTLSConfig(),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		// longer than the heartbeat interval so heartbeats reuse the connection
+		IdleConnTimeout: 2 * heartbeatInterval,
+	}
+	return &http.Client{
+		Timeout: controlPlaneTimeout,
+		Transport: &apiKeyTransport{
+			RoundTripper: transport,
+		},
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestControlPlaneClientInjected(t *testing.T) {
+	setForTest(t, &httpScheme, "http")
+	setForTest(t, &PunchHoleHost, "tunnel.example.com")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &connectionSucceededCount, 2)
+
+	var paths []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host != "192.0.2.1:"+PunchHoleHTTPPort {
+			t.Errorf("request to %s, want the punch-hole ip", req.URL.Host)
+		}
+		paths = append(paths, req.URL.Path)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Request: req}, nil
+	})}
+	if err := inFunctionTickCallback(context.Background(), client, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Out(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(paths, ",") != "/in,/out" {
+		t.Fatalf("injected client made %v, want /in and /out", paths)
+	}
+}
+
+func TestControlPlaneHTTPSDialsResolvedIP(t *testing.T) {
+	var host, serverName string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, serverName = r.Host, r.TLS.ServerName
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	// the test certificate is issued for example.com, which resolves elsewhere
+	setForTest(t, &httpScheme, "https")
+	setForTest(t, &PunchHoleHost, "example.com")
+	setForTest(t, &PunchHoleHTTPPort, port)
+	setForTest(t, &punchHoleIP, "127.0.0.1")
+	setForTest(t, &tlsConfig, &tls.Config{RootCAs: pool})
+	setForTest(t, &connectionSucceededCount, 2)
+
+	if err := inFunctionTickCallback(context.Background(), newHTTPClient(), false); err != nil {
+		t.Fatal(err)
+	}
+	if host != net.JoinHostPort("example.com", port) || serverName != "example.com" {
+		t.Fatalf("request for %s with server name %q, want example.com", host, serverName)
+	}
+}
+
+// startControlPlane points the control plane calls at a plain http test
+// server running handler
+func startControlPlane(t *testing.T, handler http.Handler) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &httpScheme, "http")
+	setForTest(t, &PunchHoleHost, "127.0.0.1")
+	setForTest(t, &PunchHoleHTTPPort, port)
+	setForTest(t, &punchHoleIP, "127.0.0.1")
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &failoverIndex, 0)
+}
+
+func TestControlPlaneConnectionReused(t *testing.T) {
+	var mu sync.Mutex
+	var conns int
+	var protos []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos = append(protos, r.Proto)
+		mu.Unlock()
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	setForTest(t, &httpScheme, "https")
+	setForTest(t, &PunchHoleHost, "example.com")
+	setForTest(t, &PunchHoleHTTPPort, port)
+	setForTest(t, &punchHoleIP, "127.0.0.1")
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &tlsConfig, &tls.Config{RootCAs: pool})
+	setForTest(t, &connectionSucceededCount, 2)
+
+	client := newHTTPClient()
+	for range 3 {
+		if err := inFunctionTickCallback(context.Background(), client, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Fatalf("3 heartbeats opened %d connections, want one reused", conns)
+	}
+	for _, proto := range protos {
+		if proto != "HTTP/2.0" {
+			t.Fatalf("heartbeat sent over %s, want HTTP/2", proto)
+		}
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	setForTest(t, &maxIdleConns, 7)
+	transport := newHTTPClient().Transport.(*apiKeyTransport).RoundTripper.(*http.Transport)
+	if transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 7 {
+		t.Fatalf("transport keeps %d idle connections, %d per host, want -max-idle-conns", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout <= heartbeatInterval {
+		t.Fatalf("idle connections closed after %s, before the next heartbeat", transport.IdleConnTimeout)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/freeport"
+	"github.com/projectdiscovery/gologger"
+)
+
+// proxy modes, the http proxy only serves alongside socks5
+const (
+	proxyModeSocks5 = "socks5"
+	proxyModeBoth   = "both"
+)
+
+var (
+	// proxyMode is proxyModeSocks5 or proxyModeBoth, which also serves an
+	// HTTP CONNECT proxy on its own port and remote listener
+	proxyMode = proxyModeSocks5
+
+	// httpProxyPort is the local port of the http proxy with proxyModeBoth
+	httpProxyPort *freeport.Port
+	// reverseHTTPProxyPort is the punch-hole port the http proxy is reached on
+	reverseHTTPProxyPort *freeport.Port
+)
+
+func validateProxyMode() error {
+	switch proxyMode {
+	case proxyModeSocks5, proxyModeBoth:
+		return nil
+	}
+	return errors.Errorf("invalid -proxy-mode %q: must be %s or %s", proxyMode, proxyModeSocks5, proxyModeBoth)
+}
+
+// httpProxy is an HTTP proxy tunneling CONNECT requests and forwarding
+// plain http requests, with the same credentials as the socks5 proxy
+type httpProxy struct {
+	// credentials are checked against Proxy-Authorization, nil disables auth
+	credentials *credentialStore
+	// dial makes the outbound connections
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	transport *http.Transport
+}
+
+func newHTTPProxy(credentials *credentialStore, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *httpProxy {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+	return &httpProxy{
+		credentials: credentials,
+		dial:        dial,
+		transport:   &http.Transport{DialContext: dial},
+	}
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.credentials != nil {
+		user, password, ok := proxyBasicAuth(r)
+		if !ok || !p.credentials.Valid(user, password, r.RemoteAddr) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="tunnelx"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests must use an absolute url", http.StatusBadRequest)
+		return
+	}
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	r.Header.Del("Proxy-Connection")
+	resp, err := p.transport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// connect tunnels the hijacked client connection to r.Host
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	target, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		_ = target.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	defer func() {
+		_ = client.Close()
+		_ = target.Close()
+	}()
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// bytes the client sent after the request are already buffered
+		_, _ = io.Copy(target, buffered.Reader)
+		closeWrite(target)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, target)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+// proxyBasicAuth returns the credentials of the Proxy-Authorization header
+func proxyBasicAuth(r *http.Request) (user, password string, ok bool) {
+	header := r.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", "", false
+	}
+	// BasicAuth parses the Authorization header only
+	parse := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return parse.BasicAuth()
+}
+
+// closeWrite half-closes c so the peer sees EOF, when c supports it
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// serveHTTPProxy serves proxy on the http proxy port until the listener fails
+func serveHTTPProxy(proxy *httpProxy, listener net.Listener) {
+	server := &http.Server{
+		Handler:           proxy,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if err := server.Serve(listener); err != nil && !shuttingDown.Load() {
+		gologger.Error().Msgf("http proxy stopped: %v", err)
+	}
+}
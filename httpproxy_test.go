@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxyConnect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxy := httptest.NewServer(newHTTPProxy(&credentialStore{user: "pdcp", password: "key"}, nil))
+	defer proxy.Close()
+
+	dialConnect := func(auth string) (net.Conn, *http.Response) {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", proxy.Listener.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target.Addr(), target.Addr())
+		if auth != "" {
+			request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+		}
+		if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, resp
+	}
+
+	conn, resp := dialConnect("pdcp:wrong")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("wrong password got status %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+
+	conn, resp = dialConnect("pdcp:key")
+	defer func() {
+		_ = conn.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got status %d, want 200", resp.StatusCode)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("tunnel echoed %q, want ping", buf)
+	}
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization was forwarded to the origin")
+		}
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(newHTTPProxy(&credentialStore{user: "pdcp", password: "key"}, nil))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("pdcp", "key")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+	resp, err := client.Get(origin.URL + "/world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "hello /world") {
+		t.Fatalf("got %q through the proxy", body)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/gologger/levels"
+	"github.com/projectdiscovery/gologger/writer"
+)
+
+// rotatingFile is an io.Writer appending to a file which is rotated once it
+// exceeds maxSize, keeping at most maxFiles rotated files (path.1 is newest)
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N-1 to path.N down to path to path.1 and reopens path
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxFiles > 0 {
+		_ = os.Remove(r.backupName(r.maxFiles))
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(r.backupName(i), r.backupName(i+1))
+		}
+		if err := os.Rename(r.path, r.backupName(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+// ansiEscape matches the color codes written by the cli formatter
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// teeWriter writes gologger output to the terminal and to the log file
+type teeWriter struct {
+	cli  writer.Writer
+	file io.Writer
+}
+
+func (t *teeWriter) Write(data []byte, level levels.Level) {
+	t.cli.Write(data, level)
+	line := append(ansiEscape.ReplaceAll(data, nil), '\n')
+	_, _ = t.file.Write(line)
+}
+
+// setupLogFile mirrors all log output into a size rotated file
+func setupLogFile(path string, maxSizeMB, maxFiles int) error {
+	file, err := newRotatingFile(path, int64(maxSizeMB)*1024*1024, maxFiles)
+	if err != nil {
+		return err
+	}
+	gologger.DefaultLogger.SetWriter(&teeWriter{cli: writer.NewCLI(), file: file})
+	// the socks5 and tunnel loggers write through the standard logger
+	log.SetOutput(io.MultiWriter(os.Stderr, file))
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/projectdiscovery/gologger/levels"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnelx.log")
+	file, err := newRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = file.file.Close()
+	})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("log file not created: %v", err)
+	}
+
+	lines := []string{strings.Repeat("a", 60), strings.Repeat("b", 60), strings.Repeat("c", 60), strings.Repeat("d", 60)}
+	for _, line := range lines {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{path: lines[3], path + ".1": lines[2], path + ".2": lines[1]} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(name), data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 rotated files: %v", err)
+	}
+}
+
+func TestTeeWriterStripsColors(t *testing.T) {
+	var cli bufferWriter
+	var file bytes.Buffer
+	tee := &teeWriter{cli: &cli, file: &file}
+	tee.Write([]byte("\x1b[34mINF\x1b[0m connected"), levels.LevelInfo)
+	if cli.String() != "\x1b[34mINF\x1b[0m connected\n" {
+		t.Errorf("terminal got %q, want the colored line", cli.String())
+	}
+	if file.String() != "INF connected\n" {
+		t.Errorf("log file got %q, want the line without colors", file.String())
+	}
+}
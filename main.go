@@ -1,20 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -31,13 +37,64 @@ import (
 	sliceutil "github.com/projectdiscovery/utils/slice"
 	"github.com/rs/xid"
 	socks5 "github.com/things-go/go-socks5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/crypto/ssh"
 )
 
 const version = "v0.0.1"
 
+const (
+	// deregisterAttempts is the number of /out calls made on shutdown
+	deregisterAttempts = 3
+	// deregisterTimeout bounds the time spent deregistering on shutdown
+	deregisterTimeout = 10 * time.Second
+	// renameAttempts is the number of /rename calls made after registration
+	renameAttempts = 3
+	// freePortAttempts is the number of /freeport calls made for a reverse port
+	freePortAttempts = 3
+)
+
+// defaultPunchHoleHost is the production punch-hole server
+const defaultPunchHoleHost = "proxy.projectdiscovery.io"
+
+// sources of the agent name
+const (
+	nameSourceFlag     = "flag"
+	nameSourceEnv      = "env"
+	nameSourceHostname = "hostname"
+	nameSourceRandom   = "random"
+)
+
+// -on-id-conflict actions
+const (
+	idConflictRegenerate = "regenerate"
+	idConflictFail       = "fail"
+)
+
+// -sighup actions
+const (
+	sighupReregister = "reregister"
+	sighupReconnect  = "reconnect"
+)
+
+// heartbeatInterval is the average interval between /in heartbeats
+const heartbeatInterval = time.Minute
+
+// socks5MaxRestarts is the number of consecutive restarts of the socks5
+// server before giving up
+const socks5MaxRestarts = 5
+
+// socks5BindRetries is the number of new ports tried when the socks5 port
+// was taken between picking and binding it
+const socks5BindRetries = 2
+
+// remoteListenRetries is the number of new ports requested when the server
+// rejects the remote listen port within the same SSH session
+const remoteListenRetries = 3
+
 var (
-	PunchHoleHost     = envutil.GetEnvOrDefault("PUNCH_HOLE_HOST", "proxy.projectdiscovery.io")
+	PunchHoleHost     = envutil.GetEnvOrDefault("PUNCH_HOLE_HOST", defaultPunchHoleHost)
 	PunchHolePort     = envutil.GetEnvOrDefault("PUNCH_HOLE_SSH_PORT", "20022")
 	PunchHoleHTTPPort = envutil.GetEnvOrDefault("PUNCH_HOLE_HTTP_PORT", "8880")
 	// proxy username is "pdcp" by default
@@ -49,46 +106,224 @@ var (
 	AgentName string
 	// proxy password is the PDCP_API_KEY and is required
 	proxyPassword string
+	// apiKeyProvided is set when the key was given by flag or env, even if empty
+	apiKeyProvided bool
 
 	// NoColor is a flag to enable or disable color output
 	noColor bool
 
+	// jsonOutput writes logs as json lines
+	jsonOutput bool
+
+	// logFile, when set, receives a copy of all log output
+	logFile       string
+	logMaxSize    int
+	logMaxBackups int
+
 	// showVersion is a flag to enable or disable version output
 	showVersion bool
+	// localDialRetries is how often a failed dial of the local target
+	// is retried before a tunneled connection is dropped
+	localDialRetries int
+
+	// acceptBacklog bounds the tunneled connections waiting for the local target
+	acceptBacklog int
 
-	httpClient = &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
-	}
+	// acceptProxyProtocol reads the original client address from a PROXY
+	// protocol header sent by the punch-hole server
+	acceptProxyProtocol bool
+
+	// maxConnectionsPerSource limits the concurrent tunneled connections per source ip
+	maxConnectionsPerSource int
+
+	// traceBytes is how many bytes of each direction of a tunneled
+	// connection are dumped with -verbose
+	traceBytes int
+
+	// dumpConfig prints the resolved flags as json and exits
+	dumpConfig bool
+	// commandLine holds the parsed flags for -print-config
+	commandLine *flag.FlagSet
+
+	// noMetrics disables pushing the tunnel stats to the control plane
+	noMetrics bool
+
+	// servers are candidate punch-hole host:port, the fastest one is used
+	servers goflags.StringSlice
+	// routes are name=target pairs routing tunneled connections by TLS SNI or HTTP Host
+	routes       goflags.StringSlice
+	tunnelRoutes map[string]string
+
+	// bindIP overrides the address the socks5 server listens on
+	bindIP string
+
+	// remoteBind is the address the punch-hole server binds the reverse listener to
+	remoteBind string
+
+	// stickyPort keeps the reverse port across reconnects when the server still allows it
+	stickyPort bool
+
+	// noProxyAuth disables socks5 authentication, only allowed on loopback or private binds
+	noProxyAuth bool
+
+	// enableBind enables the socks5 BIND command
+	enableBind bool
+
+	// controlSocket is the path of the unix control socket
+	controlSocket string
+
+	// serviceAction is the windows service action to perform
+	serviceAction string
+
+	// heartbeatJitter randomizes the heartbeat interval
+	heartbeatJitter time.Duration
+
+	// publicIPOverride replaces public ip detection when set
+	publicIPOverride string
+
+	// agentNameSource is where AgentName comes from, one of the nameSource constants
+	agentNameSource string
 
-	logger      = log.Default()
-	punchHoleIP string
+	// noRegister skips the /in, /out and /rename control plane calls
+	noRegister bool
+	// noDeregister skips /out when the agent stops, it stays registered
+	// until the server times the session out
+	noDeregister bool
+
+	// onIDConflict is what happens when the agent id is already registered
+	onIDConflict string
+
+	// sighupAction is what SIGHUP triggers, sighupReregister or sighupReconnect
+	sighupAction string
+
+	// maxLifetime, when set, shuts the agent down after the duration
+	maxLifetime time.Duration
+
+	// logDestinations logs and counts socks5 CONNECT destinations
+	logDestinations bool
+
+	// resolver used for socks5 destination hostnames, system or a DoH url
+	resolver string
+
+	// tunnelRotateInterval, when set, re-establishes the tunnel periodically
+	tunnelRotateInterval time.Duration
+	// healthCheckTimeout bounds the wait for the local socks5 server before registering
+	healthCheckTimeout time.Duration
+	// operationDeadline bounds every read and write of a tunneled connection
+	operationDeadline time.Duration
+	// connectionDeadline bounds the lifetime of every tunneled connection
+	connectionDeadline time.Duration
+	// drainTimeout bounds how long in-flight connections may finish when a tunnel session ends
+	drainTimeout time.Duration
+	// drainConnectionTimeout closes a connection once it has been draining this long
+	drainConnectionTimeout time.Duration
+	// overlapReconnect establishes the new tunnel while the old one drains
+	overlapReconnect bool
+	// drainingTunnels tracks the sessions draining in the background with overlapReconnect
+	drainingTunnels sync.WaitGroup
+	// socks5Conns tracks the connections of the socks5 server, drained on
+	// shutdown in direct mode where no tunnel session does it
+	socks5Conns sync.WaitGroup
+
+	// compression of the tunneled stream, must match the server
+	compression string
+
+	// sshTimeout bounds the SSH dial and handshake
+	sshTimeout time.Duration
+
+	// connectTimeout bounds the whole connection establishment sequence
+	connectTimeout time.Duration
+
+	// verbose enables debug logs such as per connection forwarding messages
+	verbose bool
+
+	// httpScheme of the control plane calls, see controlPlaneScheme
+	httpScheme = envutil.GetEnvOrDefault("PUNCH_HOLE_HTTP_SCHEME", "")
+
+	// maxIdleConns is the number of idle control plane connections kept alive
+	maxIdleConns int
+
+	// insecureSkipVerify disables tls certificate verification of http calls
+	insecureSkipVerify bool
+
+	// tlsConfig of the control plane client, set from -insecure, -tls-min-version and -tls-ciphers
+	tlsConfig = &tls.Config{}
+
+	logger = log.Default()
+
+	// punchHoleMu guards punchHoleIP, the address in use, and punchHoleIPs,
+	// all addresses PunchHoleHost resolved to
+	punchHoleMu  sync.RWMutex
+	punchHoleIP  string
+	punchHoleIPs []string
 
 	connectionSucceededCount int
+
+	// tunnelMu guards socks5proxyPort, socks5Listener, currentTunnel and
+	// cancelSession once the tunnel is running
+	tunnelMu       sync.Mutex
+	socks5Listener net.Listener
+	currentTunnel  *sshr.SSHR
+	cancelSession  context.CancelFunc
+
+	// teardownDone is closed once shutdown completed the teardown
+	teardownDone = make(chan struct{})
+	teardownOnce sync.Once
+
+	// healthMu guards stopHealth, which stops the running In loop and waits for
+	// it, and orders SIGHUP re-registrations before the shutdown /out
+	healthMu   sync.Mutex
+	stopHealth func()
+
+	// tunnelConnected reports whether a tunnel session is currently established
+	tunnelConnected atomic.Bool
+	// startedAt is when the agent started
+	startedAt = time.Now()
+
+	// shuttingDown is set once a graceful shutdown has started
+	shuttingDown atomic.Bool
+
+	// tunnelStats is shared by all tunnel sessions so counters survive reconnects
+	tunnelStats = &sshr.Stats{}
 )
 
 type credentialStore struct {
 	user     string
 	password string
+	// secondary is also accepted while keys are rotated
+	secondary string
 }
 
 func (cs *credentialStore) Valid(user, password, userAddr string) bool {
-	return user == cs.user && password == cs.password
+	if user != cs.user {
+		return false
+	}
+	return password == cs.password || (cs.secondary != "" && password == cs.secondary)
 }
 
-var onceRemoteIp = sync.OnceValues(func() (string, error) {
-	return getPublicIP()
-})
+var onceRemoteIp = sync.OnceValues(remotePublicIP)
+
+// remotePublicIP returns -public-ip when set, the detected public ip otherwise
+func remotePublicIP() (string, error) {
+	if publicIPOverride != "" {
+		return publicIPOverride, nil
+	}
+	return getPublicIP(connectCtx)
+}
 
 var (
-	socks5proxyPort  *freeport.Port
-	reverseProxyPort *freeport.Port
+	socks5proxyPort *freeport.Port
+	// reverseProxyPort is the port the punch-hole server listens on, replaced
+	// by reconnects, listen retries and failover while a session reads it
+	reverseProxyPort atomic.Pointer[freeport.Port]
 	ctx              context.Context
 	cancel           context.CancelFunc
+	// tunnelDone is closed once the reconnect loop has exited
+	tunnelDone chan struct{}
+
+	// connectCtx is done once the connection is established or connectTimeout expires
+	connectCtx  = context.Background()
+	connectDone = func() {}
 )
 
 func main() {
@@ -98,47 +333,128 @@ func main() {
 		gologger.Fatal().Msgf("error parsing arguments: %v", err)
 	}
 
+	if verbose {
+		gologger.DefaultLogger.SetMaxLevel(levels.LevelDebug)
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
 	if showVersion {
 		gologger.Info().Msgf("Current Version: %s\n", version)
 		os.Exit(0)
 	}
 
-	if noColor || osutils.IsWindows() {
+	if dumpConfig {
+		if err := printConfig(os.Stdout, commandLine); err != nil {
+			gologger.Fatal().Msgf("error printing configuration: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if jsonOutput {
+		gologger.DefaultLogger.SetFormatter(&formatter.JSON{})
+	} else if noColor || osutils.IsWindows() {
 		gologger.DefaultLogger.SetFormatter(formatter.NewCLI(true))
 	}
 
+	if logFile != "" {
+		if err := setupLogFile(logFile, logMaxSize, logMaxBackups); err != nil {
+			gologger.Fatal().Msgf("error opening log file: %v", err)
+		}
+	}
+
+	if serviceAction != "" {
+		if !osutils.IsWindows() {
+			gologger.Fatal().Msgf("-service is only supported on windows")
+		}
+		if err := runService(serviceAction); err != nil {
+			gologger.Fatal().Msgf("error running service action %q: %v", serviceAction, err)
+		}
+		return
+	}
+
+	if command == commandCheck {
+		if err := runCheck(); err != nil {
+			gologger.Fatal().Msgf("%s", err)
+		}
+		return
+	}
+
 	if err := process(); err != nil {
 		gologger.Fatal().Msgf("%s", err)
 	}
 }
 
 func process() error {
-	if iputil.IsIP(PunchHoleHost) {
-		punchHoleIP = PunchHoleHost
-	} else {
-		ips, err := net.LookupIP(PunchHoleHost)
-		if err != nil {
-			return errors.Wrapf(err, "error resolving %s", PunchHoleHost)
+	// handle interrupts from the start, so an interrupt while connecting
+	// still deregisters an agent that was already registered
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go handleInterrupt(c)
+
+	if err := prepare(); err != nil {
+		return err
+	}
+
+	if forwardOnly {
+		return runForwardOnly()
+	}
+
+	if connectTimeout > 0 {
+		startConnectTimeout()
+	}
+
+	if len(servers) > 0 {
+		if err := validateServers(servers); err != nil {
+			return err
 		}
-		for _, ip := range ips {
-			if iputil.IsIPv4(ip) {
-				punchHoleIP = ip.String()
-				break
-			}
+		selected, err := selectServer(connectCtx, servers)
+		if err != nil {
+			gologger.Warning().Msgf("%v, falling back to %s", err, net.JoinHostPort(PunchHoleHost, PunchHolePort))
+		} else {
+			PunchHoleHost, PunchHolePort, _ = net.SplitHostPort(selected)
+			gologger.Info().Msgf("Using server %s", selected)
 		}
-		if punchHoleIP == "" {
-			return errors.Errorf("no IPv4 address found for %s", PunchHoleHost)
+	}
+	if len(backupHosts) > 0 {
+		if err := validateServers(backupHosts); err != nil {
+			return errors.Wrap(err, "invalid -backup-host")
 		}
 	}
+	configureFailover()
 
-	if proxyPassword == "" {
-		return errors.Errorf("PDCP_API_KEY is not configured")
+	ips, err := resolvePunchHole(connectCtx, PunchHoleHost)
+	if err != nil {
+		return err
 	}
+	setPunchHoleIPs(ips)
 
-	server := socks5.NewServer(
+	nameResolver, err := newResolver(resolver)
+	if err != nil {
+		return err
+	}
+	socks5Options := []socks5.Option{
 		socks5.WithLogger(socks5.NewLogger(logger)),
-		socks5.WithCredential(&credentialStore{user: proxyUsername, password: proxyPassword}),
-	)
+		socks5.WithResolver(nameResolver),
+	}
+	var credentials *credentialStore
+	if !noProxyAuth {
+		credentials = &credentialStore{user: proxyUsername, password: proxyPassword, secondary: secondaryAPIKey}
+		socks5Options = append(socks5Options, socks5.WithCredential(credentials))
+	}
+	if enableBind {
+		socks5Options = append(socks5Options, socks5.WithBindHandle(handleSocks5Bind))
+	}
+	var rule socks5.RuleSet
+	if logDestinations {
+		rule = destinationRule{}
+	}
+	dial, err := outboundDialer()
+	if err != nil {
+		return err
+	}
+	if dial != nil {
+		socks5Options = append(socks5Options, socks5.WithDial(dial))
+	}
 
 	var listenIp string
 	// Check if the service is accessible from the internet
@@ -146,53 +462,123 @@ func process() error {
 	if err != nil {
 		printConnectionFailure(errors.Wrap(err, "error checking service accessibility"))
 	} else if accessible {
+		agentMode = modeDirect
 		listenIp, _ = onceRemoteIp()
 		gologger.Print().Msgf("Service is accessible from the internet with ip: %s", listenIp)
 	} else {
 		gologger.Warning().Msgf("service is not accessible from the internet, listening on all interfaces")
+		agentMode = modeTunnel
 		listenIp = "0.0.0.0"
 	}
+	if bindIP != "" {
+		listenIp = bindIP
+	}
+	if agentMode == modeTunnel && holdOnReconnect > 0 {
+		rule = holdRule{next: rule}
+	}
+	if rule != nil {
+		socks5Options = append(socks5Options, socks5.WithRule(rule))
+	}
+	if agentMode == modeTunnel {
+		// the reverse tunnel only carries tcp, an advertised udp relay would be unreachable
+		socks5Options = append(socks5Options, socks5.WithAssociateHandle(handleSocks5AssociateUnsupported))
+	} else {
+		socks5Options = append(socks5Options, socks5.WithAssociateHandle(newSocks5AssociateHandler(dial)))
+	}
+	server := socks5.NewServer(socks5Options...)
 
-	socks5proxyPort, err = freeport.GetFreeTCPPort(listenIp)
+	activated, err := activationListener()
 	if err != nil {
-		return errors.Wrap(err, "error getting free port")
+		return err
+	}
+	if activated != nil {
+		socks5proxyPort, err = listenerPort(activated)
+		if err != nil {
+			return err
+		}
+		gologger.Info().Msgf("Using socket activated listener %s", socks5proxyPort.NetListenAddress)
+	} else {
+		socks5proxyPort, err = getFreeTCPPort(listenIp)
+		if err != nil {
+			return errors.Wrap(err, "error getting free port")
+		}
+	}
+	if proxyMode == proxyModeBoth {
+		httpProxyPort, err = getFreeTCPPort(listenIp)
+		if err != nil {
+			return errors.Wrap(err, "error getting free port")
+		}
+		listener, err := net.Listen("tcp", httpProxyPort.NetListenAddress)
+		if err != nil {
+			return errors.Wrap(err, "error listening for the http proxy")
+		}
+		go serveHTTPProxy(newHTTPProxy(credentials, dial), listener)
+	}
+	printStartupBanner()
+
+	if controlSocket != "" {
+		if err := serveControlSocket(controlSocket); err != nil {
+			return errors.Wrap(err, "error listening on control socket")
+		}
+	}
+	if statusAddr != "" {
+		if err := serveStatusPage(statusAddr); err != nil {
+			return errors.Wrap(err, "error listening on status address")
+		}
 	}
 
 	if !accessible {
 		ctx, cancel = context.WithCancel(context.Background())
 		defer cancel()
 
-		_ = Out(ctx)
+		if !noRegister {
+			_ = Out(ctx, controlPlaneClient)
+		}
 
-		reverseProxyPort, err = getFreePortFromServer()
+		port, err := getFreePortFromServer(connectCtx, controlPlaneClient)
 		if err != nil {
 			printConnectionFailure(errors.Wrap(err, "error getting free port"))
 		}
-
-		// Register a graceful exit to call Out(ctx) when the program is interrupted
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			gologger.Print().Msg("Received interrupt signal, deregistering tunnel...")
-			if err := Out(ctx); err != nil {
-				gologger.Warning().Msgf("error deregistering tunnel: %v", err)
+		reverseProxyPort.Store(port)
+		if httpProxyPort != nil {
+			reverseHTTPProxyPort, err = getFreePortFromServer(connectCtx, controlPlaneClient)
+			if err != nil {
+				printConnectionFailure(errors.Wrap(err, "error getting free port"))
 			}
-			cancel()
-			os.Exit(0)
-		}()
+		}
 
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go handleSighup(ctx, hup)
+		if !noRegister && heartbeatWatchdog > 0 {
+			go runHeartbeatWatchdog(ctx)
+		}
+
+		tunnelDone = make(chan struct{})
 		go func() {
+			defer close(tunnelDone)
 			retryCount := 0
-			for {
-				if err := createTunnelsWithGoSSH(ctx); err != nil {
-					gologger.Error().Msgf("error creating tunnels: %v", err)
+			for attempt := 0; ctx.Err() == nil && !shuttingDown.Load(); attempt++ {
+				if err := connectTunnel(ctx, attempt > 0); err != nil {
+					if errors.Is(err, sshr.ErrConnectionClosed) {
+						gologger.Warning().Msgf("server closed the connection: %v", err)
+					} else if errors.Is(err, sshr.ErrListenRetriesExhausted) {
+						gologger.Error().Msgf("server rejected %d free ports in a row: %v", remoteListenRetries+1, err)
+					} else {
+						gologger.Error().Msgf("error creating tunnels: %v", err)
+					}
+					// the retry count spans the whole rotation of -backup-host
 					retryCount++
+					failover(ctx)
 					if retryCount > 10 {
+						if fallBackToDirect(ctx) {
+							return
+						}
 						gologger.Fatal().Msg("Exceeded maximum retry attempts for creating tunnels")
 					}
-					backoffDuration := time.Duration(retryCount*5) * time.Second
-					time.Sleep(backoffDuration)
+					if !waitBackoff(ctx, tunnelBackoff, retryCount) {
+						return
+					}
 				} else {
 					// reset retry count in case of success
 					retryCount = 0
@@ -200,11 +586,381 @@ func process() error {
 			}
 		}()
 	} else {
+		publicEndpoint.Store(socks5proxyPort.NetListenAddress)
+		if httpProxyPort != nil {
+			gologger.Info().Msgf("HTTP proxy listening on %s", httpProxyPort.NetListenAddress)
+		}
+		connectDone()
 		printConnectionSuccess()
+		if selfTest {
+			// give the socks5 server below a moment to start listening
+			time.AfterFunc(time.Second, runSelfTest)
+		}
+		if reachabilityURL != "" {
+			time.AfterFunc(time.Second, runReachabilityCheck)
+		}
+	}
+
+	if maxLifetime > 0 {
+		startMaxLifetime()
+	}
+
+	return serveSocks5(server, listenIp, activated)
+}
+
+// exitProcess exits once the agent shut down gracefully
+var exitProcess = os.Exit
+
+// startMaxLifetime shuts the agent down and exits once maxLifetime elapsed
+func startMaxLifetime() {
+	time.AfterFunc(maxLifetime, func() {
+		gologger.Info().Msgf("Maximum lifetime of %s reached, shutting down", maxLifetime)
+		shutdown()
+		exitProcess(0)
+	})
+}
+
+// prepare validates the configuration and resolves the settings depending
+// on it, for connect and check alike
+func prepare() error {
+	// a forward-only tunnel does not use the control plane and may not need a key
+	if err := validateAPIKey(); err != nil && !forwardOnly {
+		return err
+	}
+
+	if err := validateProxyMode(); err != nil {
+		return err
+	}
+	if err := validateBind(); err != nil {
+		return err
+	}
+
+	if err := sshr.Compression(compression).Validate(); err != nil {
+		return err
+	}
+
+	if err := validateUDPBufferSize(); err != nil {
+		return err
 	}
 
-	if err := server.ListenAndServe("tcp", socks5proxyPort.NetListenAddress); err != nil {
-		return errors.Wrap(err, "error listening and serving")
+	logAgentName()
+
+	if discoveryURL != "" {
+		applyDiscovery(context.Background())
+	}
+
+	if err := validatePunchHole(); err != nil {
+		return err
+	}
+
+	if err := setupSSHDialer(); err != nil {
+		return err
+	}
+
+	if otelEndpoint != "" {
+		if err := setupTracing(); err != nil {
+			return err
+		}
+	}
+
+	if onIDConflict != idConflictRegenerate && onIDConflict != idConflictFail {
+		return errors.Errorf("invalid -on-id-conflict %q: must be %s or %s", onIDConflict, idConflictRegenerate, idConflictFail)
+	}
+
+	if sighupAction != sighupReregister && sighupAction != sighupReconnect {
+		return errors.Errorf("invalid -sighup %q: must be %s or %s", sighupAction, sighupReregister, sighupReconnect)
+	}
+
+	parsedRoutes, err := parseRoutes(routes)
+	if err != nil {
+		return err
+	}
+	tunnelRoutes = parsedRoutes
+	return nil
+}
+
+// serveSocks5 runs the socks5 server, on listener first when not nil,
+// restarting it on a fresh port when it stops unexpectedly and pointing the
+// reverse tunnel at the new port.
+func serveSocks5(server *socks5.Server, listenIp string, listener net.Listener) error {
+	restarts := 0
+	for {
+		if listener == nil {
+			var err error
+			if listener, err = listenSocks5(listenIp); err != nil {
+				return err
+			}
+		}
+
+		tunnelMu.Lock()
+		socks5Listener = listener
+		tunnelMu.Unlock()
+
+		started := time.Now()
+		err := server.Serve(trackingListener{listener})
+		listener = nil
+		if shuttingDown.Load() {
+			// returning would exit before the teardown deregistered the agent
+			<-teardownDone
+			return nil
+		}
+		// a server that ran for a while is not crash looping
+		if time.Since(started) > time.Minute {
+			restarts = 0
+		}
+		restarts++
+		if restarts > socks5MaxRestarts {
+			return errors.Wrap(err, "error listening and serving")
+		}
+		gologger.Warning().Msgf("socks5 server stopped unexpectedly: %v, restarting", err)
+
+		port, err := getFreeTCPPort(listenIp)
+		if err != nil {
+			return errors.Wrap(err, "error getting free port")
+		}
+		setSocks5Port(port)
+	}
+}
+
+// listenSocks5 listens on the current socks5 port, moving to a new free port
+// when another process took it since it was picked
+func listenSocks5(listenIp string) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		tunnelMu.Lock()
+		listenAddress := socks5proxyPort.NetListenAddress
+		tunnelMu.Unlock()
+
+		listener, err := net.Listen("tcp", listenAddress)
+		if err == nil {
+			return listener, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || attempt == socks5BindRetries {
+			return nil, errors.Wrap(err, "error listening")
+		}
+		gologger.Warning().Msgf("socks5 port %s is already in use, picking another one", listenAddress)
+
+		port, err := getFreeTCPPort(listenIp)
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting free port")
+		}
+		setSocks5Port(port)
+	}
+}
+
+// setSocks5Port moves the socks5 server to port and points the reverse tunnel at it
+func setSocks5Port(port *freeport.Port) {
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+	socks5proxyPort = port
+	if currentTunnel != nil {
+		currentTunnel.SetLocalTarget(localDialAddress(port))
+	}
+	if agentMode == modeDirect {
+		publicEndpoint.Store(port.NetListenAddress)
+	}
+}
+
+// onConnectTimeout reports that the connection was not established within
+// -connect-timeout, it exits the process
+var onConnectTimeout = printConnectionFailure
+
+// startConnectTimeout bounds connectCtx by connectTimeout and reports a
+// failure once it expires before connectDone is called
+func startConnectTimeout() {
+	connectCtx, connectDone = context.WithTimeout(context.Background(), connectTimeout)
+	ctx := connectCtx
+	go func() {
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			onConnectTimeout(errors.Errorf("connection was not established within %s", connectTimeout))
+		}
+	}()
+}
+
+// shutdown tears the agent down in order: stop accepting connections and
+// heartbeats, deregister, drain the in-flight connections and close the tunnel
+func shutdown() {
+	shuttingDown.Store(true)
+	defer teardownOnce.Do(func() {
+		close(teardownDone)
+	})
+	if controlSocket != "" {
+		_ = os.Remove(controlSocket)
+	}
+	// new connections are refused first so none start while deregistering,
+	// in-flight ones are drained before the tunnel is closed
+	stopAccepting()
+	// no heartbeat or SIGHUP may register the agent again after /out
+	healthMu.Lock()
+	if stopHealth != nil {
+		stopHealth()
+		stopHealth = nil
+	}
+	healthMu.Unlock()
+	if ctx != nil {
+		if !noRegister && !noDeregister && !forwardOnly {
+			deregister()
+		}
+		cancel()
+	}
+	defer flushTracing()
+	// let in-flight connections drain before the caller exits
+	deadline := time.After(drainTimeout)
+	if tunnelDone == nil {
+		waitDrained(&socks5Conns, deadline)
+		return
+	}
+	select {
+	case <-tunnelDone:
+	case <-deadline:
+		return
+	}
+	// with -overlap-reconnect the last sessions drain in the background
+	waitDrained(&drainingTunnels, deadline)
+}
+
+// waitDrained waits for wg until deadline
+func waitDrained(wg *sync.WaitGroup, deadline <-chan time.Time) {
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-deadline:
+	}
+}
+
+// trackingListener adds the connections it accepts to socks5Conns until
+// they are closed
+type trackingListener struct {
+	net.Listener
+}
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	socks5Conns.Add(1)
+	return &trackedConn{Conn: conn}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(socks5Conns.Done)
+	return err
+}
+
+// stopAccepting closes the socks5 listener and the remote listener of the
+// tunnel, in-flight connections keep going
+func stopAccepting() {
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+	if socks5Listener != nil {
+		_ = socks5Listener.Close()
+	}
+	if currentTunnel != nil {
+		currentTunnel.StopAccepting()
+	}
+}
+
+// deregister calls /out, retrying transient failures within deregisterTimeout
+// so a failed call does not leave a ghost agent registered server-side
+func deregister() {
+	outCtx, outCancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer outCancel()
+
+	for attempt := 1; ; attempt++ {
+		err := Out(outCtx, controlPlaneClient)
+		if err == nil {
+			gologger.Info().Msgf("Tunnel deregistered")
+			emitEventSync(eventDeregistered, nil)
+			return
+		}
+		if attempt == deregisterAttempts || outCtx.Err() != nil {
+			gologger.Warning().Msgf("error deregistering tunnel after %d attempts: %v", attempt, err)
+			return
+		}
+		select {
+		case <-time.After(controlPlaneBackoff.NextDelay(attempt)):
+		case <-outCtx.Done():
+		}
+	}
+}
+
+// validatePunchHole checks the punch-hole host and ports from flags or env
+func validatePunchHole() error {
+	if PunchHoleHost == "" {
+		return errors.Errorf("punch-hole host is empty")
+	}
+	if httpScheme != "" && httpScheme != "http" && httpScheme != "https" {
+		return errors.Errorf("invalid -http-scheme %q: must be http or https", httpScheme)
+	}
+	for name, port := range map[string]string{"-ssh-port": PunchHolePort, "-http-port": PunchHoleHTTPPort} {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return errors.Errorf("invalid %s %q", name, port)
+		}
+	}
+	return nil
+}
+
+// parseRoutes parses name=host:port routes into a map keyed by the lowercased name
+func parseRoutes(routes []string) (map[string]string, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string, len(routes))
+	for _, route := range routes {
+		name, target, ok := strings.Cut(route, "=")
+		if !ok || name == "" {
+			return nil, errors.Errorf("invalid route %q, expected name=host:port", route)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, errors.Wrapf(err, "invalid route target %q", target)
+		}
+		parsed[strings.ToLower(name)] = target
+	}
+	return parsed, nil
+}
+
+// validateAPIKey trims the API key and reports whether it is missing or empty
+func validateAPIKey() error {
+	proxyPassword = strings.TrimSpace(proxyPassword)
+	secondaryAPIKey = strings.TrimSpace(secondaryAPIKey)
+	if proxyPassword != "" {
+		return nil
+	}
+	if !apiKeyProvided {
+		return errors.Errorf("PDCP_API_KEY is not configured, set it with -auth or the PDCP_API_KEY environment variable")
+	}
+	return errors.Errorf("PDCP_API_KEY is provided but empty")
+}
+
+// validateBind checks the -bind address and that -no-proxy-auth is only
+// used where the proxy cannot be reached from outside the local network
+func validateBind() error {
+	if publicIPOverride != "" && !iputil.IsIP(publicIPOverride) {
+		return errors.Errorf("invalid public ip %q", publicIPOverride)
+	}
+	if bindIP != "" && !iputil.IsIP(bindIP) {
+		return errors.Errorf("invalid bind address %q", bindIP)
+	}
+	if !iputil.IsIP(remoteBind) {
+		return errors.Errorf("invalid remote bind address %q", remoteBind)
+	}
+	if !noProxyAuth {
+		return nil
+	}
+	ip := net.ParseIP(bindIP)
+	if ip == nil || !(ip.IsLoopback() || ip.IsPrivate()) {
+		return errors.Errorf("-no-proxy-auth requires -bind with a loopback or private address")
 	}
 	return nil
 }
@@ -232,24 +988,204 @@ func printConnectionSuccess() {
 func parseArguments() error {
 	flagSet := goflags.NewFlagSet()
 	flagSet.SetDescription("A socks5 proxy server that tunnels traffic through a remote server")
-	flagSet.SetCustomHelpText("USAGE EXAMPLE:\n  tunnelx -auth <your_api_key> -name <custom_network_name>")
+	flagSet.SetCustomHelpText("COMMANDS:\n  connect (default)  establish the tunnel and serve the proxy\n  check              validate the configuration and check the punch-hole server is reachable\n  version            show the version\n  service <action>   manage the windows service (install, uninstall, run)\n\nUSAGE EXAMPLE:\n  tunnelx -auth <your_api_key> -name <custom_network_name>\n  tunnelx check -auth <your_api_key>")
 
-	hostname, _ := os.Hostname()
-	if hostname == "" {
-		hostname = xid.New().String()
-	}
+	defaultName, defaultNameSource := defaultAgentName()
 
 	flagSet.CreateGroup("Configuration", "Configuration",
 		flagSet.StringVarEnv(&proxyPassword, "auth", "", "", "PDCP_API_KEY", "set your ProjectDiscovery API key for authentication"),
-		flagSet.StringVarEnv(&AgentName, "name", "", hostname, "AGENT_NAME", "specify a network name (optional)"),
+		flagSet.StringVarEnv(&secondaryAPIKey, "auth-secondary", "", "", "PDCP_API_KEY_SECONDARY", "secondary ProjectDiscovery API key used when the primary one is rejected, for key rotation"),
+		flagSet.StringVarEnv(&AgentName, "name", "", defaultName, "AGENT_NAME", "specify a network name (optional)"),
+		flagSet.StringVar(&idPrefix, "id-prefix", "", "namespace prepended to the agent id, e.g. us-east gives us-east/<id>"),
+		flagSet.StringSliceVar(&routes, "route", nil, "route tunneled connections by tls sni or http host to a local target (name=host:port)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVar(&PunchHoleHost, "host", PunchHoleHost, "punch-hole server host (env PUNCH_HOLE_HOST)"),
+		flagSet.StringVar(&PunchHolePort, "ssh-port", PunchHolePort, "punch-hole server ssh port (env PUNCH_HOLE_SSH_PORT)"),
+		flagSet.StringVar(&PunchHoleHTTPPort, "http-port", PunchHoleHTTPPort, "punch-hole server http port (env PUNCH_HOLE_HTTP_PORT)"),
+		flagSet.StringVar(&discoveryURL, "discovery-url", "", "url of a json document with the punch-hole host, ssh_port and http_port, fetched at startup in place of the defaults"),
+		flagSet.StringVar(&httpScheme, "http-scheme", httpScheme, "scheme of the control plane calls, http or https (default https for the production host, http otherwise)"),
+		flagSet.StringSliceVar(&servers, "server", nil, "punch-hole servers (host:ssh-port) to choose the lowest latency one from", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&backupHosts, "backup-host", nil, "backup punch-hole servers (host:ssh-port) to fail over to in order when the one in use keeps failing", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVar(&upstreamSocks, "upstream-socks", "", "socks5 proxy (socks5://[user:password@]host:port) to reach the punch-hole ssh server through"),
+		flagSet.StringVar(&proxyMode, "proxy-mode", proxyMode, "proxies to serve, socks5 or both for socks5 and an http connect proxy on its own port"),
+		flagSet.StringVar(&bindIP, "bind", "", "ip address for the socks5 server to listen on (default auto detected)"),
+		flagSet.StringVar(&outIP, "out-ip", "", "source ip of the proxy's outbound connections"),
+		flagSet.StringVar(&outInterface, "out-interface", "", "interface whose address is the source of the proxy's outbound connections"),
+		flagSet.StringVar(&remoteBind, "remote-bind", "0.0.0.0", "ip address the punch-hole server binds the reverse tunnel to"),
+		flagSet.BoolVar(&stickyPort, "sticky-port", false, "try to keep the same reverse port across reconnects, requesting a new one only when it is taken"),
+		flagSet.BoolVar(&noProxyAuth, "no-proxy-auth", false, "disable socks5 authentication (requires a loopback or private -bind)"),
+		flagSet.BoolVar(&enableBind, "enable-bind", false, "enable the socks5 BIND command for reverse data channels"),
+		flagSet.IntVar(&udpBufferSize, "udp-buffer-size", defaultUDPBufferSize, "largest datagram relayed by socks5 UDP ASSOCIATE, larger ones are dropped"),
+		flagSet.StringVar(&otelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint receiving traces of the connect sequence and proxied connections, e.g. http://localhost:4318"),
+		flagSet.BoolVar(&selfTest, "self-test", false, "check the proxy end to end with a request through it once connected"),
+		flagSet.StringVar(&reachabilityURL, "reachability-url", "", "prober asked to connect back to the public endpoint once connected, as GET <url>?address=host:port"),
+		flagSet.StringVar(&eventWebhook, "event-webhook", "", "url receiving a json POST on tunnel lifecycle events"),
+		flagSet.BoolVar(&noDeregister, "no-deregister", false, "stay registered when the agent stops, skipping /out, until the server times the session out"),
+		flagSet.BoolVar(&noRegister, "no-register", false, "establish the tunnel without registering the agent (/in, /out and /rename)"),
+		flagSet.BoolVar(&noMetrics, "no-metrics", false, "disable reporting tunnel metrics to the control plane"),
+		flagSet.BoolVar(&logDestinations, "log-destinations", false, "log and count the destinations of socks5 CONNECT requests"),
+		flagSet.StringVar(&publicIPOverride, "public-ip", "", "public ip of this host, skips public ip detection"),
+		flagSet.StringVar(&resolver, "resolver", "system", "resolver for socks5 destination hostnames (system or a DoH url like https://1.1.1.1/dns-query)"),
+		flagSet.StringVar(&compression, "compression", "none", "compression of the tunneled stream (none, gzip, zstd), must be supported by the server"),
+		flagSet.StringVar(&onIDConflict, "on-id-conflict", idConflictRegenerate, "action when the agent id is registered by another agent: regenerate (new random id) or fail"),
+		flagSet.StringVar(&sighupAction, "sighup", sighupReregister, "action on SIGHUP: reregister (call /in again) or reconnect (re-establish the tunnel)"),
+		flagSet.DurationVar(&maxLifetime, "max-lifetime", 0, "shut down gracefully after this duration (0 to disable)"),
+		flagSet.DurationVar(&tunnelRotateInterval, "tunnel-rotate-interval", 0, "re-establish the tunnel at this interval to refresh NAT mappings (0 to disable)"),
+		flagSet.DurationVar(&healthCheckTimeout, "health-check-timeout", 0, "wait up to this duration for the local socks5 server to accept connections before registering (0 to disable)"),
+		flagSet.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "read the original client address from a PROXY protocol header the punch-hole server sends on every tunneled connection"),
+		flagSet.IntVar(&maxConnectionsPerSource, "max-connections-per-source", 0, "maximum concurrent tunneled connections per source ip, the client ip with -accept-proxy-protocol (0 to disable)"),
+		flagSet.IntVar(&localDialRetries, "local-dial-retries", 2, "retries of a failed dial of the local target before a tunneled connection is dropped"),
+		flagSet.IntVar(&acceptBacklog, "accept-backlog", 128, "tunneled connections that may wait for the local target at once before accepting pauses"),
+		flagSet.DurationVar(&operationDeadline, "operation-deadline", 0, "close a tunneled connection once a single read or write on it takes longer than this duration (0 to disable)"),
+		flagSet.DurationVar(&connectionDeadline, "connection-deadline", 0, "close tunneled connections still open after this duration, regardless of activity (0 to disable)"),
+		flagSet.DurationVar(&holdOnReconnect, "hold-on-reconnect", 0, "hold socks5 requests made while the tunnel reconnects for up to this duration (0 to disable)"),
+		flagSet.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "time given to in-flight connections to finish when the tunnel is re-established"),
+		flagSet.BoolVar(&overlapReconnect, "overlap-reconnect", false, "on reconnect, keep in-flight connections on the old tunnel while the new one is established"),
+		flagSet.DurationVar(&drainConnectionTimeout, "drain-timeout-per-connection", 0, "while draining, close a connection once it has been draining for this duration (0 to disable)"),
+		flagSet.DurationVar(&heartbeatJitter, "heartbeat-jitter", 10*time.Second, "maximum random deviation of the heartbeat interval"),
+		flagSet.DurationVar(&heartbeatWatchdog, "heartbeat-watchdog", 5*time.Minute, "re-establish the tunnel when no heartbeat succeeded for this duration (0 to disable)"),
+		flagSet.StringVar(&reconnectBackoff, "reconnect-backoff", backoffLinear, "backoff policy between tunnel reconnects and control plane retries (constant, linear, exponential)"),
+		flagSet.DurationVar(&reconnectDelay, "reconnect-delay", 5*time.Second, "base delay between tunnel reconnects"),
+		flagSet.DurationVar(&reconnectMaxDelay, "reconnect-max-delay", time.Minute, "maximum delay between tunnel reconnects"),
+		flagSet.IntVar(&maxIdleConns, "max-idle-conns", 4, "maximum idle control plane connections kept alive for reuse"),
+		flagSet.StringVar(&tlsServerName, "tls-server-name", "", "server name verified on https control plane calls, e.g. when -host is an ip"),
+		flagSet.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "minimum tls version of the control plane calls (1.0, 1.1, 1.2 or 1.3)"),
+		flagSet.StringSliceVar(&tlsCiphers, "tls-ciphers", nil, "tls 1.2 cipher suites allowed for the control plane calls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.BoolVar(&insecureSkipVerify, "insecure", false, "skip tls certificate verification, only for testing against self-signed servers"),
+		flagSet.StringSliceVar(&sshKeyExchanges, "ssh-kex", nil, "ssh key exchange algorithms allowed, e.g. curve25519-sha256", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&sshCiphers, "ssh-ciphers", nil, "ssh ciphers allowed, e.g. aes256-gcm@openssh.com", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&sshMACs, "ssh-macs", nil, "ssh macs allowed, e.g. hmac-sha2-256-etm@openssh.com", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.DurationVar(&sshTimeout, "ssh-timeout", 30*time.Second, "timeout for the ssh connection and handshake"),
+		flagSet.DurationVar(&connectTimeout, "connect-timeout", 0, "maximum time to establish the connection (0 to disable)"),
+	)
+	flagSet.CreateGroup("forward", "Forward Only",
+		flagSet.BoolVar(&forwardOnly, "forward-only", false, "only reverse forward -local-target to -remote-addr on -ssh-server, without the control plane and socks5 proxy"),
+		flagSet.StringVar(&sshServer, "ssh-server", "", "ssh server (host:port) for -forward-only"),
+		flagSet.StringVar(&remoteAddr, "remote-addr", "", "address (host:port) the ssh server listens on for -forward-only"),
+		flagSet.StringVar(&localTarget, "local-target", "", "local address (host:port) connections are forwarded to for -forward-only"),
+		flagSet.StringVar(&sshUser, "ssh-user", "", "user authenticating to -ssh-server for -forward-only"),
+		flagSet.StringVar(&sshKeyFile, "ssh-key", "", "private key file authenticating to -ssh-server, the ssh agent is used too when SSH_AUTH_SOCK is set"),
+		flagSet.StringVar(&sshKnownHosts, "ssh-known-hosts", "", "known_hosts file verifying the host key of -ssh-server (default ~/.ssh/known_hosts)"),
+	)
+
+	flagSet.CreateGroup("status", "Status",
+		flagSet.StringVar(&controlSocket, "control-socket", "", "unix socket path accepting status, reconnect and shutdown commands"),
+		flagSet.StringVar(&statusAddr, "status-addr", "", "address (host:port) of an http server with a status page on / and the status as json on /status"),
+	)
+	flagSet.CreateGroup("service", "Service",
+		flagSet.StringVar(&serviceAction, "service", "", "manage the windows service (install, uninstall, run)"),
 	)
 	flagSet.CreateGroup("output", "Output",
 		flagSet.BoolVarP(&noColor, "no-color", "nc", false, "disable output content coloring (ANSI escape codes)"),
+		flagSet.BoolVar(&jsonOutput, "json", false, "write output in json lines format"),
+		flagSet.StringVar(&logFile, "log-file", "", "file to write logs to, in addition to the terminal"),
+		flagSet.IntVar(&logMaxSize, "log-max-size", 10, "maximum size in MB of the log file before it is rotated"),
+		flagSet.IntVar(&logMaxBackups, "log-max-files", 5, "number of rotated log files to keep"),
 	)
 	flagSet.CreateGroup("debug", "Debug",
 		flagSet.BoolVar(&showVersion, "version", false, "show version of the project"),
+		flagSet.BoolVar(&dumpConfig, "print-config", false, "print the resolved configuration as json, with api keys redacted, and exit"),
+		flagSet.BoolVar(&verbose, "verbose", false, "show verbose output, including every forwarded connection"),
+		flagSet.IntVar(&traceBytes, "trace-bytes", 0, "with -verbose, log a hex dump of the first bytes (at most 4096) of both directions of every tunneled connection"),
 	)
-	return flagSet.Parse()
+	name, action, args, err := splitCommand(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	// with no flags after the subcommand, Parse falls back to os.Args, which
+	// stops at the subcommand and sets no flags either
+	if err := flagSet.Parse(args...); err != nil {
+		return err
+	}
+	command = name
+	switch command {
+	case commandVersion:
+		showVersion = true
+	case commandService:
+		serviceAction = action
+	}
+
+	if err := configureTLS(); err != nil {
+		return err
+	}
+	controlPlaneClient = newHTTPClient()
+	if err := configureSSHAlgorithms(); err != nil {
+		return err
+	}
+
+	if err := configureBackoff(); err != nil {
+		return err
+	}
+	if heartbeatWatchdog != 0 && heartbeatWatchdog < heartbeatInterval+heartbeatJitter {
+		return errors.Errorf("invalid -heartbeat-watchdog %s: must be 0 or at least %s, the heartbeat interval", heartbeatWatchdog, heartbeatInterval+heartbeatJitter)
+	}
+	if acceptBacklog < 1 {
+		return errors.Errorf("invalid -accept-backlog %d: must be at least 1", acceptBacklog)
+	}
+	if holdOnReconnect < 0 {
+		return errors.Errorf("invalid -hold-on-reconnect %s: must not be negative", holdOnReconnect)
+	}
+	if drainConnectionTimeout < 0 {
+		return errors.Errorf("invalid -drain-timeout-per-connection %s: must not be negative", drainConnectionTimeout)
+	}
+
+	if err := validateIDPrefix(); err != nil {
+		return err
+	}
+	setAgentID(namespacedID(AgentID))
+
+	// allow referencing the environment, e.g. -name tunnelx-${POD_NAME}
+	AgentName = expandEnv(AgentName)
+	bindIP = expandEnv(bindIP)
+
+	_, apiKeyProvided = os.LookupEnv("PDCP_API_KEY")
+	agentNameSource = defaultNameSource
+	if _, ok := os.LookupEnv("AGENT_NAME"); ok {
+		agentNameSource = nameSourceEnv
+	}
+	flagSet.CommandLine.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "auth":
+			apiKeyProvided = true
+		case "name":
+			agentNameSource = nameSourceFlag
+		}
+	})
+	commandLine = flagSet.CommandLine
+	return nil
+}
+
+// logAgentName tells which agent name is used when -name is not given
+func logAgentName() {
+	switch agentNameSource {
+	case nameSourceHostname:
+		gologger.Info().Msgf("No -name given, using the hostname %q as the agent name", AgentName)
+	case nameSourceRandom:
+		gologger.Info().Msgf("No -name given and no hostname available, using the random agent name %q", AgentName)
+	}
+}
+
+// osHostname returns the host name, the default agent name
+var osHostname = os.Hostname
+
+// defaultAgentName returns the agent name used without -name, the host name
+// or a random xid when there is none, and its nameSource
+func defaultAgentName() (string, string) {
+	if hostname, _ := osHostname(); hostname != "" {
+		return hostname, nameSourceHostname
+	}
+	return xid.New().String(), nameSourceRandom
+}
+
+// expandEnv expands ${VAR} and ${VAR:-default} references in value.
+// Undefined variables without a default expand to an empty string.
+func expandEnv(value string) string {
+	return os.Expand(value, func(name string) string {
+		name, fallback, _ := strings.Cut(name, ":-")
+		if envValue := os.Getenv(name); envValue != "" {
+			return envValue
+		}
+		return fallback
+	})
 }
 
 func isServiceAccessibleFromInternet() (bool, error) {
@@ -258,16 +1194,74 @@ func isServiceAccessibleFromInternet() (bool, error) {
 		return false, err
 	}
 
+	return hasLocalIP(publicIP), nil
+}
+
+// hasLocalIP reports whether publicIP is an address of a local interface
+func hasLocalIP(publicIP string) bool {
 	localIPs, err := getLocalIPs()
 	if err != nil {
-		return false, err
+		// sandboxed environments can fail enumerating interfaces, the tunnel works regardless
+		gologger.Warning().Msgf("could not enumerate local ips, assuming not accessible from the internet: %v", err)
+		return false
 	}
 
-	return sliceutil.Contains(localIPs, publicIP), nil
+	accessible := sliceutil.Contains(localIPs, publicIP)
+	gologger.Debug().
+		Str("public_ip", publicIP).
+		Str("local_ips", strings.Join(localIPs, ",")).
+		Str("accessible", strconv.FormatBool(accessible)).
+		Msg("Checked whether the public ip is a local ip")
+	return accessible
 }
 
-func getPublicIP() (string, error) {
-	resp, err := httpClient.Get("https://api.ipify.org")
+// fallBackToDirect runs the accessibility check again once the tunnel could
+// not be established, with a freshly detected public ip, and serves the
+// socks5 proxy directly when this host turns out to be reachable. The socks5
+// server already listens on all interfaces in tunnel mode, unless -bind
+// restricts it to another address.
+func fallBackToDirect(ctx context.Context) bool {
+	publicIP := publicIPOverride
+	if publicIP == "" {
+		ip, err := getPublicIP(ctx)
+		if err != nil {
+			gologger.Warning().Msgf("could not detect the public ip again: %v", err)
+			return false
+		}
+		publicIP = ip
+	}
+	if bindIP != "" && bindIP != publicIP && !net.ParseIP(bindIP).IsUnspecified() {
+		return false
+	}
+	if !hasLocalIP(publicIP) {
+		return false
+	}
+
+	endpoint := switchToDirect(publicIP)
+	gologger.Warning().Msgf("Could not establish the tunnel, but this host is accessible from the internet on %s, serving the proxy directly", endpoint)
+	connectDone()
+	printConnectionSuccess()
+	return true
+}
+
+// switchToDirect moves the agent to direct mode on publicIP and returns the
+// endpoint of the proxy. Requests are no longer held for the tunnel.
+func switchToDirect(publicIP string) string {
+	tunnelMu.Lock()
+	agentMode = modeDirect
+	endpoint := net.JoinHostPort(publicIP, strconv.Itoa(socks5proxyPort.Port))
+	tunnelMu.Unlock()
+	servingDirect.Store(true)
+	publicEndpoint.Store(endpoint)
+	return endpoint
+}
+
+func getPublicIP(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.ipify.org", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := publicIPClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -283,9 +1277,12 @@ func getPublicIP() (string, error) {
 	return strings.TrimSpace(string(ip)), nil
 }
 
+// netInterfaces lists the local network interfaces
+var netInterfaces = net.Interfaces
+
 func getLocalIPs() ([]string, error) {
 	var ips []string
-	ifaces, err := net.Interfaces()
+	ifaces, err := netInterfaces()
 	if err != nil {
 		return nil, err
 	}
@@ -298,61 +1295,431 @@ func getLocalIPs() ([]string, error) {
 
 		for _, addr := range addrs {
 			ip := addr.String()
-			if iputil.IsIP(ip) {
-				ips = append(ips, ip)
+			if !iputil.IsIP(ip) {
+				gologger.Debug().Str("interface", iface.Name).Str("address", ip).Msg("Skipping local address that is not an ip")
+				continue
 			}
+			ips = append(ips, ip)
 		}
 	}
 
 	return ips, nil
 }
 
+// remoteListenAddr is the address the server listens on for the reverse tunnel
+func remoteListenAddr(port int) string {
+	return net.JoinHostPort(remoteBind, strconv.Itoa(port))
+}
+
+// connectTunnel runs a tunnel session. Reconnects first request a new
+// reverse port since the server may have reclaimed the previous one, unless
+// -sticky-port tries the previous one first, and /in registration only
+// happens once the session listens on it.
+func connectTunnel(ctx context.Context, reconnect bool) error {
+	if reconnect {
+		emitEvent(eventReconnecting, nil)
+		refreshPunchHoleIP(ctx)
+		if previous := reverseProxyPort.Load(); stickyPort && previous != nil {
+			// a rejected listen falls back to a new port through NextRemoteListenAddr
+			gologger.Debug().Msgf("Reclaiming reverse port %d", previous.Port)
+		} else {
+			port, err := getFreePortFromServer(ctx, controlPlaneClient)
+			if err != nil {
+				return errors.Wrap(err, "error getting free port")
+			}
+			reverseProxyPort.Store(port)
+		}
+		// the http proxy listener has no listen retries, it always gets a new port
+		if httpProxyPort != nil {
+			port, err := getFreePortFromServer(ctx, controlPlaneClient)
+			if err != nil {
+				return errors.Wrap(err, "error getting free port")
+			}
+			reverseHTTPProxyPort = port
+		}
+	}
+
+	sessionCtx, sessionCancel := context.WithCancel(ctx)
+	defer sessionCancel()
+	if tunnelRotateInterval > 0 {
+		sessionCtx, sessionCancel = context.WithTimeout(sessionCtx, tunnelRotateInterval)
+		defer sessionCancel()
+	}
+	tunnelMu.Lock()
+	cancelSession = sessionCancel
+	tunnelMu.Unlock()
+
+	if err := createTunnelsWithGoSSH(sessionCtx); err != nil {
+		return err
+	}
+	if errors.Is(sessionCtx.Err(), context.DeadlineExceeded) {
+		gologger.Info().Msgf("Rotating tunnel after %s", tunnelRotateInterval)
+	}
+	return nil
+}
+
+// lookupIP resolves the punch-hole host
+var lookupIP = net.DefaultResolver.LookupIP
+
+// resolvePunchHole resolves the punch-hole host to all its addresses, IPv4
+// first with IPv6 after them for v6 only deployments
+func resolvePunchHole(ctx context.Context, host string) ([]string, error) {
+	if iputil.IsIP(host) {
+		return []string{host}, nil
+	}
+	ips, err := lookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error resolving %s", host)
+	}
+	var v4, v6 []string
+	for _, ip := range ips {
+		if iputil.IsIPv4(ip) {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, errors.Errorf("no IP address found for %s", host)
+	}
+	return append(v4, v6...), nil
+}
+
+// setPunchHoleIPs records the resolved addresses, the address in use is kept
+// while the host still resolves to it
+func setPunchHoleIPs(ips []string) (previous string, changed bool) {
+	punchHoleMu.Lock()
+	defer punchHoleMu.Unlock()
+
+	punchHoleIPs = ips
+	previous = punchHoleIP
+	if !slices.Contains(ips, punchHoleIP) {
+		punchHoleIP = ips[0]
+	}
+	return previous, previous != punchHoleIP
+}
+
+// currentPunchHoleIP returns the address of the punch-hole server in use
+func currentPunchHoleIP() string {
+	punchHoleMu.RLock()
+	defer punchHoleMu.RUnlock()
+	return punchHoleIP
+}
+
+// refreshPunchHoleIP re-resolves the punch-hole host so reconnects follow
+// DNS based failover, the current ip is kept when resolution fails
+func refreshPunchHoleIP(ctx context.Context) {
+	host, _ := activePunchHole()
+	ips, err := resolvePunchHole(ctx, host)
+	if err != nil {
+		gologger.Warning().Msgf("%v, reconnecting to %s", err, currentPunchHoleIP())
+		return
+	}
+	if previous, changed := setPunchHoleIPs(ips); changed {
+		gologger.Info().Msgf("%s now resolves to %s (was %s)", host, currentPunchHoleIP(), previous)
+	}
+}
+
+// dialPunchHole dials the port of addr on the addresses of the punch-hole host,
+// starting with the one in use and falling back to the others in order.
+// The first address that connects becomes the one in use.
+func dialPunchHole(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	punchHoleMu.RLock()
+	current := punchHoleIP
+	candidates := append([]string{current}, slices.DeleteFunc(slices.Clone(punchHoleIPs), func(ip string) bool {
+		return ip == current
+	})...)
+	punchHoleMu.RUnlock()
+
+	for _, ip := range candidates {
+		var conn net.Conn
+		conn, err = sshDialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err != nil {
+			gologger.Debug().Msgf("could not connect to %s: %v", ip, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if ip != current {
+			gologger.Info().Msgf("%s is unreachable, using %s", current, ip)
+			punchHoleMu.Lock()
+			punchHoleIP = ip
+			punchHoleMu.Unlock()
+		}
+		return conn, nil
+	}
+	host, _ := activePunchHole()
+	return nil, errors.Wrapf(err, "could not connect to any address of %s", host)
+}
+
+// requestReconnect ends the current tunnel session, the reconnect loop then
+// establishes a new one
+func requestReconnect() bool {
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+	if cancelSession == nil {
+		return false
+	}
+	cancelSession()
+	return true
+}
+
+// handleInterrupt shuts down gracefully on the first interrupt or SIGTERM
+func handleInterrupt(signals <-chan os.Signal) {
+	<-signals
+	gologger.Print().Msg("Received interrupt signal, shutting down...")
+	shutdown()
+	exitProcess(0)
+}
+
+// handleSighup re-registers the agent or re-establishes the tunnel on
+// SIGHUP, as selected by -sighup
+func handleSighup(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		switch sighupAction {
+		case sighupReconnect:
+			gologger.Info().Msg("Received SIGHUP, reconnecting tunnel...")
+			if !requestReconnect() {
+				gologger.Warning().Msg("no tunnel session to reconnect")
+			}
+		default:
+			gologger.Info().Msg("Received SIGHUP, re-registering agent...")
+			if !tunnelConnected.Load() {
+				gologger.Warning().Msg("tunnel is not connected, not re-registering")
+				continue
+			}
+			reregister(ctx)
+		}
+	}
+}
+
+// reregister calls /in outside the heartbeat loop. It holds healthMu so a
+// shutdown deregisters only after it, and skips the call once one started.
+func reregister(ctx context.Context) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if shuttingDown.Load() {
+		return
+	}
+	if err := inFunctionTickCallback(ctx, controlPlaneClient, false); err != nil {
+		gologger.Warning().Msgf("error re-registering agent: %v", err)
+	}
+}
+
 func createTunnelsWithGoSSH(ctx context.Context) error {
-	server := fmt.Sprintf("%s:%s", punchHoleIP, PunchHolePort)
+	apiKey := currentAPIKey()
+	_, sshPort := activePunchHole()
+	server := net.JoinHostPort(currentPunchHoleIP(), sshPort)
+	// offered tells an auth failure apart from one before the key was sent
+	var offered atomic.Bool
 	sshConfig := &ssh.ClientConfig{
-		User: AgentID,
+		Config: sshAlgorithms,
+		User:   currentAgentID(),
 		Auth: []ssh.AuthMethod{
-			ssh.Password(proxyPassword),
+			ssh.PasswordCallback(func() (string, error) {
+				offered.Store(true)
+				return apiKey, nil
+			}),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         sshTimeout,
 	}
 	sshrConfig := &sshr.Config{
-		SSHServer:        server,
-		SSHClientConfig:  sshConfig,
-		RemoteListenAddr: fmt.Sprintf("0.0.0.0:%d", reverseProxyPort.Port),
-		LocalTarget:      fmt.Sprintf("localhost:%d", socks5proxyPort.Port),
-		Logger:           slog.Default(),
+		SSHServer:               server,
+		SSHClientConfig:         sshConfig,
+		Dialer:                  dialPunchHole,
+		RemoteListenAddr:        remoteListenAddr(reverseProxyPort.Load().Port),
+		Logger:                  slog.Default(),
+		Stats:                   tunnelStats,
+		Compression:             sshr.Compression(compression),
+		DrainTimeout:            drainTimeout,
+		DrainConnectionTimeout:  drainConnectionTimeout,
+		DrainInBackground:       overlapReconnect,
+		OperationDeadline:       operationDeadline,
+		ConnectionDeadline:      connectionDeadline,
+		Routes:                  tunnelRoutes,
+		HealthCheckTimeout:      healthCheckTimeout,
+		LocalDialRetries:        localDialRetries,
+		AcceptBacklog:           acceptBacklog,
+		AcceptProxyProtocol:     acceptProxyProtocol,
+		MaxConnectionsPerSource: maxConnectionsPerSource,
+		TraceBytes:              traceBytes,
+		ListenRetries:           remoteListenRetries,
+		NextRemoteListenAddr: func() (string, error) {
+			port, err := getFreePortFromServer(ctx, controlPlaneClient)
+			if err != nil {
+				return "", err
+			}
+			if previous := reverseProxyPort.Swap(port); stickyPort && previous != nil {
+				gologger.Warning().Msgf("Reverse port %d was rejected, the public endpoint moves to port %d", previous.Port, port.Port)
+			}
+			return remoteListenAddr(port.Port), nil
+		},
 		SuccessHook: func() {
 			connectionSucceededCount++
+			resetFailover()
+			setTunnelConnected(true)
+			publicEndpoint.Store(net.JoinHostPort(currentPunchHoleIP(), strconv.Itoa(reverseProxyPort.Load().Port)))
+			emitEvent(eventConnected, nil)
+			if reverseHTTPProxyPort != nil {
+				gologger.Info().Msgf("HTTP proxy reachable on %s", net.JoinHostPort(currentPunchHoleIP(), strconv.Itoa(reverseHTTPProxyPort.Port)))
+			}
 
-			// Run the background /in routine for healthchecking
-			go func() {
-				if err := In(ctx); err != nil {
-					printConnectionFailure(errors.Wrap(err, "error registering tunnel"))
+			if noRegister {
+				connectDone()
+				gologger.Info().Msgf("Tunnel established on %s, not registering with -no-register", publicEndpoint.Load())
+				if reachabilityURL != "" {
+					go runReachabilityCheck()
 				}
-			}()
+				return
+			}
+			// Run the background /in routine for healthchecking
+			startHealthLoop(ctx)
 		},
 	}
+	// publish the tunnel under the lock so a socks5 restart is not missed
+	tunnelMu.Lock()
+	sshrConfig.LocalTarget = localDialAddress(socks5proxyPort)
+	if httpProxyPort != nil {
+		sshrConfig.Forwards = []sshr.Forward{{
+			RemoteListenAddr: remoteListenAddr(reverseHTTPProxyPort.Port),
+			LocalTarget:      localDialAddress(httpProxyPort),
+		}}
+	}
 	s, err := sshr.New(*sshrConfig)
+	if err == nil {
+		currentTunnel = s
+	}
+	tunnelMu.Unlock()
 	if err != nil {
 		return err
 	}
+	defer setTunnelConnected(false)
 
-	return s.Run(ctx)
+	err = s.Run(ctx)
+	if overlapReconnect {
+		drainingTunnels.Add(1)
+		go func() {
+			<-s.Drained()
+			drainingTunnels.Done()
+		}()
+	}
+	if tunnelConnected.Load() {
+		emitEvent(eventDisconnected, err)
+	}
+	if offered.Load() && isAuthError(err) {
+		// the reconnect loop retries with the other key
+		rejectAPIKey(apiKey)
+	}
+	return err
 }
 
-func getFreePortFromServer() (*freeport.Port, error) {
-	endpoint := fmt.Sprintf("http://%s:%s/freeport", punchHoleIP, PunchHoleHTTPPort)
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+// getFreeTCPPort returns a free local tcp port on ip, which may be IPv4 or IPv6
+func getFreeTCPPort(ip string) (*freeport.Port, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-API-Key", proxyPassword)
-	resp, err := httpClient.Do(req)
+	addr := l.Addr().(*net.TCPAddr)
+	if err := l.Close(); err != nil {
+		return nil, err
+	}
+	return &freeport.Port{Address: ip, Port: addr.Port, Protocol: freeport.TCP, NetListenAddress: addr.String()}, nil
+}
+
+// localDialAddress is the address a local listener on port is reached at,
+// loopback when it listens on all addresses
+func localDialAddress(port *freeport.Port) string {
+	host, _, err := net.SplitHostPort(port.NetListenAddress)
+	if err != nil {
+		host = port.Address
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port.Port))
+}
+
+// userAgent identifies the agent version and platform to the control plane
+var userAgent = fmt.Sprintf("tunnelx/%s (%s; %s)", version, runtime.GOOS, runtime.GOARCH)
+
+// newControlPlaneRequest creates an authenticated request to a control plane endpoint
+func newControlPlaneRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, controlPlaneURL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", currentAPIKey())
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Agent-ID", currentAgentID())
+	return req, nil
+}
+
+// controlPlaneURL returns the url of a control plane endpoint
+func controlPlaneURL(path string) string {
+	scheme, host := controlPlaneScheme(), currentPunchHoleIP()
+	// certificates are issued for the host name, dialControlPlane still
+	// connects to the resolved ip
+	if scheme == "https" {
+		host, _ = activePunchHole()
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, PunchHoleHTTPPort), path)
+}
+
+// controlPlaneScheme is -http-scheme, or https for the production host and
+// http for other hosts when unset
+func controlPlaneScheme() string {
+	if httpScheme != "" {
+		return httpScheme
+	}
+	if host, _ := activePunchHole(); host == defaultPunchHoleHost {
+		return "https"
+	}
+	return "http"
+}
+
+// getFreePortFromServer calls /freeport, retrying failures and invalid
+// ports until freePortAttempts is reached or ctx is done
+func getFreePortFromServer(ctx context.Context, client *http.Client) (*freeport.Port, error) {
+	for attempt := 1; ; attempt++ {
+		port, err := requestFreePort(ctx, client)
+		if err == nil || attempt == freePortAttempts || ctx.Err() != nil {
+			return port, err
+		}
+		gologger.Debug().Msgf("/freeport attempt %d failed: %v", attempt, err)
+		select {
+		case <-time.After(controlPlaneBackoff.NextDelay(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func requestFreePort(ctx context.Context, client *http.Client) (*freeport.Port, error) {
+	req, err := newControlPlaneRequest(ctx, http.MethodGet, "/freeport", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
+		// drain what the decoder left so the connection can be reused
+		_, _ = io.Copy(io.Discard, resp.Body)
 		_ = resp.Body.Close()
 	}()
 
@@ -363,41 +1730,140 @@ func getFreePortFromServer() (*freeport.Port, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
 	}
-	port := freeport.Port{Address: punchHoleIP, Port: result.Port, Protocol: freeport.TCP}
+	if result.Port < 1 || result.Port > 65535 {
+		return nil, fmt.Errorf("/freeport endpoint returned invalid port %d", result.Port)
+	}
+	host := currentPunchHoleIP()
+	port := freeport.Port{
+		Address:          host,
+		Port:             result.Port,
+		Protocol:         freeport.TCP,
+		NetListenAddress: net.JoinHostPort(host, strconv.Itoa(result.Port)),
+	}
 
 	return &port, nil
 }
 
-func In(ctx context.Context) error {
-	ticker := time.NewTicker(time.Minute)
+// nextHeartbeat returns the delay until the next heartbeat, randomized by
+// up to heartbeatJitter either way so agents started together spread out
+func nextHeartbeat() time.Duration {
+	jitter := min(heartbeatJitter, heartbeatInterval/2)
+	if jitter <= 0 {
+		return heartbeatInterval
+	}
+	return heartbeatInterval - jitter + rand.N(2*jitter)
+}
+
+// startHealthLoop runs In for the tunnel session ctx in the background. The
+// loop of a previous session is stopped first, so a single loop sends heartbeats.
+func startHealthLoop(ctx context.Context) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if shuttingDown.Load() {
+		return
+	}
+	if stopHealth != nil {
+		stopHealth()
+	}
+
+	markHeartbeat()
+	loopCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	stopHealth = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		if err := In(loopCtx, controlPlaneClient); err != nil {
+			printConnectionFailure(errors.Wrap(err, "error registering tunnel"))
+		}
+	}()
+}
+
+// In registers the tunnel on client and sends heartbeats until ctx, the tunnel
+// session, is done. It returns an error only when a heartbeat fails, after
+// deregistering and stopping the agent.
+func In(ctx context.Context, client *http.Client) (err error) {
+	timer := time.NewTimer(nextHeartbeat())
 	defer func() {
-		ticker.Stop()
-		if err := Out(ctx); err != nil {
-			gologger.Warning().Msgf("error deregistering tunnel: %v", err)
+		timer.Stop()
+		// the session ending is not a heartbeat failure
+		if ctx.Err() != nil {
+			err = nil
+			return
+		}
+		if !noDeregister {
+			if err := Out(ctx, client); err != nil {
+				gologger.Warning().Msgf("error deregistering tunnel: %v", err)
+			}
 		}
 		cancel()
 	}()
 
 	// Run first time to register
-	if err := inFunctionTickCallback(ctx, true); err != nil {
+	registerCtx, span := otel.Tracer("github.com/projectdiscovery/tunnelx").Start(ctx, "tunnel.register")
+	err = inFunctionTickCallback(registerCtx, client, true)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	if err != nil {
+		if errors.Is(err, errAgentIDConflict) && onIDConflict == idConflictRegenerate {
+			previous, id := currentAgentID(), namespacedID(xid.New().String())
+			setAgentID(id)
+			gologger.Warning().Msgf("agent id %s is already registered by another agent, reconnecting as %s", previous, id)
+			// the ssh user is the agent id, so the tunnel has to be re-established
+			requestReconnect()
+			return nil
+		}
 		return err
 	}
+	markHeartbeat()
+
+	// a suspended host misses heartbeats, the server may already consider
+	// the session gone on resume
+	clock := newClockMonitor()
+	clockCheck := time.NewTicker(clockCheckInterval)
+	defer clockCheck.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			if err := inFunctionTickCallback(ctx, false); err != nil {
+			return nil
+		case <-clockCheck.C:
+			if skew, jumped := clock.observe(); jumped {
+				gologger.Warning().Msgf("system clock jumped by %s, the host was probably suspended, sending a heartbeat now", skew.Round(time.Second))
+				timer.Reset(0)
+			}
+		case <-timer.C:
+			timer.Reset(nextHeartbeat())
+			if err := inFunctionTickCallback(ctx, client, false); err != nil {
 				return err
 			}
+			markHeartbeat()
+			if !noMetrics {
+				if err := pushMetrics(ctx, client); err != nil {
+					gologger.Warning().Msgf("error pushing metrics: %v", err)
+				}
+			}
 		}
 	}
 }
 
-func inFunctionTickCallback(ctx context.Context, first bool) error {
-	endpoint := fmt.Sprintf("http://%s:%s/in", punchHoleIP, PunchHoleHTTPPort)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+// inResponse holds the directives the server may send in the /in response
+type inResponse struct {
+	// Reconnect asks the agent to re-establish the tunnel, e.g. before the
+	// server is drained
+	Reconnect bool `json:"reconnect"`
+}
+
+// errAgentIDConflict is returned by /in when another agent uses the same id
+var errAgentIDConflict = errors.New("agent id is already registered by another agent")
+
+func inFunctionTickCallback(ctx context.Context, client *http.Client, first bool) error {
+	req, err := newControlPlaneRequest(ctx, http.MethodPost, "/in", nil)
 	if err != nil {
 		log.Printf("failed to create request: %v", err)
 		return err
@@ -405,10 +1871,14 @@ func inFunctionTickCallback(ctx context.Context, first bool) error {
 	q := req.URL.Query()
 	q.Add("os", runtime.GOOS)
 	q.Add("arch", runtime.GOARCH)
-	q.Add("id", AgentID)
+	q.Add("id", currentAgentID())
+	q.Add("version", version)
+	q.Add("go", runtime.Version())
+	if revision := buildCommit(); revision != "" {
+		q.Add("commit", revision)
+	}
 	req.URL.RawQuery = q.Encode()
-	req.Header.Set("X-API-Key", proxyPassword)
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("failed to call /in endpoint: %v", err)
 		return err
@@ -421,14 +1891,32 @@ func inFunctionTickCallback(ctx context.Context, first bool) error {
 		log.Printf("failed to read response body: %v", err)
 		return err
 	}
+	if resp.StatusCode == http.StatusConflict {
+		return errAgentIDConflict
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("unexpected status code from /in endpoint: %d, body: %s", resp.StatusCode, string(body))
 		return fmt.Errorf("unexpected status code from /in endpoint: %v, body: %s", resp.StatusCode, string(body))
 	}
-	time.Sleep(1000 * time.Millisecond)
+	// the body is optional, older servers answer without one
+	var directive inResponse
+	if json.Unmarshal(body, &directive) == nil && directive.Reconnect {
+		gologger.Info().Msgf("Server asked to reconnect, re-establishing the tunnel")
+		requestReconnect()
+		return nil
+	}
 	if first {
+		connectDone()
+		emitEvent(eventRegistered, nil)
+		if selfTest {
+			go runSelfTest()
+		}
+		if reachabilityURL != "" {
+			go runReachabilityCheck()
+		}
+		// the agent is registered once /in succeeded, so it can be renamed right away
 		if AgentName != "" {
-			if err := renameAgent(ctx, AgentName); err != nil {
+			if err := renameAgentWithRetry(ctx, client, AgentName); err != nil {
 				gologger.Error().Msgf("error renaming agent: %v", err)
 			}
 		}
@@ -440,18 +1928,16 @@ func inFunctionTickCallback(ctx context.Context, first bool) error {
 	return nil
 }
 
-func Out(ctx context.Context) error {
-	endpoint := fmt.Sprintf("http://%s:%s/out", punchHoleIP, PunchHoleHTTPPort)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+func Out(ctx context.Context, client *http.Client) error {
+	req, err := newControlPlaneRequest(ctx, http.MethodPost, "/out", nil)
 	if err != nil {
 		log.Printf("failed to create request: %v", err)
 		return err
 	}
-	req.Header.Set("X-API-Key", proxyPassword)
 	q := req.URL.Query()
-	q.Add("id", AgentID)
+	q.Add("id", currentAgentID())
 	req.URL.RawQuery = q.Encode()
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("failed to call /out endpoint: %v", err)
 		return err
@@ -470,21 +1956,73 @@ func Out(ctx context.Context) error {
 	return nil
 }
 
-func renameAgent(ctx context.Context, name string) error {
-	endpoint := fmt.Sprintf("http://%s:%s/rename", punchHoleIP, PunchHoleHTTPPort)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+// metricsPayload is the body sent to the /metrics endpoint
+type metricsPayload struct {
+	ID string `json:"id"`
+	sshr.StatsSnapshot
+	Destinations map[string]uint64 `json:"destinations,omitempty"`
+}
+
+func pushMetrics(ctx context.Context, client *http.Client) error {
+	payload, err := json.Marshal(metricsPayload{ID: currentAgentID(), StatsSnapshot: tunnelStats.Snapshot(), Destinations: destinationCounts()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal metrics: %v", err)
+	}
+
+	req, err := newControlPlaneRequest(ctx, http.MethodPost, "/metrics", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call /metrics endpoint: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from /metrics endpoint: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// renameAgentWithRetry calls /rename, retrying transient failures until
+// renameAttempts is reached or ctx is done
+func renameAgentWithRetry(ctx context.Context, client *http.Client, name string) error {
+	for attempt := 1; ; attempt++ {
+		err := renameAgent(ctx, client, name)
+		if err == nil || attempt == renameAttempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(controlPlaneBackoff.NextDelay(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func renameAgent(ctx context.Context, client *http.Client, name string) error {
+	req, err := newControlPlaneRequest(ctx, http.MethodPost, "/rename", nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
 
 	q := req.URL.Query()
-	q.Add("id", AgentID)
+	q.Add("id", currentAgentID())
 	q.Add("name", name)
 	req.URL.RawQuery = q.Encode()
 
-	req.Header.Set("X-API-Key", proxyPassword)
-
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to call /rename endpoint: %v", err)
 	}
@@ -0,0 +1,1576 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/freeport"
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/gologger/levels"
+	"github.com/projectdiscovery/gologger/writer"
+	"github.com/projectdiscovery/tunnelx/sshr"
+	"github.com/rs/xid"
+	socks5 "github.com/things-go/go-socks5"
+	"golang.org/x/net/proxy"
+)
+
+// setForTest sets a package variable for the duration of the test. Tests in
+// this package share globals and must not run in parallel.
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	previous := *p
+	*p = v
+	t.Cleanup(func() {
+		*p = previous
+	})
+}
+
+// setReverseProxyPortForTest is setForTest for the atomic reverseProxyPort
+func setReverseProxyPortForTest(t *testing.T, port *freeport.Port) {
+	t.Helper()
+	previous := reverseProxyPort.Swap(port)
+	t.Cleanup(func() {
+		reverseProxyPort.Store(previous)
+	})
+}
+
+// setAgentIDForTest sets the agent id in use for the duration of the test
+func setAgentIDForTest(t *testing.T, id string) {
+	t.Helper()
+	previous := currentAgentID()
+	setAgentID(id)
+	t.Cleanup(func() {
+		setAgentID(previous)
+	})
+}
+
+// bufferWriter is a gologger writer keeping every line it is given
+type bufferWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *bufferWriter) Write(data []byte, _ levels.Level) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(data)
+	w.buf.WriteByte('\n')
+}
+
+func (w *bufferWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// captureLogs keeps the gologger output up to level for the duration of the test
+func captureLogs(t *testing.T, level levels.Level) *bufferWriter {
+	t.Helper()
+	logs := &bufferWriter{}
+	gologger.DefaultLogger.SetWriter(logs)
+	gologger.DefaultLogger.SetMaxLevel(level)
+	t.Cleanup(func() {
+		gologger.DefaultLogger.SetWriter(writer.NewCLI())
+		gologger.DefaultLogger.SetMaxLevel(levels.LevelInfo)
+	})
+	return logs
+}
+
+func TestLocalDialAddress(t *testing.T) {
+	for listen, want := range map[string]string{
+		"0.0.0.0:1080":      "127.0.0.1:1080",
+		"[::]:1080":         "[::1]:1080",
+		"192.168.1.10:1080": "192.168.1.10:1080",
+		"[fd00::1]:1080":    "[fd00::1]:1080",
+		"127.0.0.1:1080":    "127.0.0.1:1080",
+	} {
+		got := localDialAddress(&freeport.Port{Port: 1080, NetListenAddress: listen})
+		if got != want {
+			t.Errorf("listening on %s dials %s, want %s", listen, got, want)
+		}
+	}
+}
+
+func TestTrackingListenerDrain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracking := trackingListener{listener}
+	defer func() {
+		_ = tracking.Close()
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	conn, err := tracking.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		waitDrained(&socks5Conns, time.After(10*time.Second))
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drained with an open connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not drained once the connection was closed")
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var payload map[string]any
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			t.Errorf("request to %s, want /metrics", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+	}))
+	setForTest(t, &tunnelStats, &sshr.Stats{})
+	setAgentIDForTest(t, "agent-1")
+
+	if err := pushMetrics(context.Background(), http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	if payload["id"] != "agent-1" {
+		t.Errorf("metrics for agent %v, want agent-1", payload["id"])
+	}
+	for _, counter := range []string{"active_connections", "total_connections", "bytes_in", "bytes_out", "accept_errors", "target_resets", "rejected_connections"} {
+		if _, ok := payload[counter]; !ok {
+			t.Errorf("metrics payload %v has no %s", payload, counter)
+		}
+	}
+}
+
+// startStalledServer accepts tcp connections and never answers on them
+func startStalledServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+		}
+	}()
+	return listener
+}
+
+func TestConnectTimeout(t *testing.T) {
+	stalled := startStalledServer(t)
+	_, port, _ := net.SplitHostPort(stalled.Addr().String())
+	setForTest(t, &PunchHoleHost, "127.0.0.1")
+	setForTest(t, &PunchHolePort, port)
+	setForTest(t, &punchHoleIP, "127.0.0.1")
+	setForTest(t, &punchHoleIPs, []string{"127.0.0.1"})
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &socks5proxyPort, &freeport.Port{Port: 1080, NetListenAddress: "127.0.0.1:1080"})
+	setReverseProxyPortForTest(t, &freeport.Port{Port: 20000})
+	setForTest(t, &currentTunnel, nil)
+	setForTest(t, &sshTimeout, time.Second)
+	setForTest(t, &connectTimeout, 100*time.Millisecond)
+	setForTest(t, &connectCtx, connectCtx)
+	setForTest(t, &connectDone, connectDone)
+	timedOut := make(chan error, 1)
+	setForTest(t, &onConnectTimeout, func(err error) {
+		timedOut <- err
+	})
+
+	startConnectTimeout()
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- createTunnelsWithGoSSH(context.Background())
+	}()
+	select {
+	case err := <-timedOut:
+		if !strings.Contains(err.Error(), "not established within 100ms") {
+			t.Fatalf("reported %v, want the connect timeout", err)
+		}
+	case <-dialed:
+		t.Fatal("the ssh dial finished before the connect timeout was reported")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout not reported")
+	}
+	if err := <-dialed; err == nil {
+		t.Fatal("the ssh dial succeeded against a server never completing the handshake")
+	}
+}
+
+// socks5Handshake checks a socks5 server without authentication answers on addr
+func socks5Handshake(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		t.Fatalf("socks5 server on %s replied %v", addr, reply)
+	}
+}
+
+// currentSocks5Listener waits for the socks5 server to listen on a port other than previous
+func currentSocks5Listener(t *testing.T, previous net.Listener) net.Listener {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		tunnelMu.Lock()
+		listener := socks5Listener
+		tunnelMu.Unlock()
+		if listener != nil && listener != previous {
+			return listener
+		}
+	}
+	t.Fatal("socks5 server not listening within 5s")
+	return nil
+}
+
+func TestServeSocks5Restarts(t *testing.T) {
+	port, err := getFreeTCPPort("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &socks5proxyPort, port)
+	setForTest(t, &socks5Listener, nil)
+	setForTest(t, &currentTunnel, nil)
+	setForTest(t, &teardownDone, make(chan struct{}))
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serveSocks5(socks5.NewServer(), "127.0.0.1", nil)
+	}()
+	first := currentSocks5Listener(t, nil)
+	socks5Handshake(t, first.Addr().String())
+
+	// the listener dies under the server
+	_ = first.Close()
+	restarted := currentSocks5Listener(t, first)
+	tunnelMu.Lock()
+	listenAddress := socks5proxyPort.NetListenAddress
+	tunnelMu.Unlock()
+	if listenAddress == port.NetListenAddress || restarted.Addr().String() != listenAddress {
+		t.Fatalf("restarted on %s with the socks5 port at %s, want a new port", restarted.Addr(), listenAddress)
+	}
+	socks5Handshake(t, listenAddress)
+
+	shuttingDown.Store(true)
+	close(teardownDone)
+	_ = restarted.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("serveSocks5 returned %v on shutdown", err)
+	}
+}
+
+func TestValidateBindNoProxyAuth(t *testing.T) {
+	setForTest(t, &noProxyAuth, true)
+	setForTest(t, &remoteBind, "0.0.0.0")
+	setForTest(t, &publicIPOverride, "")
+	for bind, allowed := range map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"10.0.0.5":    true,
+		"192.168.1.5": true,
+		"fd00::1":     true,
+		"203.0.113.7": false,
+		"0.0.0.0":     false,
+		"":            false,
+	} {
+		setForTest(t, &bindIP, bind)
+		if err := validateBind(); (err == nil) != allowed {
+			t.Errorf("-no-proxy-auth with -bind %q: %v, want allowed %t", bind, err, allowed)
+		}
+	}
+}
+
+func TestGetFreeTCPPortIPv6(t *testing.T) {
+	port, err := getFreeTCPPort("::1")
+	if err != nil {
+		t.Skipf("no ipv6 loopback: %v", err)
+	}
+	if port.Address != "::1" || port.Protocol != freeport.TCP {
+		t.Fatalf("got port %+v, want a tcp port on ::1", port)
+	}
+	listener, err := net.Listen("tcp", port.NetListenAddress)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", port.NetListenAddress, err)
+	}
+	_ = listener.Close()
+	if want := net.JoinHostPort("::1", strconv.Itoa(port.Port)); port.NetListenAddress != want || localDialAddress(port) != want {
+		t.Fatalf("listen address %s dialed at %s, want %s", port.NetListenAddress, localDialAddress(port), want)
+	}
+}
+
+func TestRequestFreePortIPv6(t *testing.T) {
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"port":20001}`))
+	}))
+	// the control plane answers on loopback, the reverse port is on the v6 punch-hole ip
+	setForTest(t, &PunchHoleHost, "2001:db8::1")
+	setForTest(t, &punchHoleIP, "2001:db8::1")
+	local := http.DefaultTransport.(*http.Transport).Clone()
+	local.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort("127.0.0.1", PunchHoleHTTPPort))
+	}
+
+	port, err := requestFreePort(context.Background(), &http.Client{Transport: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port.NetListenAddress != "[2001:db8::1]:20001" || port.Address != "2001:db8::1" {
+		t.Fatalf("got port %+v, want [2001:db8::1]:20001", port)
+	}
+}
+
+func TestDeregisterRetries(t *testing.T) {
+	var calls atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/out" {
+			t.Errorf("request to %s, want /out", r.URL.Path)
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	setForTest(t, &controlPlaneClient, &http.Client{})
+	setForTest(t, &controlPlaneBackoff, BackoffPolicy(constantBackoff{delay: time.Millisecond}))
+
+	deregister()
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("/out called %d times, want a retry after the failure", got)
+	}
+}
+
+func TestDeregisterGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	setForTest(t, &controlPlaneClient, &http.Client{})
+	setForTest(t, &controlPlaneBackoff, BackoffPolicy(constantBackoff{delay: time.Millisecond}))
+
+	deregister()
+	if got := calls.Load(); got != deregisterAttempts {
+		t.Fatalf("/out called %d times, want %d attempts", got, deregisterAttempts)
+	}
+}
+
+func TestControlPlaneHeaders(t *testing.T) {
+	headers := make(map[string]http.Header)
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers[r.URL.Path] = r.Header.Clone()
+		if r.URL.Path == "/freeport" {
+			_, _ = w.Write([]byte(`{"port":20001}`))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	setForTest(t, &connectionSucceededCount, 2)
+	setAgentIDForTest(t, "agent-1")
+
+	ctx, client := context.Background(), &http.Client{}
+	if err := inFunctionTickCallback(ctx, client, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Out(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameAgent(ctx, client, "scanner"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestFreePort(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/in", "/out", "/rename", "/freeport"} {
+		header, ok := headers[path]
+		if !ok {
+			t.Errorf("no %s request", path)
+			continue
+		}
+		if got := header.Get("User-Agent"); !strings.HasPrefix(got, "tunnelx/") || got != userAgent {
+			t.Errorf("%s sent User-Agent %q, want %q", path, got, userAgent)
+		}
+		if got := header.Get("X-Agent-ID"); got != "agent-1" {
+			t.Errorf("%s sent X-Agent-ID %q, want agent-1", path, got)
+		}
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		key      string
+		provided bool
+		err      string
+	}{
+		{"unset", "", false, "not configured"},
+		{"empty", "", true, "provided but empty"},
+		{"whitespace", " \t\n", true, "provided but empty"},
+		{"valid", "  key\n", true, ""},
+	} {
+		setForTest(t, &proxyPassword, tc.key)
+		setForTest(t, &apiKeyProvided, tc.provided)
+		err := validateAPIKey()
+		if tc.err == "" {
+			if err != nil || proxyPassword != "key" {
+				t.Errorf("%s key: %v with key %q, want the trimmed key", tc.name, err, proxyPassword)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s key: %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestPrepareChecksAPIKeyFirst(t *testing.T) {
+	setForTest(t, &proxyPassword, "")
+	setForTest(t, &apiKeyProvided, false)
+	setForTest(t, &forwardOnly, false)
+	// nothing is resolved or validated before the key
+	setForTest(t, &PunchHoleHost, "")
+	setForTest(t, &discoveryURL, "http://192.0.2.1/discovery")
+	if err := prepare(); err == nil || !strings.Contains(err.Error(), "PDCP_API_KEY is not configured") {
+		t.Fatalf("prepare returned %v, want the missing key reported", err)
+	}
+}
+
+func TestReconnectRequestsFreePort(t *testing.T) {
+	var ports atomic.Int32
+	ports.Store(20001)
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"port":%d}`, ports.Add(1))
+	}))
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &remoteBind, "0.0.0.0")
+	setForTest(t, &stickyPort, false)
+	setForTest(t, &controlPlaneClient, &http.Client{})
+
+	for _, want := range []string{"0.0.0.0:20002", "0.0.0.0:20003"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- connectTunnel(ctx, true)
+		}()
+		echoThrough(t, srv.nextForward(), "hello")
+		binds := srv.requestedBinds()
+		if got := binds[len(binds)-1]; got != want {
+			t.Fatalf("reconnected listening on %s, want the new free port at %s", got, want)
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStickyPort(t *testing.T) {
+	for _, reclaimed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reclaimed=%t", reclaimed), func(t *testing.T) {
+			var requested atomic.Int32
+			startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested.Add(1)
+				_, _ = w.Write([]byte(`{"port":20005}`))
+			}))
+			srv := startPunchHoleServer(t)
+			usePunchHole(t, srv, startEchoTarget(t))
+			setForTest(t, &remoteBind, "0.0.0.0")
+			setForTest(t, &stickyPort, true)
+			setForTest(t, &controlPlaneClient, &http.Client{})
+			if !reclaimed {
+				// another agent took the port while this one was away
+				srv.rejectBind = func(addr string) bool {
+					return addr == "0.0.0.0:20001"
+				}
+			}
+			logs := captureLogs(t, levels.LevelWarning)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- connectTunnel(ctx, true)
+			}()
+			echoThrough(t, srv.nextForward(), "hello")
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			binds := srv.requestedBinds()
+			if reclaimed {
+				if len(binds) != 1 || binds[0] != "0.0.0.0:20001" || requested.Load() != 0 {
+					t.Fatalf("reconnect listened on %v after %d /freeport calls, want port 20001 reclaimed", binds, requested.Load())
+				}
+				if strings.Contains(logs.String(), "public endpoint moves") {
+					t.Fatalf("endpoint change logged for a reclaimed port:\n%s", logs)
+				}
+				return
+			}
+			if got := binds[len(binds)-1]; got != "0.0.0.0:20005" || requested.Load() != 1 {
+				t.Fatalf("reconnect listened on %v after %d /freeport calls, want a new port once 20001 was rejected", binds, requested.Load())
+			}
+			if port := reverseProxyPort.Load().Port; port != 20005 {
+				t.Fatalf("reverse port is %d, want the new one", port)
+			}
+			if !strings.Contains(logs.String(), "Reverse port 20001 was rejected, the public endpoint moves to port 20005") {
+				t.Fatalf("endpoint change not logged:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestRemoteBind(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &remoteBind, "127.0.0.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- createTunnelsWithGoSSH(ctx)
+	}()
+	srv.nextForward()
+	if binds := srv.requestedBinds(); len(binds) != 1 || binds[0] != "127.0.0.1:20001" {
+		t.Fatalf("tunnel requested %v, want a listener on 127.0.0.1:20001", binds)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	setForTest(t, &bindIP, "")
+	setForTest(t, &noProxyAuth, false)
+	setForTest(t, &publicIPOverride, "")
+	for _, bind := range []string{"", "localhost", "10.0.0.300"} {
+		setForTest(t, &remoteBind, bind)
+		if err := validateBind(); err == nil {
+			t.Errorf("-remote-bind %q accepted", bind)
+		}
+	}
+}
+
+func TestAccessibilityWithoutInterfaces(t *testing.T) {
+	setForTest(t, &netInterfaces, func() ([]net.Interface, error) {
+		return nil, errors.New("route ip+net: netlinkrib: permission denied")
+	})
+	setForTest(t, &onceRemoteIp, func() (string, error) {
+		return "203.0.113.7", nil
+	})
+	accessible, err := isServiceAccessibleFromInternet()
+	if err != nil || accessible {
+		t.Fatalf("accessible %t with %v, want the tunnel used without an error", accessible, err)
+	}
+
+	setForTest(t, &publicIPOverride, "203.0.113.7")
+	setForTest(t, &bindIP, "")
+	setForTest(t, &agentMode, modeTunnel)
+	if fallBackToDirect(context.Background()) || agentMode != modeTunnel {
+		t.Fatal("fell back to direct mode without knowing the local ips")
+	}
+}
+
+func TestAccessibilityDiagnostics(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("interfaces not enumerable: %v", err)
+	}
+	var loopback []net.Interface
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range ifaceAddrs {
+			addrs = append(addrs, addr.String())
+		}
+		loopback = append(loopback, iface)
+	}
+	if len(addrs) == 0 {
+		t.Skip("no loopback address")
+	}
+	setForTest(t, &netInterfaces, func() ([]net.Interface, error) {
+		return loopback, nil
+	})
+	logs := captureLogs(t, levels.LevelDebug)
+
+	accessible := hasLocalIP("198.51.100.1")
+	if accessible {
+		t.Fatal("public ip 198.51.100.1 found on the loopback interface")
+	}
+	output := ansiEscape.ReplaceAllString(logs.String(), "")
+	for _, want := range append(addrs, "public_ip=198.51.100.1", "accessible=false") {
+		if !strings.Contains(output, want) {
+			t.Errorf("accessibility diagnostics miss %s:\n%s", want, output)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("POD_NAME", "scanner-0")
+	t.Setenv("EMPTY_VAR", "")
+	for value, want := range map[string]string{
+		"tunnelx-${POD_NAME}":           "tunnelx-scanner-0",
+		"tunnelx-$POD_NAME":             "tunnelx-scanner-0",
+		"tunnelx-${UNDEFINED_VAR}":      "tunnelx-",
+		"tunnelx-${UNDEFINED_VAR:-dev}": "tunnelx-dev",
+		"tunnelx-${EMPTY_VAR:-dev}":     "tunnelx-dev",
+		"tunnelx-${POD_NAME:-dev}":      "tunnelx-scanner-0",
+		"10.0.0.1":                      "10.0.0.1",
+	} {
+		if got := expandEnv(value); got != want {
+			t.Errorf("expandEnv(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestNextHeartbeatJitter(t *testing.T) {
+	setForTest(t, &heartbeatJitter, 10*time.Second)
+	var lowest, highest time.Duration
+	for i := range 1000 {
+		delay := nextHeartbeat()
+		if delay < heartbeatInterval-10*time.Second || delay >= heartbeatInterval+10*time.Second {
+			t.Fatalf("heartbeat in %s, want within 10s of %s", delay, heartbeatInterval)
+		}
+		if i == 0 || delay < lowest {
+			lowest = delay
+		}
+		if delay > highest {
+			highest = delay
+		}
+	}
+	if highest-lowest < 10*time.Second {
+		t.Fatalf("heartbeats only spread over %s", highest-lowest)
+	}
+
+	// the jitter never exceeds half the interval
+	setForTest(t, &heartbeatJitter, time.Hour)
+	for range 1000 {
+		if delay := nextHeartbeat(); delay < heartbeatInterval/2 || delay >= heartbeatInterval*3/2 {
+			t.Fatalf("heartbeat in %s, want the jitter capped at half the interval", delay)
+		}
+	}
+	setForTest(t, &heartbeatJitter, 0)
+	if delay := nextHeartbeat(); delay != heartbeatInterval {
+		t.Fatalf("heartbeat in %s without jitter, want the interval", delay)
+	}
+}
+
+func TestTunnelRotation(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &remoteBind, "0.0.0.0")
+	// reconnects reclaim the port without asking the control plane
+	setForTest(t, &stickyPort, true)
+	setForTest(t, &tunnelRotateInterval, 200*time.Millisecond)
+
+	for attempt := range 3 {
+		started := time.Now()
+		if err := connectTunnel(context.Background(), attempt > 0); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(started); elapsed < tunnelRotateInterval || elapsed > 5*time.Second {
+			t.Fatalf("session %d lasted %s, want it rotated after %s", attempt, elapsed, tunnelRotateInterval)
+		}
+		srv.nextForward()
+	}
+	if binds := srv.requestedBinds(); len(binds) != 3 {
+		t.Fatalf("tunnel dialed %d times, want once per rotation", len(binds))
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	sessionCtx, sessionCancel := context.WithCancel(context.Background())
+	defer sessionCancel()
+	setForTest(t, &ctx, sessionCtx)
+	setForTest(t, &cancel, sessionCancel)
+	setForTest(t, &tunnelDone, nil)
+	setForTest(t, &teardownDone, make(chan struct{}))
+	setForTest(t, &socks5Listener, nil)
+	setForTest(t, &currentTunnel, nil)
+	setForTest(t, &noRegister, true)
+	setForTest(t, &controlSocket, "")
+	setForTest(t, &maxLifetime, 50*time.Millisecond)
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+	})
+	exited := make(chan int, 1)
+	setForTest(t, &exitProcess, func(code int) {
+		exited <- code
+	})
+
+	started := time.Now()
+	startMaxLifetime()
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Fatalf("exited with %d, want 0", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent still running past its lifetime")
+	}
+	if elapsed := time.Since(started); elapsed < maxLifetime {
+		t.Fatalf("shut down after %s, before the %s lifetime", elapsed, maxLifetime)
+	}
+	if !shuttingDown.Load() || sessionCtx.Err() == nil {
+		t.Fatal("exited without a graceful shutdown")
+	}
+}
+
+func TestPublicIPOverride(t *testing.T) {
+	var detected atomic.Int32
+	setForTest(t, &publicIPClient, &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		detected.Add(1)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("198.51.100.1")), Request: req}, nil
+	})})
+
+	setForTest(t, &publicIPOverride, "203.0.113.7")
+	if ip, err := remotePublicIP(); err != nil || ip != "203.0.113.7" {
+		t.Fatalf("public ip %q with %v, want the override", ip, err)
+	}
+	setForTest(t, &bindIP, "")
+	setForTest(t, &netInterfaces, func() ([]net.Interface, error) {
+		return nil, nil
+	})
+	fallBackToDirect(context.Background())
+	if got := detected.Load(); got != 0 {
+		t.Fatalf("public ip detected %d times with -public-ip set", got)
+	}
+
+	setForTest(t, &publicIPOverride, "")
+	if ip, err := remotePublicIP(); err != nil || ip != "198.51.100.1" || detected.Load() != 1 {
+		t.Fatalf("public ip %q with %v, want it detected without an override", ip, err)
+	}
+
+	setForTest(t, &publicIPOverride, "not-an-ip")
+	setForTest(t, &remoteBind, "0.0.0.0")
+	if err := validateBind(); err == nil {
+		t.Fatal("-public-ip not-an-ip accepted")
+	}
+}
+
+func TestRenameAgentRetries(t *testing.T) {
+	var calls atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != "scanner" {
+			t.Errorf("renamed to %q, want scanner", r.URL.Query().Get("name"))
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	setForTest(t, &controlPlaneBackoff, BackoffPolicy(constantBackoff{delay: time.Millisecond}))
+
+	if err := renameAgentWithRetry(context.Background(), &http.Client{}, "scanner"); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("/rename called %d times, want success on the third attempt", got)
+	}
+}
+
+func TestRenameAgentCancelled(t *testing.T) {
+	var calls atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	setForTest(t, &controlPlaneBackoff, BackoffPolicy(constantBackoff{delay: time.Minute}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	if err := renameAgentWithRetry(ctx, &http.Client{}, "scanner"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("rename returned %v, want it cancelled", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("rename returned %s after the cancellation", elapsed)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("/rename called %d times, want no retry once cancelled", got)
+	}
+}
+
+func TestRenameAfterRegistration(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	setForTest(t, &AgentName, "scanner")
+	setForTest(t, &connectionSucceededCount, 2)
+	setForTest(t, &connectDone, func() {})
+	setForTest(t, &selfTest, false)
+	setForTest(t, &reachabilityURL, "")
+
+	if err := inFunctionTickCallback(context.Background(), &http.Client{}, true); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(paths, ",") != "/in,/rename" {
+		t.Fatalf("first heartbeat called %v, want /rename right after /in", paths)
+	}
+}
+
+func TestSighup(t *testing.T) {
+	registered := make(chan struct{}, 1)
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/in" {
+			registered <- struct{}{}
+		}
+	}))
+	setForTest(t, &controlPlaneClient, &http.Client{})
+	reconnected := make(chan struct{}, 1)
+	setForTest(t, &cancelSession, context.CancelFunc(func() {
+		reconnected <- struct{}{}
+	}))
+	tunnelConnected.Store(true)
+	t.Cleanup(func() {
+		tunnelConnected.Store(false)
+	})
+
+	for _, tt := range []struct {
+		action string
+		want   chan struct{}
+		other  chan struct{}
+	}{
+		{sighupReregister, registered, reconnected},
+		{sighupReconnect, reconnected, registered},
+	} {
+		t.Run(tt.action, func(t *testing.T) {
+			setForTest(t, &sighupAction, tt.action)
+			ctx, cancel := context.WithCancel(context.Background())
+			signals := make(chan os.Signal, 1)
+			done := make(chan struct{})
+			go func() {
+				handleSighup(ctx, signals)
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			signals <- syscall.SIGHUP
+			select {
+			case <-tt.want:
+			case <-tt.other:
+				t.Fatalf("SIGHUP with -sighup %s took the other action", tt.action)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("SIGHUP with -sighup %s did nothing", tt.action)
+			}
+			select {
+			case <-tt.other:
+				t.Fatalf("SIGHUP with -sighup %s also took the other action", tt.action)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestInterruptWhileConnecting(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	setForTest(t, &controlPlaneClient, &http.Client{})
+	srv := startPunchHoleServer(t)
+	// the ssh handshake hangs until the test ends
+	connecting, release := make(chan struct{}, 1), make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+	})
+	srv.password = func(_, _ string) error {
+		connecting <- struct{}{}
+		<-release
+		return nil
+	}
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &sshTimeout, 500*time.Millisecond)
+	setForTest(t, &noRegister, false)
+	setForTest(t, &noDeregister, false)
+	setForTest(t, &forwardOnly, false)
+	setForTest(t, &controlSocket, "")
+	setForTest(t, &socks5Listener, nil)
+	setForTest(t, &drainTimeout, 5*time.Second)
+	setForTest(t, &teardownDone, make(chan struct{}))
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+	})
+	exited := make(chan int, 1)
+	setForTest(t, &exitProcess, func(code int) {
+		exited <- code
+	})
+
+	sessionCtx, sessionCancel := context.WithCancel(context.Background())
+	defer sessionCancel()
+	setForTest(t, &ctx, sessionCtx)
+	setForTest(t, &cancel, sessionCancel)
+	setForTest(t, &tunnelDone, make(chan struct{}))
+	go func() {
+		defer close(tunnelDone)
+		_ = connectTunnel(sessionCtx, false)
+	}()
+	select {
+	case <-connecting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not connecting")
+	}
+
+	signals := make(chan os.Signal, 1)
+	go handleInterrupt(signals)
+	signals <- os.Interrupt
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Fatalf("exited with %d, want 0", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("interrupt during connect did not shut the agent down")
+	}
+	select {
+	case <-tunnelDone:
+	default:
+		t.Fatal("exited before the connect attempt ended")
+	}
+	if sessionCtx.Err() == nil {
+		t.Fatal("connect attempt not cancelled by the interrupt")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(paths, ",") != "/out" {
+		t.Fatalf("control plane called %v, want the agent deregistered once", paths)
+	}
+}
+
+// TestParseArgumentsProcess is run in a child by the tests of parseArguments,
+// the env defaults are read when the package is initialized
+func TestParseArgumentsProcess(t *testing.T) {
+	args, ok := os.LookupEnv("TUNNELX_TEST_ARGS")
+	if !ok {
+		t.Skip("run by the tests of parseArguments")
+	}
+	setForTest(t, &os.Args, append([]string{"tunnelx"}, strings.Fields(args)...))
+	if err := parseArguments(); err != nil {
+		t.Fatal(err)
+	}
+	if want, ok := os.LookupEnv("TUNNELX_TEST_WANT"); ok {
+		if got := strings.Join([]string{PunchHoleHost, PunchHolePort, PunchHoleHTTPPort}, " "); got != want {
+			t.Fatalf("punch-hole server %q, want %q", got, want)
+		}
+	}
+	if want, ok := os.LookupEnv("TUNNELX_TEST_WANT_NAME"); ok {
+		if got := AgentName + " " + agentNameSource; got != want {
+			t.Fatalf("agent name %q, want %q", got, want)
+		}
+	}
+	if want, ok := os.LookupEnv("TUNNELX_TEST_WANT_COMMAND"); ok {
+		if got := fmt.Sprintf("%s %s version=%t", command, serviceAction, showVersion); got != want {
+			t.Fatalf("command %q, want %q", got, want)
+		}
+	}
+	if os.Getenv("TUNNELX_TEST_PRINT_CONFIG") == "1" {
+		if err := printConfig(os.Stdout, commandLine); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// parseArgumentsProcess runs parseArguments on args in a child with env,
+// checking the results wanted by env, and returns the child's output
+func parseArgumentsProcess(t *testing.T, args string, env ...string) []byte {
+	t.Helper()
+	child := exec.Command(os.Args[0], "-test.run=^TestParseArgumentsProcess$")
+	// the settings under test come from env only
+	for _, kv := range os.Environ() {
+		switch name, _, _ := strings.Cut(kv, "="); name {
+		case "PUNCH_HOLE_HOST", "PUNCH_HOLE_SSH_PORT", "PUNCH_HOLE_HTTP_PORT", "AGENT_NAME":
+		default:
+			child.Env = append(child.Env, kv)
+		}
+	}
+	child.Env = append(append(child.Env, "TUNNELX_TEST_ARGS="+args), env...)
+	out, err := child.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	return out
+}
+
+func TestPunchHoleFlagPrecedence(t *testing.T) {
+	env := []string{"PUNCH_HOLE_HOST=env.example.com", "PUNCH_HOLE_SSH_PORT=2222", "PUNCH_HOLE_HTTP_PORT=8443"}
+	tests := []struct {
+		name string
+		env  []string
+		args string
+		want string
+	}{
+		{"default", nil, "", defaultPunchHoleHost + " 20022 8880"},
+		{"env", env, "", "env.example.com 2222 8443"},
+		{"host flag", env, "-host flag.example.com", "flag.example.com 2222 8443"},
+		{"ssh port flag", env, "-ssh-port 3333", "env.example.com 3333 8443"},
+		{"http port flag", env, "-http-port 9443", "env.example.com 2222 9443"},
+		{"all flags", env, "-host flag.example.com -ssh-port 3333 -http-port 9443", "flag.example.com 3333 9443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parseArgumentsProcess(t, tt.args, append(tt.env, "TUNNELX_TEST_WANT="+tt.want)...)
+		})
+	}
+}
+
+func TestFreePortBudget(t *testing.T) {
+	var requested atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"port":%d}`, 20001+requested.Add(1))
+	}))
+	srv := startPunchHoleServer(t)
+	// every port handed out is already taken on the server
+	srv.rejectBind = func(string) bool {
+		return true
+	}
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &remoteBind, "0.0.0.0")
+	setForTest(t, &controlPlaneClient, &http.Client{})
+
+	if err := connectTunnel(context.Background(), false); !errors.Is(err, sshr.ErrListenRetriesExhausted) {
+		t.Fatalf("connect returned %v, want the listen retries exhausted", err)
+	}
+	if got := requested.Load(); got != remoteListenRetries {
+		t.Fatalf("/freeport called %d times, want %d", got, remoteListenRetries)
+	}
+	if binds := srv.requestedBinds(); len(binds) != remoteListenRetries+1 {
+		t.Fatalf("listened %d times, want the first port and %d retries", len(binds), remoteListenRetries)
+	}
+}
+
+func TestFreePortAttempts(t *testing.T) {
+	var requested atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	setForTest(t, &controlPlaneBackoff, BackoffPolicy(constantBackoff{delay: time.Millisecond}))
+
+	if _, err := getFreePortFromServer(context.Background(), &http.Client{}); err == nil {
+		t.Fatal("got a free port from a failing server")
+	}
+	if got := requested.Load(); got != freePortAttempts {
+		t.Fatalf("/freeport called %d times, want %d attempts", got, freePortAttempts)
+	}
+}
+
+func TestFreePortInvalid(t *testing.T) {
+	ports := []int{0, 70000, 4242}
+	var requested atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]int{"port": ports[min(int(requested.Add(1)), len(ports))-1]})
+	}))
+	setForTest(t, &controlPlaneBackoff, BackoffPolicy(constantBackoff{delay: time.Millisecond}))
+
+	port, err := getFreePortFromServer(context.Background(), &http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port.Port != 4242 || requested.Load() != 3 {
+		t.Fatalf("got port %d after %d calls, want 4242 once the invalid ports were retried", port.Port, requested.Load())
+	}
+
+	ports = []int{0}
+	requested.Store(0)
+	_, err = getFreePortFromServer(context.Background(), &http.Client{})
+	if err == nil || !strings.Contains(err.Error(), "invalid port 0") {
+		t.Fatalf("got %v for port 0, want an invalid port error", err)
+	}
+}
+
+func TestListenSocks5BindConflict(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("bind conflicts are reported as WSAEADDRINUSE")
+	}
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = taken.Close()
+	}()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+	setForTest(t, &socks5proxyPort, &freeport.Port{Address: "127.0.0.1", Port: takenPort, Protocol: freeport.TCP, NetListenAddress: taken.Addr().String()})
+	setForTest(t, &currentTunnel, nil)
+	setForTest(t, &agentMode, modeTunnel)
+
+	listener, err := listenSocks5("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	if port == takenPort {
+		t.Fatal("listening on the port taken by another process")
+	}
+	if socks5proxyPort.Port != port || socks5proxyPort.NetListenAddress != listener.Addr().String() {
+		t.Fatalf("socks5 port recorded as %s, want the second port %d", socks5proxyPort.NetListenAddress, port)
+	}
+}
+
+func TestNoRegister(t *testing.T) {
+	for _, register := range []bool{false, true} {
+		t.Run(fmt.Sprintf("register=%t", register), func(t *testing.T) {
+			requests := make(chan string, 16)
+			startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r.URL.Path
+			}))
+			setForTest(t, &controlPlaneClient, &http.Client{})
+			srv := startPunchHoleServer(t)
+			usePunchHole(t, srv, startEchoTarget(t))
+			setForTest(t, &noRegister, !register)
+			setForTest(t, &AgentName, "")
+			setForTest(t, &selfTest, false)
+			setForTest(t, &reachabilityURL, "")
+			setForTest(t, &stopHealth, nil)
+			connected := make(chan struct{})
+			setForTest(t, &connectDone, func() {
+				close(connected)
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- connectTunnel(ctx, false)
+			}()
+			echoThrough(t, srv.nextForward(), "hello")
+			defer func() {
+				cancel()
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+				healthMu.Lock()
+				if stopHealth != nil {
+					stopHealth()
+				}
+				healthMu.Unlock()
+			}()
+
+			select {
+			case path := <-requests:
+				if !register {
+					t.Fatalf("-no-register called %s", path)
+				}
+				if path != "/in" {
+					t.Fatalf("registered with %s, want /in", path)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if register {
+					t.Fatal("agent not registered")
+				}
+				// the tunnel still counts as established
+				select {
+				case <-connected:
+				default:
+					t.Fatal("-no-register tunnel not reported as connected")
+				}
+			}
+		})
+	}
+}
+
+func TestNoDeregister(t *testing.T) {
+	for _, deregister := range []bool{false, true} {
+		t.Run(fmt.Sprintf("deregister=%t", deregister), func(t *testing.T) {
+			var mu sync.Mutex
+			var paths []string
+			startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+			}))
+			setForTest(t, &controlPlaneClient, &http.Client{})
+			sessionCtx, sessionCancel := context.WithCancel(context.Background())
+			defer sessionCancel()
+			setForTest(t, &ctx, sessionCtx)
+			setForTest(t, &cancel, sessionCancel)
+			setForTest(t, &tunnelDone, nil)
+			setForTest(t, &teardownDone, make(chan struct{}))
+			setForTest(t, &socks5Listener, nil)
+			setForTest(t, &currentTunnel, nil)
+			setForTest(t, &controlSocket, "")
+			setForTest(t, &stopHealth, nil)
+			setForTest(t, &noRegister, false)
+			setForTest(t, &forwardOnly, false)
+			setForTest(t, &noDeregister, !deregister)
+			t.Cleanup(func() {
+				shuttingDown.Store(false)
+			})
+
+			shutdown()
+			if sessionCtx.Err() == nil {
+				t.Fatal("session not cancelled on shutdown")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if called := slices.Contains(paths, "/out"); called != deregister {
+				t.Fatalf("-no-deregister=%t: control plane calls %v", !deregister, paths)
+			}
+		})
+	}
+}
+
+func TestDefaultAgentName(t *testing.T) {
+	setForTest(t, &osHostname, func() (string, error) {
+		return "scanner-host", nil
+	})
+	if name, source := defaultAgentName(); name != "scanner-host" || source != nameSourceHostname {
+		t.Fatalf("default name %q from %s, want the hostname", name, source)
+	}
+
+	setForTest(t, &osHostname, func() (string, error) {
+		return "", errors.New("no hostname")
+	})
+	name, source := defaultAgentName()
+	if _, err := xid.FromString(name); err != nil || source != nameSourceRandom {
+		t.Fatalf("default name %q from %s without a hostname, want a random xid", name, source)
+	}
+}
+
+func TestAgentNameSource(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		t.Skip("no hostname")
+	}
+	parseArgumentsProcess(t, "-name scanner", "TUNNELX_TEST_WANT_NAME=scanner "+nameSourceFlag)
+	parseArgumentsProcess(t, "", "AGENT_NAME=scanner", "TUNNELX_TEST_WANT_NAME=scanner "+nameSourceEnv)
+	parseArgumentsProcess(t, "", "TUNNELX_TEST_WANT_NAME="+hostname+" "+nameSourceHostname)
+}
+
+func TestAgentNameLogged(t *testing.T) {
+	setForTest(t, &AgentName, "4f2b7d3c0a1e5c9b8d6f")
+	setForTest(t, &agentNameSource, nameSourceRandom)
+	logs := captureLogs(t, levels.LevelInfo)
+	logAgentName()
+	if !strings.Contains(logs.String(), `no hostname available, using the random agent name "4f2b7d3c0a1e5c9b8d6f"`) {
+		t.Fatalf("random agent name not logged:\n%s", logs)
+	}
+	if status := currentStatus(); status.AgentName != AgentName || status.AgentNameSource != nameSourceRandom {
+		t.Fatalf("status reports agent name %q from %s", status.AgentName, status.AgentNameSource)
+	}
+}
+
+func TestReconnectResolvesAgain(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &remoteBind, "0.0.0.0")
+	setForTest(t, &stickyPort, true)
+	// the host resolved to an address the server moved away from
+	setForTest(t, &PunchHoleHost, "tunnel.invalid")
+	setForTest(t, &punchHoleIP, "192.0.2.1")
+	setForTest(t, &punchHoleIPs, []string{"192.0.2.1"})
+	setForTest(t, &lookupIP, func(_ context.Context, _, host string) ([]net.IP, error) {
+		if host != "tunnel.invalid" {
+			t.Errorf("resolved %s, want the punch-hole host", host)
+		}
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	})
+	var mu sync.Mutex
+	var dialed []string
+	setForTest(t, &sshDialer, proxy.ContextDialer(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- connectTunnel(ctx, true)
+	}()
+	echoThrough(t, srv.nextForward(), "hello")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := net.JoinHostPort("127.0.0.1", srv.port()); len(dialed) != 1 || dialed[0] != want {
+		t.Fatalf("reconnect dialed %v, want only the new address %s", dialed, want)
+	}
+	if ip := currentPunchHoleIP(); ip != "127.0.0.1" {
+		t.Fatalf("punch-hole ip %s after the reconnect, want the new address", ip)
+	}
+}
+
+func TestResolvePunchHoleAllAddresses(t *testing.T) {
+	setForTest(t, &lookupIP, func(context.Context, string, string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, nil
+	})
+	ips, err := resolvePunchHole(context.Background(), "tunnel.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ips, ",") != "192.0.2.1,192.0.2.2,2001:db8::1" {
+		t.Fatalf("resolved %v, want every address with IPv4 first", ips)
+	}
+}
+
+func TestDialPunchHoleFallsBack(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	// the server only listens on 127.0.0.1, the first address refuses
+	setForTest(t, &punchHoleIP, "::1")
+	setForTest(t, &punchHoleIPs, []string{"::1", "127.0.0.1"})
+	var mu sync.Mutex
+	var dialed []string
+	setForTest(t, &sshDialer, proxy.ContextDialer(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- connectTunnel(ctx, false)
+	}()
+	echoThrough(t, srv.nextForward(), "hello")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{net.JoinHostPort("::1", srv.port()), net.JoinHostPort("127.0.0.1", srv.port())}; strings.Join(dialed, ",") != strings.Join(want, ",") {
+		t.Fatalf("dialed %v, want %v", dialed, want)
+	}
+	if ip := currentPunchHoleIP(); ip != "127.0.0.1" {
+		t.Fatalf("punch-hole ip %s, want the address that connected", ip)
+	}
+}
+
+func TestReconnectDirective(t *testing.T) {
+	var registered atomic.Int32
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/in" && registered.Add(1) == 1 {
+			_, _ = w.Write([]byte(`{"reconnect":true}`))
+		}
+	}))
+	setForTest(t, &controlPlaneClient, &http.Client{})
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &noRegister, false)
+	setForTest(t, &noDeregister, true)
+	setForTest(t, &stickyPort, true)
+	setForTest(t, &AgentName, "")
+	setForTest(t, &selfTest, false)
+	setForTest(t, &reachabilityURL, "")
+	setForTest(t, &stopHealth, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for attempt := 0; ctx.Err() == nil; attempt++ {
+			_ = connectTunnel(ctx, attempt > 0)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+		healthMu.Lock()
+		if stopHealth != nil {
+			stopHealth()
+		}
+		healthMu.Unlock()
+	}()
+
+	srv.nextForward()
+	// the directive ends the first session, the agent dials again
+	echoThrough(t, srv.nextForward(), "hello")
+	for deadline := time.Now().Add(5 * time.Second); registered.Load() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("reconnected session not registered")
+		}
+	}
+	if binds := srv.requestedBinds(); len(binds) != 2 {
+		t.Fatalf("tunnel dialed %d times, want once more after the directive", len(binds))
+	}
+}
+
+func TestSingleHealthLoop(t *testing.T) {
+	registrations := make(chan struct{}, 16)
+	startControlPlane(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/in" {
+			registrations <- struct{}{}
+		}
+	}))
+	setForTest(t, &controlPlaneClient, &http.Client{})
+	setForTest(t, &connectionSucceededCount, 2)
+	setForTest(t, &noMetrics, true)
+	setForTest(t, &AgentName, "")
+	setForTest(t, &selfTest, false)
+	setForTest(t, &reachabilityURL, "")
+	setForTest(t, &stopHealth, nil)
+	setForTest(t, &clockCheckInterval, 10*time.Millisecond)
+	var jump atomic.Int64
+	setForTest(t, &wallClock, func() time.Time {
+		return time.Now().Round(0).Add(time.Duration(jump.Load()))
+	})
+	defer func() {
+		healthMu.Lock()
+		if stopHealth != nil {
+			stopHealth()
+		}
+		healthMu.Unlock()
+	}()
+
+	// every established session calls the success hook
+	for range 3 {
+		startHealthLoop(context.Background())
+		select {
+		case <-registrations:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel not registered")
+		}
+	}
+
+	select {
+	case <-registrations:
+		t.Fatal("heartbeat sent before the clock jumped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// every running loop sends a heartbeat on a clock jump
+	jump.Store(int64(time.Minute))
+	select {
+	case <-registrations:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat after the clock jumped")
+	}
+	select {
+	case <-registrations:
+		t.Fatal("more than one health loop sent heartbeats")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestOverlapReconnect(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &stickyPort, true)
+	setForTest(t, &overlapReconnect, true)
+	setForTest(t, &drainTimeout, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for attempt := 0; ctx.Err() == nil; attempt++ {
+			_ = connectTunnel(ctx, attempt > 0)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+		drainingTunnels.Wait()
+	}()
+
+	conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("long-lived connection dropped: %v", err)
+		}
+		if string(buf) != msg {
+			t.Fatalf("got %q, want %q", buf, msg)
+		}
+	}
+	echo("before the reconnect")
+
+	if !requestReconnect() {
+		t.Fatal("no session to re-establish")
+	}
+	// the new tunnel is up while the old connection is still open
+	echoThrough(t, srv.nextForward(), "on the new tunnel")
+	echo("after the reconnect")
+	if binds := srv.requestedBinds(); len(binds) != 2 {
+		t.Fatalf("tunnel dialed %d times, want once more after the reconnect", len(binds))
+	}
+}
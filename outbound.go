@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// outIP is the source ip of the proxy's outbound connections
+	outIP string
+	// outInterface is the interface whose address is used as outIP
+	outInterface string
+)
+
+// outboundDialer returns the dial function for the proxy's outbound
+// connections, nil when the default source address is used
+func outboundDialer() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if outIP != "" && outInterface != "" {
+		return nil, errors.Errorf("-out-ip and -out-interface are mutually exclusive")
+	}
+	source := outIP
+	if outInterface != "" {
+		ip, err := interfaceIP(outInterface)
+		if err != nil {
+			return nil, err
+		}
+		source = ip.String()
+	}
+	if source == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, errors.Errorf("invalid -out-ip %q", source)
+	}
+	local, err := isLocalIP(ip)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not enumerate local addresses")
+	}
+	if !local {
+		return nil, errors.Errorf("-out-ip %s is not an address of this host", source)
+	}
+
+	// the dialer only uses destination addresses of the source address family
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	return dialer.DialContext, nil
+}
+
+// interfaceIP returns the first address of the named interface, preferring IPv4
+func interfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid -out-interface %q", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get addresses of %s", name)
+	}
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return nil, errors.Errorf("interface %s has no ip address", name)
+	}
+	return first, nil
+}
+
+// isLocalIP reports whether ip is assigned to an interface of this host
+func isLocalIP(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
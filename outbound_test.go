@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// sourceIP returns a non-loopback ipv4 address of this host, the loopback
+// address when there is none
+func sourceIP(t *testing.T) string {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skipf("could not enumerate local addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return "127.0.0.1"
+}
+
+func TestOutboundSource(t *testing.T) {
+	source := sourceIP(t)
+	setForTest(t, &outIP, source)
+	setForTest(t, &outInterface, "")
+	dial, err := outboundDialer()
+	if err != nil || dial == nil {
+		t.Fatalf("no outbound dialer for -out-ip %s: %v", source, err)
+	}
+
+	target, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		_ = conn.Close()
+	}()
+
+	// connections to loopback originate from loopback unless bound elsewhere
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	conn := socks5Request(t, startSocks5(t, socks5.WithDial(dial)), statute.CommandConnect, net.JoinHostPort("127.0.0.1", port))
+	if rep, _ := readSocks5Reply(t, conn); rep != statute.RepSuccess {
+		t.Fatalf("CONNECT replied %d", rep)
+	}
+	select {
+	case addr := <-accepted:
+		if ip := addr.(*net.TCPAddr).IP.String(); ip != source {
+			t.Fatalf("outbound connection from %s, want -out-ip %s", ip, source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target not reached")
+	}
+}
+
+func TestOutboundDialerValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		iface    string
+		wantDial bool
+		wantErr  bool
+	}{
+		{"default", "", "", false, false},
+		{"local ip", "127.0.0.1", "", true, false},
+		{"invalid ip", "not-an-ip", "", false, true},
+		{"not local", "203.0.113.1", "", false, true},
+		{"unknown interface", "", "tunnelx-none0", false, true},
+		{"both", "127.0.0.1", "lo", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &outIP, tt.ip)
+			setForTest(t, &outInterface, tt.iface)
+			dial, err := outboundDialer()
+			if (err != nil) != tt.wantErr || (dial != nil) != tt.wantDial {
+				t.Fatalf("outboundDialer returned dialer %t and %v", dial != nil, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/freeport"
+	"golang.org/x/crypto/ssh"
+)
+
+// punchHoleServer is an in-process punch-hole server: it checks passwords
+// with password, accepting all when nil, and serves tcpip-forward requests
+// on loopback listeners
+type punchHoleServer struct {
+	t        *testing.T
+	listener net.Listener
+	password func(user, password string) error
+	// rejectBind, when set, rejects the tcpip-forward requests it returns true for
+	rejectBind func(addr string) bool
+
+	// forwards receives the loopback address every remote listener is reachable on
+	forwards chan string
+
+	mu    sync.Mutex
+	conns []ssh.Conn
+	// binds are the addresses of the tcpip-forward requests, in order
+	binds []string
+	// ciphers, when set, are the only ciphers the server negotiates
+	ciphers []string
+}
+
+func startPunchHoleServer(t *testing.T) *punchHoleServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &punchHoleServer{t: t, listener: listener, forwards: make(chan string, 16)}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if srv.password != nil {
+				return nil, srv.password(meta.User(), string(password))
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = listener.Close()
+		srv.closeConns()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connConfig := config
+			srv.mu.Lock()
+			if srv.ciphers != nil {
+				restricted := *config
+				restricted.Ciphers = srv.ciphers
+				connConfig = &restricted
+			}
+			srv.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				srv.serve(conn, connConfig)
+			}()
+		}
+	}()
+	return srv
+}
+
+func (srv *punchHoleServer) port() string {
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	return port
+}
+
+// restrictCiphers makes new connections negotiate only ciphers
+func (srv *punchHoleServer) restrictCiphers(ciphers ...string) {
+	srv.mu.Lock()
+	srv.ciphers = ciphers
+	srv.mu.Unlock()
+}
+
+// closeConns drops every ssh connection, as a server restart would
+func (srv *punchHoleServer) closeConns() {
+	srv.mu.Lock()
+	conns := srv.conns
+	srv.conns = nil
+	srv.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// requestedBinds returns the addresses of the tcpip-forward requests so far
+func (srv *punchHoleServer) requestedBinds() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.binds...)
+}
+
+// nextForward waits for the next remote listener
+func (srv *punchHoleServer) nextForward() string {
+	srv.t.Helper()
+	select {
+	case addr := <-srv.forwards:
+		return addr
+	case <-time.After(10 * time.Second):
+		srv.t.Fatal("no remote listener within 10s")
+		return ""
+	}
+}
+
+func (srv *punchHoleServer) serve(netConn net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		_ = netConn.Close()
+		return
+	}
+	srv.mu.Lock()
+	srv.conns = append(srv.conns, conn)
+	srv.mu.Unlock()
+	go func() {
+		for ch := range chans {
+			_ = ch.Reject(ssh.Prohibited, "no channels")
+		}
+	}()
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	for req := range reqs {
+		if req.Type != "tcpip-forward" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		var payload struct {
+			Addr string
+			Port uint32
+		}
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		bind := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+		srv.mu.Lock()
+		srv.binds = append(srv.binds, bind)
+		srv.mu.Unlock()
+		if srv.rejectBind != nil && srv.rejectBind(bind) {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		listeners = append(listeners, l)
+		var reply []byte
+		if payload.Port == 0 {
+			reply = ssh.Marshal(struct{ Port uint32 }{uint32(l.Addr().(*net.TCPAddr).Port)})
+		}
+		_ = req.Reply(true, reply)
+		go srv.acceptForward(conn, l, payload.Addr, payload.Port)
+		srv.forwards <- l.Addr().String()
+	}
+}
+
+// acceptForward opens a forwarded-tcpip channel for every connection of l
+func (srv *punchHoleServer) acceptForward(conn ssh.Conn, l net.Listener, bindAddr string, bindPort uint32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() {
+				_ = c.Close()
+			}()
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			payload := ssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{bindAddr, bindPort, origin.IP.String(), uint32(origin.Port)})
+			// the client registers the forward only once it has read the reply
+			var ch ssh.Channel
+			var reqs <-chan *ssh.Request
+			var err error
+			for range 100 {
+				ch, reqs, err = conn.OpenChannel("forwarded-tcpip", payload)
+				var open *ssh.OpenChannelError
+				if !errors.As(err, &open) || open.Reason != ssh.Prohibited {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			defer func() {
+				_ = ch.Close()
+			}()
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(ch, c)
+				_ = ch.CloseWrite()
+				close(done)
+			}()
+			_, _ = io.Copy(c, ch)
+			_ = c.(*net.TCPConn).CloseWrite()
+			<-done
+		}()
+	}
+}
+
+// usePunchHole points the tunnel at srv, forwarding to the local target
+// listening on target, and keeps the tunnel from registering
+func usePunchHole(t *testing.T, srv *punchHoleServer, target string) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetPort, _ := strconv.Atoi(port)
+	setForTest(t, &PunchHoleHost, "127.0.0.1")
+	setForTest(t, &PunchHolePort, srv.port())
+	setForTest(t, &punchHoleIP, "127.0.0.1")
+	setForTest(t, &punchHoleIPs, []string{"127.0.0.1"})
+	setForTest(t, &failoverHosts, nil)
+	setForTest(t, &failoverIndex, 0)
+	setForTest(t, &socks5proxyPort, &freeport.Port{Address: host, Port: targetPort, Protocol: freeport.TCP, NetListenAddress: target})
+	setReverseProxyPortForTest(t, &freeport.Port{Port: 20001})
+	setForTest(t, &httpProxyPort, nil)
+	setForTest(t, &currentTunnel, nil)
+	setForTest(t, &cancelSession, nil)
+	setForTest(t, &sshTimeout, 5*time.Second)
+	setForTest(t, &noRegister, true)
+	setForTest(t, &connectionSucceededCount, 0)
+	setForTest(t, &connectDone, func() {})
+}
+
+// startEchoTarget runs a local target echoing what it reads
+func startEchoTarget(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// echoThrough writes msg on a new connection to addr and checks it comes back
+func echoThrough(t *testing.T, addr, msg string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
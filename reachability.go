@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+// reachabilityTimeout bounds the whole reachability check
+const reachabilityTimeout = 30 * time.Second
+
+// reachabilityURL is a prober asked to connect back to the public endpoint
+// once connected, disabled when empty
+var reachabilityURL string
+
+// reachabilityResult is the answer of the prober to
+// GET <reachabilityURL>?address=<host:port>
+type reachabilityResult struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runReachabilityCheck asks the prober to connect to the public endpoint
+// and logs whether it could
+func runReachabilityCheck() {
+	endpoint, _ := publicEndpoint.Load().(string)
+	if endpoint == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reachabilityTimeout)
+	defer cancel()
+	result, err := checkReachability(ctx, endpoint)
+	switch {
+	case err != nil:
+		gologger.Warning().Msgf("Reachability check of %s failed: %v", endpoint, err)
+	case result.Reachable:
+		gologger.Info().Msgf("Public endpoint %s is reachable from the internet", endpoint)
+	case result.Error != "":
+		gologger.Error().Msgf("Public endpoint %s is not reachable from the internet: %s", endpoint, result.Error)
+	default:
+		gologger.Error().Msgf("Public endpoint %s is not reachable from the internet", endpoint)
+	}
+}
+
+func checkReachability(ctx context.Context, endpoint string) (*reachabilityResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reachabilityURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -reachability-url")
+	}
+	q := req.URL.Query()
+	q.Set("address", endpoint)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("User-Agent", userAgent)
+
+	// the api key is not sent, the prober may be served by anyone
+	client := &http.Client{Timeout: reachabilityTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var result reachabilityResult
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "invalid prober response")
+	}
+	return &result, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckReachability(t *testing.T) {
+	reachable := map[string]bool{"203.0.113.7:41000": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := r.URL.Query().Get("address")
+		result := reachabilityResult{Reachable: reachable[address]}
+		if !result.Reachable {
+			result.Error = "connection refused"
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+	setForTest(t, &reachabilityURL, server.URL)
+
+	result, err := checkReachability(context.Background(), "203.0.113.7:41000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reachable {
+		t.Fatal("reachable endpoint reported unreachable")
+	}
+	result, err = checkReachability(context.Background(), "203.0.113.7:41001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reachable || result.Error != "connection refused" {
+		t.Fatalf("unreachable endpoint reported %+v", result)
+	}
+}
+
+func TestCheckReachabilityStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	setForTest(t, &reachabilityURL, server.URL)
+
+	if _, err := checkReachability(context.Background(), "203.0.113.7:41000"); err == nil {
+		t.Fatal("no error for a failing prober")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	socks5 "github.com/things-go/go-socks5"
+)
+
+// dohTimeout bounds a single DNS over HTTPS query
+const dohTimeout = 10 * time.Second
+
+// newResolver returns the socks5 name resolver for the -resolver value,
+// "system" (or empty) uses the system resolver and an https url uses DNS over HTTPS
+func newResolver(spec string) (socks5.NameResolver, error) {
+	if spec == "" || spec == "system" {
+		return socks5.DNSResolver{}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.Errorf("invalid -resolver %q: must be system or an https DoH url", spec)
+	}
+	return &dohResolver{url: u.String(), client: &http.Client{Timeout: dohTimeout}}, nil
+}
+
+// dohResolver resolves names with RFC 8484 DNS over HTTPS
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+// Resolve implements socks5.NameResolver, preferring IPv4 addresses
+func (r *dohResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, ip, nil
+	}
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		ip, err := r.query(ctx, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ip != nil {
+			return ctx, ip, nil
+		}
+	}
+	if lastErr != nil {
+		return ctx, nil, lastErr
+	}
+	return ctx, nil, errors.Errorf("no address found for %s", name)
+}
+
+func (r *dohResolver) query(ctx context.Context, name string, qtype uint16) (net.IP, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	// RFC 8484 recommends an id of 0 for cache friendliness
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not pack dns query")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "doh request failed")
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("doh request failed with status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read doh response")
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, errors.Wrap(err, "could not unpack doh response")
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		return nil, errors.Errorf("doh query for %s failed: %s", name, dns.RcodeToString[answer.Rcode])
+	}
+	for _, rr := range answer.Answer {
+		switch record := rr.(type) {
+		case *dns.A:
+			return record.A, nil
+		case *dns.AAAA:
+			return record.AAAA, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// startDoHServer answers A queries for names with their address in records
+// and records every queried name
+func startDoHServer(t *testing.T, records map[string]string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var queried []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := new(dns.Msg)
+		if r.Header.Get("Content-Type") != "application/dns-message" || query.Unpack(body) != nil || len(query.Question) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		question := query.Question[0]
+		mu.Lock()
+		queried = append(queried, question.Name)
+		mu.Unlock()
+
+		answer := new(dns.Msg)
+		answer.SetReply(query)
+		if ip, ok := records[question.Name]; ok && question.Qtype == dns.TypeA {
+			answer.Answer = append(answer.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		} else if !ok {
+			answer.Rcode = dns.RcodeNameError
+		}
+		packed, _ := answer.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queried...)
+	}
+}
+
+func TestCustomResolverConnect(t *testing.T) {
+	server, queried := startDoHServer(t, map[string]string{"echo.internal.": "127.0.0.1"})
+	resolver := &dohResolver{url: server.URL + "/dns-query", client: server.Client()}
+	_, port, _ := net.SplitHostPort(startEchoTarget(t))
+
+	conn := socks5Request(t, startSocks5(t, socks5.WithResolver(resolver)), statute.CommandConnect, net.JoinHostPort("echo.internal", port))
+	if rep, _ := readSocks5Reply(t, conn); rep != statute.RepSuccess {
+		t.Fatalf("CONNECT by hostname replied %d", rep)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q through the proxy: %v", buf, err)
+	}
+	if names := queried(); len(names) == 0 || names[0] != "echo.internal." {
+		t.Fatalf("resolver queried %v, want echo.internal", names)
+	}
+
+	conn = socks5Request(t, startSocks5(t, socks5.WithResolver(resolver)), statute.CommandConnect, net.JoinHostPort("missing.internal", port))
+	if rep, _ := readSocks5Reply(t, conn); rep != statute.RepHostUnreachable {
+		t.Fatalf("CONNECT to an unknown hostname replied %d, want host unreachable", rep)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	for _, spec := range []string{"", "system"} {
+		if _, err := newResolver(spec); err != nil {
+			t.Errorf("-resolver %q: %v", spec, err)
+		}
+	}
+	if resolver, err := newResolver("https://dns.example/dns-query"); err != nil {
+		t.Errorf("-resolver with a DoH url: %v", err)
+	} else if _, ok := resolver.(*dohResolver); !ok {
+		t.Errorf("-resolver with a DoH url made a %T", resolver)
+	}
+	for _, spec := range []string{"http://dns.example/dns-query", "8.8.8.8", "https://"} {
+		if _, err := newResolver(spec); err == nil {
+			t.Errorf("-resolver %q accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"golang.org/x/net/proxy"
+)
+
+// selfTestTimeout bounds the whole self-test request
+const selfTestTimeout = 30 * time.Second
+
+var (
+	// selfTest enables checking the proxy end to end once connected
+	selfTest bool
+	// selfTestURL is requested through the proxy by -self-test
+	selfTestURL = "https://api.ipify.org"
+)
+
+// runSelfTest requests selfTestURL through the socks5 proxy and logs the result
+func runSelfTest() {
+	address := selfTestProxyAddress()
+	ip, err := selfTestRequest(address)
+	if err != nil {
+		gologger.Error().Msgf("Self-test through %s failed: %v", address, err)
+		return
+	}
+	gologger.Info().Msgf("Self-test through %s passed, outbound ip is %s", address, ip)
+}
+
+// selfTestProxyAddress is the public endpoint in direct mode, the local
+// listener otherwise
+func selfTestProxyAddress() string {
+	if agentMode == modeDirect {
+		if endpoint, ok := publicEndpoint.Load().(string); ok {
+			return endpoint
+		}
+	}
+	tunnelMu.Lock()
+	defer tunnelMu.Unlock()
+	return localDialAddress(socks5proxyPort)
+}
+
+func selfTestRequest(address string) (string, error) {
+	var auth *proxy.Auth
+	if !noProxyAuth {
+		auth = &proxy.Auth{User: proxyUsername, Password: currentAPIKey()}
+	}
+	dialer, err := proxy.SOCKS5("tcp", address, auth, &net.Dialer{Timeout: selfTestTimeout})
+	if err != nil {
+		return "", err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return "", errors.New("socks5 dialer does not support contexts")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:     contextDialer.DialContext,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, selfTestURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return string(body), nil
+}
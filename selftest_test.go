@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/projectdiscovery/freeport"
+	"github.com/projectdiscovery/gologger/levels"
+	socks5 "github.com/things-go/go-socks5"
+)
+
+// startEchoIPService runs a https service answering status with its body,
+// standing in for selfTestURL
+func startEchoIPService(t *testing.T, status int) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("203.0.113.5"))
+	}))
+	t.Cleanup(server.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	setForTest(t, &selfTestURL, server.URL)
+	setForTest(t, &tlsConfig, &tls.Config{RootCAs: pool})
+}
+
+// useSelfTestProxy points the self-test at a local socks5 proxy requiring
+// the pdcp user with key
+func useSelfTestProxy(t *testing.T, key string) {
+	t.Helper()
+	addr := startSocks5(t, socks5.WithCredential(&credentialStore{user: "pdcp", password: key}))
+	_, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	setForTest(t, &agentMode, modeTunnel)
+	setForTest(t, &socks5proxyPort, &freeport.Port{Address: "127.0.0.1", Port: portNumber, Protocol: freeport.TCP, NetListenAddress: addr})
+	setForTest(t, &proxyUsername, "pdcp")
+	setForTest(t, &proxyPassword, "key")
+	setForTest(t, &noProxyAuth, false)
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		key    string
+		want   string
+	}{
+		{"passed", http.StatusOK, "key", "Self-test through 127.0.0.1:"},
+		{"service error", http.StatusInternalServerError, "key", "unexpected status code 500"},
+		{"proxy rejects auth", http.StatusOK, "other", "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startEchoIPService(t, tt.status)
+			useSelfTestProxy(t, tt.key)
+			logs := captureLogs(t, levels.LevelInfo)
+
+			runSelfTest()
+			passed := strings.Contains(logs.String(), "passed, outbound ip is 203.0.113.5")
+			if passed != (tt.status == http.StatusOK && tt.key == "key") || !strings.Contains(logs.String(), tt.want) {
+				t.Fatalf("self-test logged:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestSelfTestProxyDown(t *testing.T) {
+	startEchoIPService(t, http.StatusOK)
+	setForTest(t, &agentMode, modeTunnel)
+	setForTest(t, &socks5proxyPort, &freeport.Port{Address: "127.0.0.1", Port: 1, Protocol: freeport.TCP, NetListenAddress: "127.0.0.1:1"})
+	if _, err := selfTestRequest(selfTestProxyAddress()); err == nil {
+		t.Fatal("self-test passed without a proxy")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// serverProbeTimeout bounds the latency probe of a single server
+const serverProbeTimeout = 5 * time.Second
+
+// selectServer probes the tcp connect latency of the candidate host:port
+// servers concurrently and returns the fastest reachable one
+func selectServer(ctx context.Context, candidates []string) (string, error) {
+	type probe struct {
+		addr    string
+		latency time.Duration
+		err     error
+	}
+
+	probes := make(chan probe, len(candidates))
+	for _, candidate := range candidates {
+		go func(addr string) {
+			probeCtx, cancel := context.WithTimeout(ctx, serverProbeTimeout)
+			defer cancel()
+			start := time.Now()
+			// through -upstream-socks the latency includes the proxy
+			conn, err := sshDialer.DialContext(probeCtx, "tcp", addr)
+			if err == nil {
+				_ = conn.Close()
+			}
+			probes <- probe{addr: addr, latency: time.Since(start), err: err}
+		}(candidate)
+	}
+
+	var best *probe
+	for range candidates {
+		p := <-probes
+		if p.err != nil {
+			continue
+		}
+		if best == nil || p.latency < best.latency {
+			best = &p
+		}
+	}
+	if best == nil {
+		return "", errors.New("no server is reachable")
+	}
+	return best.addr, nil
+}
+
+// validateServers checks every -server entry is a host:port
+func validateServers(servers []string) error {
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return errors.Wrapf(err, "invalid server %q", server)
+		}
+	}
+	return nil
+}
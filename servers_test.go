@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialerFunc is a proxy.ContextDialer calling itself
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// listenLoopback returns the address of a loopback listener accepting connections
+func listenLoopback(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return listener.Addr().String()
+}
+
+func TestSelectServer(t *testing.T) {
+	fast, slow := listenLoopback(t), listenLoopback(t)
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := unreachable.Addr().String()
+	_ = unreachable.Close()
+
+	var direct net.Dialer
+	setForTest(t, &sshDialer, proxy.ContextDialer(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == slow {
+			// the slow server takes a while to answer the connect
+			time.Sleep(200 * time.Millisecond)
+		}
+		return direct.DialContext(ctx, network, addr)
+	})))
+
+	for range 3 {
+		selected, err := selectServer(context.Background(), []string{slow, closed, fast})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selected != fast {
+			t.Fatalf("selected %s, want the faster server %s", selected, fast)
+		}
+	}
+	if _, err := selectServer(context.Background(), []string{closed}); err == nil {
+		t.Fatal("selected a server while none is reachable")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "github.com/pkg/errors"
+
+func runService(_ string) error {
+	return errors.New("windows service mode is not supported on this platform")
+}
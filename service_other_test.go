@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import "testing"
+
+func TestRunServiceUnsupported(t *testing.T) {
+	for _, action := range []string{"install", "uninstall", "run"} {
+		if err := runService(action); err == nil {
+			t.Errorf("service %s succeeded outside windows", action)
+		}
+	}
+}
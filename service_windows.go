@@ -0,0 +1,166 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName        = "tunnelx"
+	serviceDisplayName = "TunnelX"
+	serviceDescription = "ProjectDiscovery ingress tunnel for internal network scanning"
+)
+
+func runService(action string) error {
+	switch action {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		return svc.Run(serviceName, &tunnelxService{})
+	default:
+		return errors.Errorf("unknown service action, expected one of install, uninstall, run")
+	}
+}
+
+// installService registers tunnelx as an automatically started service.
+// All other command line arguments are passed to the service on start.
+func installService() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exePath, err = filepath.Abs(exePath)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "could not connect to service manager")
+	}
+	defer func() {
+		_ = m.Disconnect()
+	}()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		_ = s.Close()
+		return errors.Errorf("service %s already exists", serviceName)
+	}
+
+	args := append(serviceArgs(os.Args[1:]), "-service", "run")
+	s, err := m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return errors.Wrap(err, "could not create service")
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	gologger.Info().Msgf("Service %s installed", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "could not connect to service manager")
+	}
+	defer func() {
+		_ = m.Disconnect()
+	}()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.Errorf("service %s is not installed", serviceName)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	if err := s.Delete(); err != nil {
+		return errors.Wrap(err, "could not delete service")
+	}
+
+	gologger.Info().Msgf("Service %s uninstalled", serviceName)
+	return nil
+}
+
+// serviceArgs strips the service subcommand, or the -service flag, and its
+// action from args
+func serviceArgs(args []string) []string {
+	if len(args) >= 2 && args[0] == commandService {
+		args = args[2:]
+	}
+	var filtered []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "service" {
+			i++
+			continue
+		}
+		if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		filtered = append(filtered, args[i])
+	}
+	return filtered
+}
+
+type tunnelxService struct{}
+
+// Execute runs the agent and maps service control requests to a graceful shutdown
+func (t *tunnelxService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- process()
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				gologger.Error().Msgf("%s", err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			reply, stop := serviceControl(req)
+			if reply != nil {
+				status <- *reply
+			}
+			if stop {
+				shutdown()
+				return false, 0
+			}
+		}
+	}
+}
+
+// serviceControl maps a service control request to the status to report,
+// nil for none, and whether it stops the service
+func serviceControl(req svc.ChangeRequest) (*svc.Status, bool) {
+	switch req.Cmd {
+	case svc.Interrogate:
+		return &req.CurrentStatus, false
+	case svc.Stop, svc.Shutdown:
+		return &svc.Status{State: svc.StopPending}, true
+	}
+	return nil, false
+}
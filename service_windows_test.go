@@ -0,0 +1,54 @@
+//go:build windows
+
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestServiceArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-auth", "key", "-service", "install"}, []string{"-auth", "key"}},
+		{[]string{"--service=install", "-auth", "key"}, []string{"-auth", "key"}},
+		{[]string{"service", "install", "-auth", "key"}, []string{"-auth", "key"}},
+		{[]string{"-auth", "key"}, []string{"-auth", "key"}},
+	} {
+		if got := serviceArgs(tc.args); !slices.Equal(got, tc.want) {
+			t.Errorf("serviceArgs(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestRunServiceUnknownAction(t *testing.T) {
+	if err := runService("restart"); err == nil {
+		t.Fatal("unknown service action accepted")
+	}
+}
+
+func TestServiceControl(t *testing.T) {
+	running := svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for _, tc := range []struct {
+		cmd   svc.Cmd
+		reply *svc.Status
+		stop  bool
+	}{
+		{svc.Interrogate, &running, false},
+		{svc.Stop, &svc.Status{State: svc.StopPending}, true},
+		{svc.Shutdown, &svc.Status{State: svc.StopPending}, true},
+		{svc.Pause, nil, false},
+	} {
+		reply, stop := serviceControl(svc.ChangeRequest{Cmd: tc.cmd, CurrentStatus: running})
+		if stop != tc.stop {
+			t.Errorf("control %d stops the service: %t, want %t", tc.cmd, stop, tc.stop)
+		}
+		if (reply == nil) != (tc.reply == nil) || reply != nil && *reply != *tc.reply {
+			t.Errorf("control %d reports %+v, want %+v", tc.cmd, reply, tc.reply)
+		}
+	}
+}
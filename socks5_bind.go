@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// bindAcceptTimeout is how long a BIND request waits for the inbound connection
+const bindAcceptTimeout = 2 * time.Minute
+
+// handleSocks5Bind implements the SOCKS5 BIND command: it listens on the
+// interface routing to the requested destination, replies with the bound
+// address, waits for the destination to connect back and then relays data.
+func handleSocks5Bind(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindSourceIP(request.DestAddr.IP), "0"))
+	if err != nil {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return errors.Wrap(err, "bind listen failed")
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, listener.Addr()); err != nil {
+		return errors.Wrap(err, "failed to send bind reply")
+	}
+
+	conn, err := acceptBindConn(ctx, listener.(*net.TCPListener), request.DestAddr.IP)
+	if err != nil {
+		_ = socks5.SendReply(writer, statute.RepTTLExpired, nil)
+		return errors.Wrap(err, "bind accept failed")
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, conn.RemoteAddr()); err != nil {
+		return errors.Wrap(err, "failed to send bind reply")
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(conn, request.Reader)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(writer, conn)
+		errCh <- err
+	}()
+	// returning closes both the inbound connection and the client connection
+	return <-errCh
+}
+
+// acceptBindConn waits for a connection from expectedIP, ignoring other peers
+func acceptBindConn(ctx context.Context, listener *net.TCPListener, expectedIP net.IP) (net.Conn, error) {
+	deadline := time.Now().Add(bindAcceptTimeout)
+	if err := listener.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if expectedIP == nil || expectedIP.IsUnspecified() || (remote != nil && remote.IP.Equal(expectedIP)) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
+
+// bindSourceIP returns the local address routing to dest, so the bound
+// address advertised to the client is reachable by the destination
+func bindSourceIP(dest net.IP) string {
+	if dest == nil || dest.IsUnspecified() {
+		return "0.0.0.0"
+	}
+	// a udp dial only selects a route, no packet is sent
+	conn, err := net.Dial("udp", net.JoinHostPort(dest.String(), "9"))
+	if err != nil {
+		return "0.0.0.0"
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// handleSocks5AssociateUnsupported rejects UDP ASSOCIATE, used in tunnel mode
+// where the relay address would only be reachable locally
+func handleSocks5AssociateUnsupported(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	if err := socks5.SendReply(writer, statute.RepCommandNotSupported, nil); err != nil {
+		return errors.Wrap(err, "failed to send reply")
+	}
+	return errors.New("udp associate is not supported through the tunnel")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// startSocks5 serves a socks5 server without authentication on loopback
+func startSocks5(t *testing.T, opts ...socks5.Option) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = socks5.NewServer(opts...).Serve(listener)
+	}()
+	return listener.Addr().String()
+}
+
+// socks5Request opens a connection to the socks5 server at addr and sends
+// a cmd request for dest, an ipv4 address or host name with its port
+func socks5Request(t *testing.T, addr string, cmd byte, dest string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != statute.MethodNoAuth {
+		t.Fatalf("socks5 greeting answered %v: %v", method, err)
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := []byte{statute.VersionSocks5, cmd, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(append(request, statute.ATYPIPv4), ip...)
+	} else {
+		request = append(append(request, statute.ATYPDomain, byte(len(host))), host...)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	request = binary.BigEndian.AppendUint16(request, uint16(portNumber))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readSocks5Reply reads a reply carrying an ipv4 or ipv6 address
+func readSocks5Reply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("no socks5 reply: %v", err)
+	}
+	size := net.IPv4len
+	if header[3] == statute.ATYPIPv6 {
+		size = net.IPv6len
+	}
+	addr := make([]byte, size+2)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		t.Fatalf("short socks5 reply: %v", err)
+	}
+	return header[1], &net.TCPAddr{IP: net.IP(addr[:size]), Port: int(binary.BigEndian.Uint16(addr[size:]))}
+}
+
+func TestSocks5BindDisabled(t *testing.T) {
+	conn := socks5Request(t, startSocks5(t), statute.CommandBind, "127.0.0.1:21")
+	if rep, _ := readSocks5Reply(t, conn); rep != statute.RepCommandNotSupported {
+		t.Fatalf("BIND without -enable-bind replied %d, want command not supported", rep)
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	addr := startSocks5(t, socks5.WithBindHandle(handleSocks5Bind))
+	conn := socks5Request(t, addr, statute.CommandBind, "127.0.0.1:21")
+	rep, bound := readSocks5Reply(t, conn)
+	if rep != statute.RepSuccess || bound.Port == 0 {
+		t.Fatalf("BIND replied %d with %s, want a bound address", rep, bound)
+	}
+
+	// the destination connects back to the bound address
+	inbound, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bound.Port)), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = inbound.Close()
+	}()
+	if rep, peer := readSocks5Reply(t, conn); rep != statute.RepSuccess || peer.Port != inbound.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("second BIND reply %d for %s, want the inbound connection", rep, peer)
+	}
+
+	// data is relayed both ways
+	_ = inbound.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := inbound.Write([]byte("220 ready")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("220 ready"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "220 ready" {
+		t.Fatalf("client read %q: %v", buf, err)
+	}
+	if _, err := conn.Write([]byte("PORT")); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, len("PORT"))
+	if _, err := io.ReadFull(inbound, buf); err != nil || string(buf) != "PORT" {
+		t.Fatalf("destination read %q: %v", buf, err)
+	}
+}
+
+func TestSocks5AssociateUnsupported(t *testing.T) {
+	proxy := startSocks5(t, socks5.WithAssociateHandle(handleSocks5AssociateUnsupported))
+	conn := socks5Request(t, proxy, statute.CommandAssociate, "0.0.0.0:0")
+	if rep, _ := readSocks5Reply(t, conn); rep != statute.RepCommandNotSupported {
+		t.Fatalf("ASSOCIATE in tunnel mode answered %d, want command not supported", rep)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// defaultUDPBufferSize holds the largest possible udp payload
+const defaultUDPBufferSize = 64 * 1024
+
+// udpBufferSize is the largest datagram relayed by UDP ASSOCIATE, larger
+// datagrams are dropped instead of being truncated
+var udpBufferSize = defaultUDPBufferSize
+
+// validateUDPBufferSize checks -udp-buffer-size
+func validateUDPBufferSize() error {
+	if udpBufferSize <= 0 {
+		return errors.Errorf("invalid -udp-buffer-size %d, must be positive", udpBufferSize)
+	}
+	return nil
+}
+
+// newSocks5AssociateHandler returns the handler of the SOCKS5 UDP ASSOCIATE
+// command, relaying datagrams of up to udpBufferSize bytes through dial.
+// The association ends when the client closes its control connection.
+func newSocks5AssociateHandler(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		// the relay is advertised on the address the client reached the proxy on
+		local := &net.UDPAddr{}
+		if addr, ok := request.LocalAddr.(*net.TCPAddr); ok {
+			local.IP = addr.IP
+		}
+		relay, err := net.ListenUDP("udp", local)
+		if err != nil {
+			_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return errors.Wrap(err, "udp listen failed")
+		}
+		defer func() {
+			_ = relay.Close()
+		}()
+		if err := socks5.SendReply(writer, statute.RepSuccess, relay.LocalAddr()); err != nil {
+			return errors.Wrap(err, "failed to send associate reply")
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go relayUDP(ctx, relay, request, dial)
+
+		// the control connection carries no data, it is only read to notice it closing
+		_, err = io.Copy(io.Discard, request.Reader)
+		return err
+	}
+}
+
+// relayUDP forwards the client's datagrams to their destinations and the
+// answers back to the client, until ctx is done
+func relayUDP(ctx context.Context, relay *net.UDPConn, request *socks5.Request, dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	var targets sync.Map
+	defer targets.Range(func(_, target any) bool {
+		_ = target.(net.Conn).Close()
+		return true
+	})
+	stop := context.AfterFunc(ctx, func() {
+		_ = relay.Close()
+	})
+	defer stop()
+
+	// one extra byte tells an oversized datagram from one filling the buffer
+	size := udpBufferSize
+	buf := make([]byte, size+1)
+	for {
+		n, client, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n > size {
+			gologger.Debug().Msgf("dropping udp datagram from %s larger than %d bytes", client, size)
+			continue
+		}
+		if !isAssociatedClient(request, client) {
+			continue
+		}
+		datagram, err := statute.ParseDatagram(buf[:n])
+		if err != nil || datagram.Frag != 0 {
+			// fragmented datagrams are not supported and are dropped
+			continue
+		}
+
+		destination := datagram.DstAddr.String()
+		key := client.String() + "-" + destination
+		target, ok := targets.Load(key)
+		if !ok {
+			conn, err := dial(ctx, "udp", destination)
+			if err != nil {
+				gologger.Debug().Msgf("could not dial udp %s: %v", destination, err)
+				continue
+			}
+			targets.Store(key, conn)
+			go relayUDPAnswers(relay, conn, client, datagram.Header(), size)
+			target = conn
+		}
+		if _, err := target.(net.Conn).Write(datagram.Data); err != nil {
+			gologger.Debug().Msgf("could not send udp datagram to %s: %v", destination, err)
+		}
+	}
+}
+
+// relayUDPAnswers sends the datagrams received from target back to client,
+// prefixed with header, dropping those larger than size
+func relayUDPAnswers(relay *net.UDPConn, target net.Conn, client *net.UDPAddr, header []byte, size int) {
+	buf := make([]byte, len(header)+size+1)
+	copy(buf, header)
+	for {
+		n, err := target.Read(buf[len(header):])
+		if err != nil {
+			return
+		}
+		if n > size {
+			gologger.Debug().Msgf("dropping udp datagram from %s larger than %d bytes", target.RemoteAddr(), size)
+			continue
+		}
+		if _, err := relay.WriteToUDP(buf[:len(header)+n], client); err != nil {
+			return
+		}
+	}
+}
+
+// isAssociatedClient reports whether client matches the address given in the
+// associate request, unspecified ips and zero ports match any client
+func isAssociatedClient(request *socks5.Request, client *net.UDPAddr) bool {
+	expected := request.DestAddr
+	if expected == nil {
+		return true
+	}
+	ipMatches := expected.IP == nil || expected.IP.IsUnspecified() || expected.IP.Equal(client.IP)
+	portMatches := expected.Port == 0 || expected.Port == client.Port
+	return ipMatches && portMatches
+}
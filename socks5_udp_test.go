@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	socks5 "github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// startUDPEchoTarget runs a udp target echoing datagrams, answering
+// "oversized" with a datagram of answerSize bytes
+func startUDPEchoTarget(t *testing.T, answerSize int) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 128*1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			answer := buf[:n]
+			if string(answer) == "oversized" {
+				answer = bytes.Repeat([]byte("a"), answerSize)
+			}
+			_, _ = conn.WriteToUDP(answer, addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// udpDatagram prefixes payload with the socks5 udp header for dest
+func udpDatagram(dest *net.UDPAddr, payload []byte) []byte {
+	header := []byte{0, 0, 0, statute.ATYPIPv4}
+	header = append(header, dest.IP.To4()...)
+	header = append(header, byte(dest.Port>>8), byte(dest.Port))
+	return append(header, payload...)
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	setForTest(t, &udpBufferSize, 1024)
+	target := startUDPEchoTarget(t, 1025)
+	proxy := startSocks5(t, socks5.WithAssociateHandle(newSocks5AssociateHandler(nil)))
+	control := socks5Request(t, proxy, statute.CommandAssociate, "0.0.0.0:0")
+	rep, relay := readSocks5Reply(t, control)
+	if rep != statute.RepSuccess {
+		t.Fatalf("UDP ASSOCIATE replied %d", rep)
+	}
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: relay.IP, Port: relay.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	// exchange sends payload and returns the relayed answer, nil when none came back
+	exchange := func(payload []byte) []byte {
+		t.Helper()
+		if _, err := client.Write(udpDatagram(target, payload)); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		buf := make([]byte, 128*1024)
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil
+		}
+		datagram, err := statute.ParseDatagram(buf[:n])
+		if err != nil {
+			t.Fatalf("invalid relayed datagram: %v", err)
+		}
+		return datagram.Data
+	}
+
+	// the 10 byte header counts towards the limit of datagrams from the client
+	atLimit := bytes.Repeat([]byte("x"), 1024-10)
+	if got := exchange(atLimit); !bytes.Equal(got, atLimit) {
+		t.Fatalf("datagram at the limit relayed as %d bytes, want %d", len(got), len(atLimit))
+	}
+	if got := exchange(append(atLimit, 'x')); got != nil {
+		t.Fatalf("datagram above the limit relayed as %d bytes, want it dropped", len(got))
+	}
+	if got := exchange([]byte("oversized")); got != nil {
+		t.Fatalf("answer above the limit relayed as %d bytes, want it dropped", len(got))
+	}
+	if got := exchange([]byte("small")); string(got) != "small" {
+		t.Fatalf("relay stopped after dropping datagrams, got %q", got)
+	}
+}
+
+func TestValidateUDPBufferSize(t *testing.T) {
+	for size, valid := range map[int]bool{-1: false, 0: false, 1: true, defaultUDPBufferSize: true} {
+		setForTest(t, &udpBufferSize, size)
+		if err := validateUDPBufferSize(); (err == nil) != valid {
+			t.Errorf("-udp-buffer-size %d: %v", size, err)
+		}
+	}
+}
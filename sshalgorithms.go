@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/goflags"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// sshKeyExchanges restricts the key exchange algorithms of the ssh connection
+	sshKeyExchanges goflags.StringSlice
+	// sshCiphers restricts the ciphers of the ssh connection
+	sshCiphers goflags.StringSlice
+	// sshMACs restricts the macs of the ssh connection
+	sshMACs goflags.StringSlice
+
+	// sshAlgorithms is embedded in the ssh client configs, empty lists keep
+	// the x/crypto defaults
+	sshAlgorithms ssh.Config
+)
+
+// configureSSHAlgorithms checks -ssh-kex, -ssh-ciphers and -ssh-macs against
+// the algorithms x/crypto supports and sets sshAlgorithms
+func configureSSHAlgorithms() error {
+	supported := ssh.SupportedAlgorithms()
+	settings := []struct {
+		flag      string
+		names     goflags.StringSlice
+		supported []string
+		value     *[]string
+	}{
+		{"-ssh-kex", sshKeyExchanges, supported.KeyExchanges, &sshAlgorithms.KeyExchanges},
+		{"-ssh-ciphers", sshCiphers, supported.Ciphers, &sshAlgorithms.Ciphers},
+		{"-ssh-macs", sshMACs, supported.MACs, &sshAlgorithms.MACs},
+	}
+	for _, setting := range settings {
+		for _, name := range setting.names {
+			name = strings.TrimSpace(name)
+			if !slices.Contains(setting.supported, name) {
+				return errors.Errorf("unknown or insecure %s algorithm %q: must be one of %s", setting.flag, name, strings.Join(setting.supported, ", "))
+			}
+			*setting.value = append(*setting.value, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/goflags"
+	"golang.org/x/crypto/ssh"
+)
+
+// useSSHAlgorithms configures sshAlgorithms from the given flag values
+func useSSHAlgorithms(t *testing.T, kex, ciphers, macs goflags.StringSlice) error {
+	t.Helper()
+	setForTest(t, &sshKeyExchanges, kex)
+	setForTest(t, &sshCiphers, ciphers)
+	setForTest(t, &sshMACs, macs)
+	setForTest(t, &sshAlgorithms, ssh.Config{})
+	return configureSSHAlgorithms()
+}
+
+func TestConfigureSSHAlgorithms(t *testing.T) {
+	err := useSSHAlgorithms(t,
+		goflags.StringSlice{"curve25519-sha256"},
+		goflags.StringSlice{"aes256-gcm@openssh.com", " aes128-ctr"},
+		goflags.StringSlice{"hmac-sha2-256-etm@openssh.com"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(sshAlgorithms.KeyExchanges, []string{"curve25519-sha256"}) ||
+		!slices.Equal(sshAlgorithms.Ciphers, []string{"aes256-gcm@openssh.com", "aes128-ctr"}) ||
+		!slices.Equal(sshAlgorithms.MACs, []string{"hmac-sha2-256-etm@openssh.com"}) {
+		t.Fatalf("configured %+v", sshAlgorithms)
+	}
+
+	for _, c := range []struct {
+		flag               string
+		kex, ciphers, macs goflags.StringSlice
+	}{
+		{flag: "-ssh-kex", kex: goflags.StringSlice{"diffie-hellman-group1-sha512"}},
+		{flag: "-ssh-ciphers", ciphers: goflags.StringSlice{"3des-cbc"}},
+		{flag: "-ssh-macs", macs: goflags.StringSlice{"hmac-md5"}},
+	} {
+		err := useSSHAlgorithms(t, c.kex, c.ciphers, c.macs)
+		if err == nil || !strings.Contains(err.Error(), c.flag) {
+			t.Errorf("got %v, want an error naming %s", err, c.flag)
+		}
+	}
+}
+
+func TestSSHAlgorithmsNegotiated(t *testing.T) {
+	srv := startPunchHoleServer(t)
+	srv.restrictCiphers("aes128-ctr")
+	usePunchHole(t, srv, startEchoTarget(t))
+	setForTest(t, &sshTimeout, time.Second)
+
+	// the tunnel offers only the configured cipher
+	if err := useSSHAlgorithms(t, nil, goflags.StringSlice{"chacha20-poly1305@openssh.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := connectTunnel(ctx, false); err == nil || ctx.Err() != nil {
+		t.Fatalf("tunnel without a cipher in common returned %v", err)
+	}
+
+	if err := useSSHAlgorithms(t, nil, goflags.StringSlice{"aes128-ctr"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- connectTunnel(ctx, false)
+	}()
+	echoThrough(t, srv.nextForward(), "hello")
+	cancel()
+	<-done
+}
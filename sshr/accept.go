@@ -0,0 +1,49 @@
+package sshr
+
+import "time"
+
+const (
+	// acceptErrorBurst is the number of accept errors tolerated per
+	// acceptErrorWindow before backing off
+	acceptErrorBurst  = 10
+	acceptErrorWindow = time.Second
+
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// acceptGuard detects rapid repeated accept errors so the accept loop
+// backs off instead of spinning
+type acceptGuard struct {
+	windowStart time.Time
+	errors      int
+	delay       time.Duration
+}
+
+// failure records an accept error and returns how long to wait before
+// accepting again
+func (g *acceptGuard) failure(now time.Time) time.Duration {
+	if now.Sub(g.windowStart) > acceptErrorWindow {
+		g.windowStart = now
+		g.errors = 0
+	}
+	g.errors++
+	if g.errors <= acceptErrorBurst {
+		return 0
+	}
+
+	if g.delay == 0 {
+		g.delay = acceptBackoffMin
+	} else {
+		g.delay *= 2
+	}
+	if g.delay > acceptBackoffMax {
+		g.delay = acceptBackoffMax
+	}
+	return g.delay
+}
+
+// success resets the backoff after a successful accept
+func (g *acceptGuard) success() {
+	g.delay = 0
+}
@@ -0,0 +1,227 @@
+package sshr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcceptGuard(t *testing.T) {
+	var guard acceptGuard
+	now := time.Now()
+	for i := range acceptErrorBurst {
+		if delay := guard.failure(now); delay != 0 {
+			t.Fatalf("backed off after %d errors, within the burst", i+1)
+		}
+	}
+	if delay := guard.failure(now); delay != acceptBackoffMin {
+		t.Fatalf("first backoff is %s, want %s", delay, acceptBackoffMin)
+	}
+	if delay := guard.failure(now); delay != 2*acceptBackoffMin {
+		t.Fatalf("second backoff is %s, want %s", delay, 2*acceptBackoffMin)
+	}
+	for range 20 {
+		guard.failure(now)
+	}
+	if delay := guard.failure(now); delay != acceptBackoffMax {
+		t.Fatalf("backoff is %s, want it capped at %s", delay, acceptBackoffMax)
+	}
+
+	guard.success()
+	if delay := guard.failure(now.Add(2 * acceptErrorWindow)); delay != 0 {
+		t.Fatalf("backed off %s in a new window after a success", delay)
+	}
+}
+
+func TestAcceptGuardErrorStream(t *testing.T) {
+	// a stream of immediate errors spends its time backing off, not spinning
+	var storm acceptGuard
+	now := time.Now()
+	var waited time.Duration
+	for range 1000 {
+		waited += storm.failure(now.Add(waited))
+	}
+	if waited < 100*acceptBackoffMax {
+		t.Fatalf("1000 immediate accept errors backed off %s in total", waited)
+	}
+
+	// errors spread below the burst rate never back off
+	var sparse acceptGuard
+	interval := 2 * acceptErrorWindow / acceptErrorBurst
+	for i := range 100 {
+		if delay := sparse.failure(now.Add(time.Duration(i) * interval)); delay != 0 {
+			t.Fatalf("backed off %s after %d errors %s apart", delay, i+1, interval)
+		}
+	}
+}
+
+// failingListener fails the first failures accepts with an error other
+// than a closed listener and records when each accept returned
+type failingListener struct {
+	net.Listener
+	failures int
+
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.times = append(l.times, time.Now())
+	failing := len(l.times) <= l.failures
+	l.mu.Unlock()
+	if failing {
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func (l *failingListener) acceptTimes() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.times)
+}
+
+func TestAcceptLoopBacksOff(t *testing.T) {
+	srv := startTestServer(t)
+	s, err := New(testConfig(srv, startEchoServer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// five errors past the burst back off 5, 10, 20, 40 and 80ms
+	const failures = acceptErrorBurst + 5
+	listener := &failingListener{failures: failures}
+	s.wrapListener = func(l net.Listener) net.Listener {
+		listener.Listener = l
+		return listener
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	// the loop keeps serving once Accept recovers
+	remote := srv.nextForward()
+	echo(t, remote, "hello")
+	echo(t, remote, "again")
+
+	times := listener.acceptTimes()
+	if len(times) <= failures {
+		t.Fatalf("%d accepts, want the %d failures and then real ones", len(times), failures)
+	}
+	if burst := times[acceptErrorBurst-1].Sub(times[0]); burst >= acceptBackoffMin {
+		t.Fatalf("the first %d errors took %s, want no backoff within the burst", acceptErrorBurst, burst)
+	}
+	var backoff time.Duration
+	for delay := acceptBackoffMin; delay <= 16*acceptBackoffMin; delay *= 2 {
+		backoff += delay
+	}
+	if waited := times[failures].Sub(times[acceptErrorBurst-1]); waited < backoff {
+		t.Fatalf("accepting resumed %s after the burst, want a backoff of at least %s", waited, backoff)
+	}
+	if got := s.Stats().Snapshot().AcceptErrors; got != failures {
+		t.Fatalf("accept_errors is %d, want %d", got, failures)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after the accept errors", err)
+	}
+}
+
+// BenchmarkAcceptBurst opens bursts of concurrent connections through the
+// tunnel with AcceptProxyProtocol, each sending its header after 5ms. A
+// connection waits for its header holding a backlog slot, the benchmark
+// reports how many slots were held at most next to the throughput. The
+// headers arrive concurrently, so a small backlog caps the waiting
+// connections without serializing the burst behind the first one.
+func BenchmarkAcceptBurst(b *testing.B) {
+	const (
+		burst = 32
+		delay = 5 * time.Millisecond
+	)
+	header := []byte("PROXY TCP4 192.0.2.1 192.0.2.2 40000 443\r\n")
+	for _, backlog := range []int{1, 8, 128} {
+		b.Run(fmt.Sprintf("backlog=%d", backlog), func(b *testing.B) {
+			srv := startTestServer(b)
+			config := testConfig(srv, startEchoServer(b))
+			config.AcceptBacklog = backlog
+			config.AcceptProxyProtocol = true
+			s, err := New(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = s.Run(ctx)
+			}()
+			remote := srv.nextForward()
+
+			// sample the backlog occupancy while the bursts run
+			var peak int
+			sampled := make(chan struct{})
+			stopSampling := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				ticker := time.NewTicker(100 * time.Microsecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stopSampling:
+						return
+					case <-ticker.C:
+						peak = max(peak, len(s.pending))
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			started := time.Now()
+			for range b.N {
+				var wg sync.WaitGroup
+				for range burst {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						conn, err := net.DialTimeout("tcp", remote, 5*time.Second)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						defer func() {
+							_ = conn.Close()
+						}()
+						_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+						time.Sleep(delay)
+						if _, err := conn.Write(append(header, 'x')); err != nil {
+							b.Error(err)
+							return
+						}
+						if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			elapsed := time.Since(started)
+			close(stopSampling)
+			<-sampled
+			if peak > backlog {
+				b.Fatalf("%d connections held a backlog slot at once, over the backlog of %d", peak, backlog)
+			}
+			b.ReportMetric(float64(b.N*burst)/elapsed.Seconds(), "conns/s")
+			b.ReportMetric(float64(elapsed.Microseconds())/1000/float64(b.N), "ms/burst")
+			b.ReportMetric(float64(peak), "peak_pending")
+		})
+	}
+}
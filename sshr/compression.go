@@ -0,0 +1,110 @@
+package sshr
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how the stream to the punch-hole server is compressed.
+// The server must be configured with the same compression.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// Validate returns an error for unknown compression names
+func (c Compression) Validate() error {
+	switch c {
+	case CompressionNone, "none", CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q", string(c))
+	}
+}
+
+// flushWriteCloser is a compressing writer that can be flushed
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// flushingWriter flushes after every write so interactive traffic is not
+// held back in the compressor
+type flushingWriter struct {
+	w flushWriteCloser
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
+
+// Close writes the stream trailer, it does not close the underlying writer
+func (f *flushingWriter) Close() error {
+	return f.w.Close()
+}
+
+// lazyReader creates the decompressor on first read, since creating it
+// reads the stream header and would block until the peer sends data
+type lazyReader struct {
+	open func() (io.Reader, error)
+	r    io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		r, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		l.r = r
+	}
+	return l.r.Read(p)
+}
+
+// nopWriteCloser is used when the stream is not compressed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressStreams returns a reader decompressing from rw and a writer
+// compressing into it
+func compressStreams(c Compression, rw io.ReadWriter) (io.Reader, io.WriteCloser, error) {
+	switch c {
+	case CompressionNone, "none":
+		return rw, nopWriteCloser{rw}, nil
+	case CompressionGzip:
+		reader := &lazyReader{open: func() (io.Reader, error) {
+			return gzip.NewReader(rw)
+		}}
+		return reader, &flushingWriter{w: gzip.NewWriter(rw)}, nil
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(rw)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader := &lazyReader{open: func() (io.Reader, error) {
+			decoder, err := zstd.NewReader(rw, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		}}
+		return reader, &flushingWriter{w: encoder}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown compression %q", string(c))
+	}
+}
@@ -0,0 +1,61 @@
+package sshr
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCompressionBytesOnWire(t *testing.T) {
+	payload := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n", 2000))
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		var wire bytes.Buffer
+		reader, writer, err := compressStreams(c, &wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the payload goes out in chunks, as the copy loop writes it
+		for chunk := range slices.Chunk(payload, 4096) {
+			if _, err := writer.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		sent := wire.Len()
+
+		received, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%q: %v", c, err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatalf("%q: read back %d bytes, want the %d byte payload", c, len(received), len(payload))
+		}
+		switch {
+		case c == CompressionNone && sent != len(payload):
+			t.Errorf("uncompressed stream sent %d bytes for %d", sent, len(payload))
+		case c != CompressionNone && sent > len(payload)/4:
+			t.Errorf("%s sent %d bytes for a compressible %d byte payload", c, sent, len(payload))
+		}
+		t.Logf("%q: %d bytes on the wire for %d", c, sent, len(payload))
+	}
+}
+
+func TestCompressionValidate(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, "none", CompressionGzip, CompressionZstd} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%q: %v", c, err)
+		}
+	}
+	if err := Compression("lz4").Validate(); err == nil {
+		t.Error("unknown compression lz4 accepted")
+	}
+	if _, err := New(Config{SSHClientConfig: &ssh.ClientConfig{}, Compression: "lz4"}); err == nil {
+		t.Error("New accepted the unknown compression lz4")
+	}
+}
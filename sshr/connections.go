@@ -0,0 +1,129 @@
+package sshr
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// connection is a forwarded connection tracked while it is active
+type connection struct {
+	id          string
+	remoteAddr  string
+	localTarget string
+	started     time.Time
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	// cancel tears both ends of the connection down
+	cancel context.CancelFunc
+}
+
+// ConnectionInfo describes an active forwarded connection
+type ConnectionInfo struct {
+	// ID correlates the connection across logs
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	LocalTarget string    `json:"local_target"`
+	Started     time.Time `json:"started"`
+	Duration    string    `json:"duration"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+}
+
+// trackConnection registers a new active connection, cancel must close it
+func (s *SSHR) trackConnection(remoteAddr, localTarget string, cancel context.CancelFunc) *connection {
+	c := &connection{
+		id:          strconv.FormatUint(s.connectionSeq.Add(1), 10),
+		remoteAddr:  remoteAddr,
+		localTarget: localTarget,
+		started:     time.Now(),
+		cancel:      cancel,
+	}
+	s.connections.Store(c.id, c)
+	return c
+}
+
+// CloseConnection closes both ends of the active connection with the given
+// id, it reports whether the connection was found
+func (s *SSHR) CloseConnection(id string) bool {
+	value, ok := s.connections.Load(id)
+	if !ok {
+		return false
+	}
+	value.(*connection).cancel()
+	return true
+}
+
+// Connections returns the active forwarded connections, oldest first
+func (s *SSHR) Connections() []ConnectionInfo {
+	var infos []ConnectionInfo
+	s.connections.Range(func(_, value any) bool {
+		c := value.(*connection)
+		infos = append(infos, ConnectionInfo{
+			ID:          c.id,
+			RemoteAddr:  c.remoteAddr,
+			LocalTarget: c.localTarget,
+			Started:     c.started,
+			Duration:    time.Since(c.started).Round(time.Second).String(),
+			BytesIn:     c.bytesIn.Load(),
+			BytesOut:    c.bytesOut.Load(),
+		})
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// closeDrainingConnections closes every connection that has been draining
+// for DrainConnectionTimeout, however active it is, checking until done is
+// closed
+func (s *SSHR) closeDrainingConnections(done <-chan struct{}) {
+	draining := make(map[*connection]time.Time)
+	ticker := time.NewTicker(max(min(s.config.DrainConnectionTimeout/4, time.Second), time.Millisecond))
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		s.connections.Range(func(_, value any) bool {
+			c := value.(*connection)
+			since, ok := draining[c]
+			if !ok {
+				draining[c] = now
+				return true
+			}
+			if now.Sub(since) >= s.config.DrainConnectionTimeout {
+				s.config.Logger.Warn("closing connection at its drain timeout",
+					slog.String("id", c.id),
+					slog.String("remote_addr", c.remoteAddr),
+				)
+				c.cancel()
+			}
+			return true
+		})
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// countingWriter counts the bytes written to the wrapped writer in n and
+// total as they are written
+type countingWriter struct {
+	io.Writer
+	n     *atomic.Uint64
+	total *atomic.Uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n.Add(uint64(n))
+	w.total.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,204 @@
+package sshr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDrainConnectionTimeout(t *testing.T) {
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.DrainTimeout = 10 * time.Second
+	config.DrainConnectionTimeout = 300 * time.Millisecond
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	remote := srv.nextForward()
+
+	dial := func() net.Conn {
+		conn, err := net.DialTimeout("tcp", remote, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	stuck, quick := dial(), dial()
+
+	// the stuck connection keeps transferring, it is closed regardless
+	go func() {
+		for {
+			if _, err := stuck.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, stuck)
+	}()
+
+	started := time.Now()
+	cancel()
+	_ = quick.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stuck connection held the drain up to DrainTimeout")
+	}
+	if elapsed := time.Since(started); elapsed < config.DrainConnectionTimeout {
+		t.Fatalf("drain finished after %s, before the per-connection timeout", elapsed)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	srv := startTestServer(t)
+	target := startEchoServer(t)
+	s, err := New(testConfig(srv, target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+
+	conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []ConnectionInfo
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		// the reply is counted once it was written back
+		if infos = s.Connections(); len(infos) == 1 && infos[0].BytesIn == 5 && infos[0].BytesOut == 5 {
+			break
+		}
+	}
+	if len(infos) != 1 {
+		t.Fatalf("listed %d connections, want the active one", len(infos))
+	}
+	info := infos[0]
+	if info.ID == "" || info.LocalTarget != target || info.RemoteAddr != conn.LocalAddr().String() {
+		t.Fatalf("listed %+v, want id, remote addr %s and local target %s", info, conn.LocalAddr(), target)
+	}
+	if info.BytesIn != 5 || info.BytesOut != 5 || info.Started.IsZero() || info.Duration == "" {
+		t.Fatalf("listed %+v, want 5 bytes each way and the start time", info)
+	}
+
+	_ = conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(s.Connections()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("closed connection still listed: %+v", s.Connections())
+		}
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	srv := startTestServer(t)
+	s, err := New(testConfig(srv, listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var target net.Conn
+	select {
+	case target = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local target not reached")
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	_ = target.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var infos []ConnectionInfo
+	for deadline := time.Now().Add(5 * time.Second); len(infos) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		infos = s.Connections()
+	}
+	if len(infos) != 1 {
+		t.Fatalf("listed %d connections, want the active one", len(infos))
+	}
+	if s.CloseConnection("unknown") {
+		t.Fatal("closed a connection with an unknown id")
+	}
+	if !s.CloseConnection(infos[0].ID) {
+		t.Fatalf("connection %s not found", infos[0].ID)
+	}
+
+	// both ends see the connection closed
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("tunneled connection still open: %v", err)
+	}
+	if _, err := target.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("local target connection still open: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(s.Connections()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("killed connection still listed")
+		}
+	}
+	if s.CloseConnection(infos[0].ID) {
+		t.Fatal("closed a connection twice")
+	}
+}
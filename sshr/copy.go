@@ -0,0 +1,179 @@
+package sshr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// copyBufferSize is the size of the buffers used to copy between the ends
+// of a forwarded connection, the io.Copy default
+const copyBufferSize = 32 * 1024
+
+// copyBuffers reuses copy buffers across connections, which would otherwise
+// allocate two per connection as the wrapped readers and writers defeat the
+// io.ReaderFrom and io.WriterTo fast paths
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// CloseReason describes why one direction of a forwarded connection ended
+type CloseReason string
+
+const (
+	CloseReasonEOF         CloseReason = "eof"
+	CloseReasonReadError   CloseReason = "read_error"
+	CloseReasonWriteError  CloseReason = "write_error"
+	CloseReasonIdleTimeout CloseReason = "idle_timeout"
+	CloseReasonShutdown    CloseReason = "shutdown"
+	// CloseReasonDeadline is a read or write exceeding OperationDeadline, or
+	// the connection outliving ConnectionDeadline
+	CloseReasonDeadline CloseReason = "deadline"
+	// CloseReasonTargetReset is the local target resetting the connection,
+	// usually the local service crashing or restarting
+	CloseReasonTargetReset CloseReason = "target_reset"
+)
+
+// errReader records the first non EOF error returned by the wrapped reader
+type errReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// errWriter records the first error returned by the wrapped writer
+type errWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// errOperationDeadline is returned by a read or write exceeding OperationDeadline
+var errOperationDeadline = errors.New("operation deadline exceeded")
+
+// errConnectionDeadline is the cause of a connection outliving ConnectionDeadline
+var errConnectionDeadline = errors.New("connection deadline exceeded")
+
+// deadlineReader bounds every Read by timeout through the read deadline of
+// conn, refreshed before each one
+type deadlineReader struct {
+	io.Reader
+	deadline operationDeadline
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	r.deadline.start(r.deadline.conn.SetReadDeadline)
+	n, err := r.Reader.Read(p)
+	return n, deadlineError(err, r.deadline.stop())
+}
+
+// deadlineWriter bounds every Write by timeout through the write deadline
+// of conn, refreshed before each one
+type deadlineWriter struct {
+	io.Writer
+	deadline operationDeadline
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.deadline.start(w.deadline.conn.SetWriteDeadline)
+	n, err := w.Writer.Write(p)
+	return n, deadlineError(err, w.deadline.stop())
+}
+
+// operationDeadline bounds the operations of one direction of conn. Conns
+// without deadline support, such as SSH channels, are closed by a timer
+// instead, created once and reset before every operation.
+type operationDeadline struct {
+	conn    net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+// start sets a deadline of timeout from now with set, or arms the timer
+// when conn does not support it
+func (d *operationDeadline) start(set func(time.Time) error) {
+	if set(time.Now().Add(d.timeout)) == nil {
+		return
+	}
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.timeout, func() {
+			d.fired.Store(true)
+			_ = d.conn.Close()
+		})
+		return
+	}
+	d.timer.Reset(d.timeout)
+}
+
+// stop ends the operation and reports whether its deadline passed
+func (d *operationDeadline) stop() bool {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	return d.fired.Load()
+}
+
+// deadlineError marks err as errOperationDeadline when the operation ran
+// out of time
+func deadlineError(err error, expired bool) error {
+	if err != nil && (expired || errors.Is(err, os.ErrDeadlineExceeded)) {
+		return fmt.Errorf("%w: %v", errOperationDeadline, err)
+	}
+	return err
+}
+
+// copyConn copies src to dst and reports why the copy ended
+func copyConn(ctx context.Context, dst io.Writer, src io.Reader) (int64, CloseReason, error) {
+	r := &errReader{Reader: src}
+	w := &errWriter{Writer: dst}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	n, err := io.CopyBuffer(w, r, *buf)
+
+	var reason CloseReason
+	switch {
+	case err == nil:
+		reason = CloseReasonEOF
+	case errors.Is(err, errOperationDeadline), errors.Is(context.Cause(ctx), errConnectionDeadline):
+		reason = CloseReasonDeadline
+	case ctx.Err() != nil:
+		reason = CloseReasonShutdown
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		reason = CloseReasonIdleTimeout
+	case w.err != nil:
+		reason = CloseReasonWriteError
+	default:
+		reason = CloseReasonReadError
+	}
+	return n, reason, err
+}
+
+// isReset reports whether err is the peer resetting the connection
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,288 @@
+package sshr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// dripConn writes a byte through the tunnel every interval until it fails,
+// it returns how long the connection stayed up
+func dripConn(t *testing.T, addr string, interval, limit time.Duration) time.Duration {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	started := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for time.Since(started) < limit {
+		select {
+		case <-closed:
+			return time.Since(started)
+		case <-ticker.C:
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return time.Since(started)
+			}
+		}
+	}
+	return time.Since(started)
+}
+
+func TestOperationDeadline(t *testing.T) {
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.OperationDeadline = 100 * time.Millisecond
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	remote := srv.nextForward()
+
+	// traffic faster than the deadline renews it on every read and write
+	if up := dripConn(t, remote, 10*time.Millisecond, time.Second); up < time.Second {
+		t.Fatalf("active connection closed after %s with a %s operation deadline", up, config.OperationDeadline)
+	}
+	// a slow drip keeps no single read within the deadline
+	if up := dripConn(t, remote, 300*time.Millisecond, 5*time.Second); up >= 5*time.Second {
+		t.Fatal("slow drip connection was never closed")
+	}
+}
+
+func TestConnectionDeadline(t *testing.T) {
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.OperationDeadline = 200 * time.Millisecond
+	config.ConnectionDeadline = time.Second
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	remote := srv.nextForward()
+
+	// a drip within the operation deadline keeps renewing it, only the
+	// connection deadline ends it
+	up := dripConn(t, remote, 20*time.Millisecond, 5*time.Second)
+	if up >= 5*time.Second {
+		t.Fatal("dripping connection was never closed")
+	}
+	if up < config.ConnectionDeadline {
+		t.Fatalf("dripping connection closed after %s, before the %s connection deadline", up, config.ConnectionDeadline)
+	}
+}
+
+// BenchmarkForward drives concurrent short-lived connections through the
+// tunnel, each echoing a 1KB message, and reports the connection latency
+func BenchmarkForward(b *testing.B) {
+	srv := startTestServer(b)
+	s, err := New(testConfig(srv, startEchoServer(b)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	remote := srv.nextForward()
+
+	msg := make([]byte, 1024)
+	b.SetBytes(int64(2 * len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, len(msg))
+		for pb.Next() {
+			conn, err := net.DialTimeout("tcp", remote, 5*time.Second)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := conn.Write(msg); err != nil {
+				b.Error(err)
+			} else if _, err := io.ReadFull(conn, buf); err != nil {
+				b.Error(err)
+			}
+			_ = conn.Close()
+		}
+	})
+	b.StopTimer()
+
+	// the stress must not leave connections behind
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Stats().Snapshot().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			b.Fatalf("%d connections still active", s.Stats().Snapshot().ActiveConnections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkCopyConn copies a 64KB stream the way each direction of a
+// forwarded connection does
+func BenchmarkCopyConn(b *testing.B) {
+	data := make([]byte, 64*1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := copyConn(context.Background(), io.Discard, bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// failingWriter fails every write with err
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestCopyConnReasons(t *testing.T) {
+	errBroken := errors.New("broken")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		dst    io.Writer
+		src    io.Reader
+		reason CloseReason
+	}{
+		{"eof", context.Background(), io.Discard, strings.NewReader("data"), CloseReasonEOF},
+		{"read error", context.Background(), io.Discard, iotest.ErrReader(errBroken), CloseReasonReadError},
+		{"write error", context.Background(), failingWriter{errBroken}, strings.NewReader("data"), CloseReasonWriteError},
+		{"shutdown", cancelled, io.Discard, iotest.ErrReader(errBroken), CloseReasonShutdown},
+		{"idle timeout", context.Background(), io.Discard, iotest.ErrReader(os.ErrDeadlineExceeded), CloseReasonIdleTimeout},
+	} {
+		if _, reason, _ := copyConn(tc.ctx, tc.dst, tc.src); reason != tc.reason {
+			t.Errorf("%s ended with %s, want %s", tc.name, reason, tc.reason)
+		}
+	}
+}
+
+func TestCloseReasonLogged(t *testing.T) {
+	srv := startTestServer(t)
+	logger := &recordingLogger{}
+	config := testConfig(srv, startEchoServer(t))
+	config.Logger = logger
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+
+	echo(t, srv.nextForward(), "hello")
+	for _, entry := range logger.wait(t, "closed connection", 2) {
+		if entry.attrs["reason"] != string(CloseReasonEOF) {
+			t.Errorf("%s closed with %q, want eof", entry.attrs["direction"], entry.attrs["reason"])
+		}
+	}
+
+	s.logClose("1", "proxy -> tunnelx -> punch-hole", CloseReasonReadError, errors.New("broken"))
+	errs := logger.find("copy data error")
+	if len(errs) != 1 || errs[0].level != "error" || errs[0].attrs["reason"] != string(CloseReasonReadError) || errs[0].attrs["error"] != "broken" {
+		t.Fatalf("read error logged as %+v", errs)
+	}
+}
+
+// startClosingTarget runs a local target closing every connection it
+// accepts, resetting it when reset is set
+func startClosingTarget(t *testing.T, reset bool) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if reset {
+				_ = conn.(*net.TCPConn).SetLinger(0)
+			}
+			_ = conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTargetReset(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reset bool
+	}{
+		{"reset", true},
+		{"closed", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startTestServer(t)
+			logger := &recordingLogger{}
+			config := testConfig(srv, startClosingTarget(t, tc.reset))
+			config.Logger = logger
+			config.Stats = &Stats{}
+			s, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = s.Run(ctx)
+			}()
+
+			if got := readAll(t, srv.nextForward()); got != "" {
+				t.Fatalf("read %q from a target closing the connection", got)
+			}
+			if tc.reset {
+				entries := logger.wait(t, "local target reset the connection", 1)
+				if entries[0].level != "warn" || entries[0].attrs["local_target"] != config.LocalTarget {
+					t.Fatalf("reset logged as %+v", entries[0])
+				}
+				if got := config.Stats.Snapshot().TargetResets; got == 0 {
+					t.Fatal("reset not counted")
+				}
+				return
+			}
+			logger.wait(t, "closed connection", 2)
+			if resets := logger.find("local target reset the connection"); len(resets) != 0 || config.Stats.Snapshot().TargetResets != 0 {
+				t.Fatalf("closed connection reported as a reset: %+v", resets)
+			}
+		})
+	}
+}
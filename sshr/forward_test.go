@@ -0,0 +1,144 @@
+package sshr
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// startForwarding forwards between the local ends of a remote and a proxy
+// pair and returns their peers and the result of forward
+func startForwarding(t *testing.T) (remotePeer, proxyPeer *net.TCPConn, done <-chan error) {
+	t.Helper()
+	s, err := New(Config{SSHClientConfig: &ssh.ClientConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotePeer, conn := tcpPair(t)
+	proxyConn, proxyPeer := tcpPair(t)
+	c := s.trackConnection(conn.RemoteAddr().String(), proxyConn.RemoteAddr().String(), func() {})
+	result := make(chan error, 1)
+	go func() {
+		result <- s.forward(context.Background(), c, conn, proxyConn, conn, nopWriteCloser{conn})
+	}()
+	return remotePeer, proxyPeer, result
+}
+
+// waitClosed checks conn reaches EOF or an error within 5s
+func waitClosed(t *testing.T, conn net.Conn, name string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("%s still open", name)
+		}
+	}
+}
+
+func TestForwardErrorTearsDownBothDirections(t *testing.T) {
+	remotePeer, proxyPeer, done := startForwarding(t)
+
+	// the local target resets the connection while the remote side is idle
+	_ = proxyPeer.SetLinger(0)
+	_ = proxyPeer.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("forward returned no error after a reset")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward still running after the local target reset")
+	}
+	waitClosed(t, remotePeer, "remote connection")
+}
+
+func TestForwardEOFHalfCloses(t *testing.T) {
+	remotePeer, proxyPeer, done := startForwarding(t)
+
+	// the remote side is done sending, the local target still answers
+	if _, err := remotePeer.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	_ = remotePeer.CloseWrite()
+	_ = proxyPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	request, err := io.ReadAll(proxyPeer)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("local target read %q: %v", request, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("forward returned %v with the response direction still open", err)
+	default:
+	}
+	if _, err := proxyPeer.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	_ = proxyPeer.CloseWrite()
+	_ = remotePeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(remotePeer)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("remote side read %q: %v", response, err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("forward returned %v after both directions ended", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward still running after both directions ended")
+	}
+}
+
+func TestForwardContextTearsDown(t *testing.T) {
+	s, err := New(Config{SSHClientConfig: &ssh.ClientConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotePeer, conn := tcpPair(t)
+	proxyConn, proxyPeer := tcpPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := s.trackConnection(conn.RemoteAddr().String(), proxyConn.RemoteAddr().String(), cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.forward(ctx, c, conn, proxyConn, conn, nopWriteCloser{conn})
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward still running after its context was cancelled")
+	}
+	waitClosed(t, remotePeer, "remote connection")
+	waitClosed(t, proxyPeer, "local target connection")
+}
@@ -0,0 +1,144 @@
+package sshr
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFDs counts the open file descriptors of the process, -1 where
+// /proc/self/fd is not available. Pipes are left out, the runtime pools
+// them for splicing between tcp conns and frees them on GC only.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	n := 0
+	for _, entry := range entries {
+		if link, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name())); err == nil && strings.HasPrefix(link, "pipe:") {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// waitForBaseline waits for count to drop back to at most baseline plus
+// slack, reporting the last count when it does not within 10s. It does not
+// run the GC, whose finalizers would close leaked fds.
+func waitForBaseline(count func() int, baseline, slack int) (int, bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		n := count()
+		if n <= baseline+slack {
+			return n, true
+		}
+		if time.Now().After(deadline) {
+			return n, false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNoLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("leak harness forwards many connections")
+	}
+	// finalizers would close leaked conns on GC and hide them
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	srv := startTestServer(t)
+	target := startEchoServer(t)
+
+	// goroutines of the servers above and of the runtime are part of the baseline
+	time.Sleep(50 * time.Millisecond)
+	goroutines, fds := runtime.NumGoroutine(), openFDs()
+
+	s, err := New(testConfig(srv, target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	remote := srv.nextForward()
+
+	const connections, concurrency = 200, 16
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range connections {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				<-sem
+			}()
+			conn, err := net.DialTimeout("tcp", remote, 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			msg := []byte("leak check")
+			if _, err := conn.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+				t.Error(err)
+				return
+			}
+			// alternate full closes and half-closes, both must release everything
+			if i%2 == 0 {
+				if tcp, ok := conn.(*net.TCPConn); ok {
+					_ = tcp.CloseWrite()
+					_, _ = io.Copy(io.Discard, conn)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// with the tunnel still up every forwarded connection is gone
+	if stats := s.Stats().Snapshot(); stats.TotalConnections != connections {
+		t.Fatalf("forwarded %d connections, want %d", stats.TotalConnections, connections)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Stats().Snapshot().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still active", s.Stats().Snapshot().ActiveConnections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v", err)
+	}
+	srv.closeConns()
+
+	// the ssh connection on both ends winds down asynchronously
+	if n, ok := waitForBaseline(runtime.NumGoroutine, goroutines, 2); !ok {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines after the tunnel closed, baseline %d:\n%s", n, goroutines, buf[:runtime.Stack(buf, true)])
+	}
+	if fds >= 0 {
+		if n, ok := waitForBaseline(openFDs, fds, 2); !ok {
+			t.Fatalf("%d open fds after the tunnel closed, baseline %d", n, fds)
+		}
+	}
+}
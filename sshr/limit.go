@@ -0,0 +1,70 @@
+package sshr
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// sourceLimiter counts the active connections of every source ip
+type sourceLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire reserves a connection slot for source, failing when it already
+// has max active connections
+func (l *sourceLimiter) acquire(source string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts == nil {
+		l.counts = make(map[string]int)
+	}
+	if l.counts[source] >= max {
+		return false
+	}
+	l.counts[source]++
+	return true
+}
+
+func (l *sourceLimiter) release(source string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[source]--; l.counts[source] <= 0 {
+		delete(l.counts, source)
+	}
+}
+
+// acquireSource applies MaxConnectionsPerSource to conn, the returned
+// release frees its slot once the connection is done
+func (s *SSHR) acquireSource(conn net.Conn) (release func(), ok bool) {
+	if s.config.MaxConnectionsPerSource <= 0 {
+		return func() {}, true
+	}
+	source := sourceIP(conn.RemoteAddr())
+	if !s.sources.acquire(source, s.config.MaxConnectionsPerSource) {
+		s.config.Stats.rejectedConnections.Add(1)
+		s.config.Logger.Warn("connection limit per source reached, rejecting connection",
+			slog.String("source", source),
+			slog.Int("limit", s.config.MaxConnectionsPerSource),
+		)
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.sources.release(source)
+		})
+	}, true
+}
+
+// sourceIP is the ip of addr without the port
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,99 @@
+package sshr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialFrom opens a connection to addr announcing source in a PROXY protocol
+// header, it returns the connection and whether msg was echoed back on it
+func dialFrom(t *testing.T, addr string, source *net.TCPAddr, msg string) (net.Conn, bool) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var header bytes.Buffer
+	if err := writeProxyHeader(&header, ProxyProtocolV1, source, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1080}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(header.Bytes(), msg...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return conn, false
+		}
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+	return conn, true
+}
+
+func TestMaxConnectionsPerSource(t *testing.T) {
+	srv := startTestServer(t)
+	logger := &recordingLogger{}
+	config := testConfig(srv, startEchoServer(t))
+	config.AcceptProxyProtocol = true
+	config.MaxConnectionsPerSource = 2
+	config.Logger = logger
+	config.Stats = &Stats{}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+
+	addr := srv.nextForward()
+	abusive := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, ok := dialFrom(t, addr, abusive, "within the limit")
+		if !ok {
+			t.Fatalf("connection %d within the limit was rejected", i+1)
+		}
+		open = append(open, conn)
+	}
+	if _, ok := dialFrom(t, addr, abusive, "over the limit"); ok {
+		t.Fatal("connection over the limit was served")
+	}
+	entry := logger.wait(t, "connection limit per source reached, rejecting connection", 1)[0]
+	if entry.attrs["source"] != "203.0.113.7" {
+		t.Fatalf("rejection logged for source %q, want 203.0.113.7", entry.attrs["source"])
+	}
+	if got := config.Stats.Snapshot().RejectedConnections; got != 1 {
+		t.Fatalf("%d rejected connections counted, want 1", got)
+	}
+
+	// other sources are not limited by it
+	if _, ok := dialFrom(t, addr, &net.TCPAddr{IP: net.ParseIP("203.0.113.8"), Port: 40000}, "other source"); !ok {
+		t.Fatal("connection from another source was rejected")
+	}
+
+	// a slot frees up once a connection is done
+	_ = open[0].Close()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, ok := dialFrom(t, addr, abusive, "freed slot"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("source still rejected after one of its connections closed")
+		}
+	}
+}
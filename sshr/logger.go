@@ -0,0 +1,43 @@
+package sshr
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger is the logger used by SSHR. args are key-value pairs or slog.Attr
+// values as accepted by slog, so a *slog.Logger can be used directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger discards all logs, it is used when Config.Logger is nil
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// levelEnabler is implemented by loggers that can tell whether a level is
+// logged, like *slog.Logger
+type levelEnabler interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+}
+
+// debugEnabled reports whether Debug logs are kept, so the per connection
+// debug lines can skip building their attributes. Loggers that cannot tell
+// are assumed to keep them.
+func (s *SSHR) debugEnabled() bool {
+	switch l := s.config.Logger.(type) {
+	case nopLogger:
+		return false
+	case levelEnabler:
+		return l.Enabled(context.Background(), slog.LevelDebug)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,135 @@
+package sshr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runWithLogger forwards a connection through a tunnel logging to a text
+// slog handler at level and returns the tunnel and its log output
+func runWithLogger(t *testing.T, level slog.Level) (*SSHR, *syncBuffer) {
+	t.Helper()
+	var logs syncBuffer
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level}))
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	echo(t, srv.nextForward(), "hello")
+	// the close is logged once both directions are done
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Snapshot().ActiveConnections > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, &logs
+}
+
+func TestRoutineLogsSuppressedByDefault(t *testing.T) {
+	s, logs := runWithLogger(t, slog.LevelInfo)
+	for _, routine := range []string{"forwarding connection", "closed connection"} {
+		if strings.Contains(logs.String(), routine) {
+			t.Errorf("%q logged at the default level:\n%s", routine, logs)
+		}
+	}
+	s.logClose("1", "proxy -> tunnelx -> punch-hole", CloseReasonReadError, errors.New("broken"))
+	if !strings.Contains(logs.String(), "copy data error") {
+		t.Errorf("copy error not logged at the default level:\n%s", logs)
+	}
+}
+
+func TestRoutineLogsVerbose(t *testing.T) {
+	_, logs := runWithLogger(t, slog.LevelDebug)
+	for _, routine := range []string{"forwarding connection", "closed connection"} {
+		if !strings.Contains(logs.String(), routine) {
+			t.Errorf("%q not logged at debug level:\n%s", routine, logs)
+		}
+	}
+}
+
+// runConnection forwards a connection through a tunnel logging to logger
+// and stops the tunnel
+func runConnection(t *testing.T, logger Logger) {
+	t.Helper()
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.Logger = logger
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	echo(t, srv.nextForward(), "hello")
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after cancel", err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	runConnection(t, nil)
+}
+
+func TestLoggerInterface(t *testing.T) {
+	// a logger other than slog gets the logs
+	logger := &recordingLogger{}
+	runConnection(t, logger)
+	if len(logger.find("forwarding connection")) != 1 {
+		t.Fatal("forwarded connection not logged")
+	}
+}
+
+func TestNilSlogLogger(t *testing.T) {
+	var logger *slog.Logger
+	runConnection(t, logger)
+
+	// a failed local dial is logged too
+	srv := startTestServer(t)
+	config := testConfig(srv, "127.0.0.1:1")
+	config.Logger = logger
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	if got := readAll(t, srv.nextForward()); got != "" {
+		t.Fatalf("read %q from an unreachable local target", got)
+	}
+}
@@ -0,0 +1,225 @@
+package sshr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocol selects the PROXY protocol header written to the local
+// target so it can see the original client address
+type ProxyProtocol int
+
+const (
+	ProxyProtocolNone ProxyProtocol = iota
+	ProxyProtocolV1
+	ProxyProtocolV2
+)
+
+// proxyProtocolV2Signature is the fixed prefix of a PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// writeProxyHeader writes a PROXY protocol header for a connection from src to dst
+func writeProxyHeader(w io.Writer, version ProxyProtocol, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolNone:
+		return nil
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unknown proxy protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns the tcp addresses of src and dst, mapping both to IPv6
+// when their families differ. ok is false when either is not a tcp address.
+func proxyAddrs(src, dst net.Addr) (srcAddr, dstAddr *net.TCPAddr, v4, ok bool) {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if !srcOk || !dstOk || srcAddr == nil || dstAddr == nil {
+		return nil, nil, false, false
+	}
+	v4 = srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	return srcAddr, dstAddr, v4, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcAddr, dstAddr, v4, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family, srcIP, dstIP := "TCP6", ipv6String(srcAddr.IP), ipv6String(dstAddr.IP)
+	if v4 {
+		family, srcIP, dstIP = "TCP4", srcAddr.IP.To4().String(), dstAddr.IP.To4().String()
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+}
+
+// ipv6String formats ip in IPv6 notation, IPv4 addresses as IPv4-mapped
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+
+	srcAddr, dstAddr, v4, ok := proxyAddrs(src, dst)
+	if !ok {
+		// LOCAL command with an unspecified family and no address block
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	// version 2, PROXY command
+	buf.WriteByte(0x21)
+	var addrs []byte
+	if v4 {
+		buf.WriteByte(0x11) // TCP over IPv4
+		addrs = append(addrs, srcAddr.IP.To4()...)
+		addrs = append(addrs, dstAddr.IP.To4()...)
+	} else {
+		buf.WriteByte(0x21) // TCP over IPv6
+		addrs = append(addrs, srcAddr.IP.To16()...)
+		addrs = append(addrs, dstAddr.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcAddr.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstAddr.Port))
+
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+// proxyHeaderMaxV1 is the longest PROXY protocol v1 header, CRLF included
+const proxyHeaderMaxV1 = 107
+
+// proxiedConn is a connection whose remote address was read from a PROXY
+// protocol header, the bytes following the header are read from r
+type proxiedConn struct {
+	net.Conn
+	r      io.Reader
+	source net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.source }
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// acceptProxyHeader reads the PROXY protocol header the punch-hole server
+// sends before the client data. The returned connection reports the client
+// address as its remote address, or conn's when the header carries none.
+func (s *SSHR) acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	// the ssh channel does not support deadlines
+	timer := time.AfterFunc(routePeekTimeout, func() {
+		_ = conn.Close()
+	})
+	defer timer.Stop()
+
+	br := bufio.NewReaderSize(conn, proxyHeaderMaxV1)
+	source, err := readProxyHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("error reading proxy protocol header: %v", err)
+	}
+	if source == nil {
+		source = conn.RemoteAddr()
+	}
+	s.config.Logger.Debug("accepted proxied connection",
+		slog.String("source_addr", source.String()),
+		slog.String("peer_addr", conn.RemoteAddr().String()),
+	)
+	return &proxiedConn{Conn: conn, r: br, source: source}, nil
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from br and
+// returns its source address, nil for LOCAL or UNKNOWN headers
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	prefix, err := br.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(prefix, proxyProtocolV2Signature):
+		return readProxyHeaderV2(br)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyHeaderV1(br)
+	default:
+		return nil, errors.New("missing proxy protocol header")
+	}
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 header: %v", err)
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("invalid v2 header: %v", err)
+	}
+	versionCommand, family := header[12], header[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, addrs); err != nil {
+		return nil, fmt.Errorf("invalid v2 address block: %v", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", versionCommand>>4)
+	}
+	// LOCAL connections, e.g. health checks, carry no client address
+	if versionCommand&0x0F == 0 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11:
+		if len(addrs) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case 0x21:
+		if len(addrs) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,158 @@
+package sshr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startRecordingServer runs a local target sending everything a connection
+// wrote, once it half-closes, on the returned channel
+func startRecordingServer(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				data, _ := io.ReadAll(conn)
+				received <- data
+			}()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+// sendAndClose writes msg on a new connection to addr and half-closes it,
+// it returns the client address of the connection
+func sendAndClose(t *testing.T, addr, msg string) *net.TCPAddr {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	return conn.LocalAddr().(*net.TCPAddr)
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	for _, version := range []ProxyProtocol{ProxyProtocolV1, ProxyProtocolV2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			srv := startTestServer(t)
+			target, received := startRecordingServer(t)
+			config := testConfig(srv, target)
+			config.ProxyProtocol = version
+			s, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = s.Run(ctx)
+			}()
+
+			client := sendAndClose(t, srv.nextForward(), "hello")
+			var data []byte
+			select {
+			case data = <-received:
+			case <-time.After(10 * time.Second):
+				t.Fatal("local target received nothing")
+			}
+			br := bufio.NewReader(bytes.NewReader(data))
+			source, err := readProxyHeader(br)
+			if err != nil {
+				t.Fatalf("no proxy header before the data %q: %v", data, err)
+			}
+			if got := source.(*net.TCPAddr); !got.IP.Equal(client.IP) || got.Port != client.Port {
+				t.Fatalf("header carries source %s, want the client at %s", got, client)
+			}
+			if rest, _ := io.ReadAll(br); string(rest) != "hello" {
+				t.Fatalf("data after the header is %q, want hello", rest)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1080}
+	for _, src := range []*net.TCPAddr{
+		{IP: net.ParseIP("203.0.113.7"), Port: 40000},
+		{IP: net.ParseIP("2001:db8::7"), Port: 40001},
+	} {
+		for _, version := range []ProxyProtocol{ProxyProtocolV1, ProxyProtocolV2} {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("v%d header for %s: %v", version, src, err)
+			}
+			if addr := got.(*net.TCPAddr); !addr.IP.Equal(src.IP) || addr.Port != src.Port {
+				t.Errorf("v%d header for %s read back as %s", version, src, addr)
+			}
+		}
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	srv := startTestServer(t)
+	target, received := startRecordingServer(t)
+	logger := &recordingLogger{}
+	config := testConfig(srv, target)
+	config.AcceptProxyProtocol = true
+	config.Logger = logger
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	var header bytes.Buffer
+	if err := writeProxyHeader(&header, ProxyProtocolV1, client, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1080}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndClose(t, srv.nextForward(), header.String()+"hello")
+	select {
+	case data := <-received:
+		if string(data) != "hello" {
+			t.Fatalf("local target received %q, want the data without the header", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("local target received nothing")
+	}
+	entry := logger.wait(t, "accepted proxied connection", 1)[0]
+	if got := entry.attrs["source_addr"]; got != client.String() {
+		t.Fatalf("logged source %q, want the client at %s", got, client)
+	}
+}
@@ -0,0 +1,125 @@
+package sshr
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// routePeekTimeout bounds the wait for the first bytes of a routed connection
+	routePeekTimeout = 10 * time.Second
+	// routePeekSize is the most that is buffered to find the route name
+	routePeekSize = 16 * 1024
+
+	recordTypeHandshake = 0x16
+)
+
+// route selects the target for conn from the TLS SNI or HTTP Host of the
+// first bytes read from r. The returned reader replays the peeked bytes.
+// It returns false when the client sent nothing within routePeekTimeout.
+func (s *SSHR) route(conn net.Conn, r io.Reader) (string, io.Reader, bool) {
+	// the ssh channel does not support deadlines
+	timer := time.AfterFunc(routePeekTimeout, func() {
+		_ = conn.Close()
+	})
+
+	br := bufio.NewReaderSize(r, routePeekSize)
+	name := peekRouteName(br)
+	if !timer.Stop() {
+		return "", nil, false
+	}
+	target, ok := s.config.Routes[name]
+	if !ok {
+		target = s.localTarget.Load().(string)
+	}
+	s.config.Logger.Debug("routing connection",
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+		slog.String("name", name),
+		slog.String("local_target", target),
+	)
+	return target, br, true
+}
+
+// peekRouteName returns the lowercased TLS SNI or HTTP Host without port,
+// or an empty string when neither is found
+func peekRouteName(br *bufio.Reader) string {
+	first, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+	var name string
+	if first[0] == recordTypeHandshake {
+		name = peekServerName(br)
+	} else {
+		name = peekHost(br)
+	}
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	return strings.ToLower(name)
+}
+
+// peekServerName reads the SNI of a TLS ClientHello contained in the first record
+func peekServerName(br *bufio.Reader) string {
+	header, err := br.Peek(5)
+	if err != nil {
+		return ""
+	}
+	record, err := br.Peek(5 + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+		return ""
+	}
+
+	var serverName string
+	errStop := errors.New("client hello read")
+	server := tls.Server(readOnlyConn{Reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errStop
+		},
+	})
+	_ = server.Handshake()
+	return serverName
+}
+
+// peekHost reads the Host header of an HTTP request
+func peekHost(br *bufio.Reader) string {
+	for {
+		buffered, _ := br.Peek(br.Buffered())
+		if bytes.Contains(buffered, []byte("\r\n\r\n")) {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffered)))
+			if err != nil {
+				return ""
+			}
+			return req.Host
+		}
+		if len(buffered) == routePeekSize {
+			return ""
+		}
+		if _, err := br.Peek(len(buffered) + 1); err != nil {
+			return ""
+		}
+	}
+}
+
+// readOnlyConn feeds bytes to a tls handshake, writes are discarded
+type readOnlyConn struct {
+	io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)     { return c.Reader.Read(p) }
+func (readOnlyConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (readOnlyConn) Close() error                     { return nil }
+func (readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,127 @@
+package sshr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record a client sends for serverName
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer func() {
+		_ = server.Close()
+	}()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		_ = client.Close()
+	}()
+	br := bufio.NewReader(server)
+	header, err := br.Peek(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	if _, err := io.ReadFull(br, record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// sendAndRead writes msg on a new connection to addr and returns the reply
+func sendAndRead(t *testing.T, addr string, msg []byte) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPeekRouteName(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"sni", clientHello(t, "API.example.com"), "api.example.com"},
+		{"host", []byte("GET / HTTP/1.1\r\nHost: Web.example.com:8080\r\n\r\n"), "web.example.com"},
+		{"no host", []byte("GET / HTTP/1.0\r\n\r\n"), ""},
+		{"not http", []byte("SSH-2.0-client\r\n\r\n"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(bytes.NewReader(tt.input), routePeekSize)
+			if got := peekRouteName(br); got != tt.want {
+				t.Fatalf("peekRouteName = %q, want %q", got, tt.want)
+			}
+			// the peeked bytes are replayed to the target
+			replayed, _ := io.ReadAll(br)
+			if !bytes.Equal(replayed, tt.input) {
+				t.Fatalf("replayed %q, want %q", replayed, tt.input)
+			}
+		})
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	srv := startTestServer(t)
+	config := testConfig(srv, startNamedServer(t, "default"))
+	config.Routes = map[string]string{
+		"api.example.com": startNamedServer(t, "api"),
+		"web.example.com": startNamedServer(t, "web"),
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	addr := srv.nextForward()
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"sni", clientHello(t, "api.example.com"), "api"},
+		{"host", []byte("GET / HTTP/1.1\r\nHost: web.example.com\r\n\r\n"), "web"},
+		{"unknown sni", clientHello(t, "other.example.com"), "default"},
+		{"unknown host", []byte("GET / HTTP/1.1\r\nHost: other.example.com\r\n\r\n"), "default"},
+		{"no name", []byte(strings.Repeat("x", 64) + "\r\n\r\n"), "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendAndRead(t, addr, tt.input); got != tt.want {
+				t.Fatalf("routed to %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after cancel", err)
+	}
+}
@@ -0,0 +1,343 @@
+package sshr
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process punch-hole server: it accepts any password
+// and serves tcpip-forward requests on loopback listeners
+type testServer struct {
+	t        testing.TB
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	// forwards receives the address every remote listener is reachable on
+	forwards chan string
+
+	mu    sync.Mutex
+	conns []ssh.Conn
+	// rejectForwards is the number of tcpip-forward requests still to reject
+	rejectForwards int
+}
+
+func startTestServer(t testing.TB) *testServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{t: t, listener: listener, config: config, forwards: make(chan string, 16)}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = listener.Close()
+		srv.closeConns()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				srv.serve(conn)
+			}()
+		}
+	}()
+	return srv
+}
+
+func (srv *testServer) addr() string {
+	return srv.listener.Addr().String()
+}
+
+// closeConns drops every ssh connection, as a server restart would
+func (srv *testServer) closeConns() {
+	srv.mu.Lock()
+	conns := srv.conns
+	srv.conns = nil
+	srv.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// nextForward waits for the next remote listener
+func (srv *testServer) nextForward() string {
+	srv.t.Helper()
+	select {
+	case addr := <-srv.forwards:
+		return addr
+	case <-time.After(10 * time.Second):
+		srv.t.Fatal("no remote listener within 10s")
+		return ""
+	}
+}
+
+func (srv *testServer) serve(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, srv.config)
+	if err != nil {
+		_ = netConn.Close()
+		return
+	}
+	srv.mu.Lock()
+	srv.conns = append(srv.conns, conn)
+	srv.mu.Unlock()
+
+	go ssh.DiscardRequests(nil)
+	go func() {
+		for ch := range chans {
+			_ = ch.Reject(ssh.Prohibited, "no channels")
+		}
+	}()
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var payload struct {
+				Addr string
+				Port uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			srv.mu.Lock()
+			reject := srv.rejectForwards > 0
+			if reject {
+				srv.rejectForwards--
+			}
+			srv.mu.Unlock()
+			if reject {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			listeners = append(listeners, l)
+			port := uint32(l.Addr().(*net.TCPAddr).Port)
+			bindPort := payload.Port
+			var reply []byte
+			if bindPort == 0 {
+				bindPort = port
+				reply = ssh.Marshal(struct{ Port uint32 }{port})
+			}
+			_ = req.Reply(true, reply)
+			go srv.acceptForward(conn, l, payload.Addr, bindPort)
+			srv.forwards <- l.Addr().String()
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// acceptForward opens a forwarded-tcpip channel for every connection of l
+func (srv *testServer) acceptForward(conn ssh.Conn, l net.Listener, bindAddr string, bindPort uint32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() {
+				_ = c.Close()
+			}()
+			origin := c.RemoteAddr().(*net.TCPAddr)
+			payload := ssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{bindAddr, bindPort, origin.IP.String(), uint32(origin.Port)})
+			// the client registers the forward only once it has read the
+			// reply, a connection right after it may beat the registration
+			var ch ssh.Channel
+			var reqs <-chan *ssh.Request
+			var err error
+			for range 100 {
+				ch, reqs, err = conn.OpenChannel("forwarded-tcpip", payload)
+				var open *ssh.OpenChannelError
+				if !errors.As(err, &open) || open.Reason != ssh.Prohibited {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			defer func() {
+				_ = ch.Close()
+			}()
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(ch, c)
+				_ = ch.CloseWrite()
+				close(done)
+			}()
+			_, _ = io.Copy(c, ch)
+			_ = c.(*net.TCPConn).CloseWrite()
+			<-done
+		}()
+	}
+}
+
+// startEchoServer runs a local target echoing what it reads
+func startEchoServer(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testConfig is a tunnel through srv to target on a kernel assigned port
+func testConfig(srv *testServer, target string) Config {
+	return Config{
+		SSHServer:        srv.addr(),
+		LocalTarget:      target,
+		RemoteListenAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(0)),
+		SSHClientConfig: &ssh.ClientConfig{
+			User:    "agent",
+			Auth:    []ssh.AuthMethod{ssh.Password("key")},
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// echo writes msg on a new connection to addr and checks it comes back
+func echo(t *testing.T, addr, msg string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+// logEntry is a log line kept by recordingLogger
+type logEntry struct {
+	level string
+	msg   string
+	attrs map[string]string
+}
+
+// recordingLogger keeps every log line, passed as slog.Attr values
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level, msg string, args []any) {
+	entry := logEntry{level: level, msg: msg, attrs: make(map[string]string)}
+	for _, arg := range args {
+		if attr, ok := arg.(slog.Attr); ok {
+			entry.attrs[attr.Key] = attr.Value.String()
+		}
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.record("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.record("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record("error", msg, args) }
+
+// find returns the log lines with msg
+func (l *recordingLogger) find(msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []logEntry
+	for _, entry := range l.entries {
+		if entry.msg == msg {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// wait waits for count log lines with msg
+func (l *recordingLogger) wait(t testing.TB, msg string, count int) []logEntry {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if found := l.find(msg); len(found) >= count {
+			return found
+		}
+	}
+	t.Fatalf("fewer than %d %q logs within 10s", count, msg)
+	return nil
+}
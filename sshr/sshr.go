@@ -2,16 +2,71 @@ package sshr
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
 )
 
+// healthCheckInterval is the delay between local target health checks
+const healthCheckInterval = 500 * time.Millisecond
+
+// listenRetryBackoff is the delay before the first listen retry, it grows linearly
+const listenRetryBackoff = 500 * time.Millisecond
+
+// defaultAcceptBacklog is the AcceptBacklog used when none is configured
+const defaultAcceptBacklog = 128
+
+// localDialRetryBackoff is the delay before the first local target dial
+// retry, it grows linearly
+const localDialRetryBackoff = 100 * time.Millisecond
+
+// ErrListenRetriesExhausted is returned by Run when the server rejected
+// every remote listen address within ListenRetries
+var ErrListenRetriesExhausted = errors.New("remote listen retries exhausted")
+
+// ErrConnectionClosed is returned by Run when the SSH connection to the
+// server was closed, as opposed to failing to listen or accept
+var ErrConnectionClosed = errors.New("ssh connection closed")
+
 type SSHR struct {
-	config Config
+	config      Config
+	localTarget atomic.Value
+
+	tracer trace.Tracer
+
+	// connections holds the active connections by id
+	connections   sync.Map
+	connectionSeq atomic.Uint64
+
+	// sources counts the active connections per source for MaxConnectionsPerSource
+	sources sourceLimiter
+
+	// stopAccepting is closed by StopAccepting
+	stopAccepting chan struct{}
+	stopOnce      sync.Once
+
+	// pending holds a slot per accepted connection not yet forwarded
+	pending chan struct{}
+
+	// drained is closed once Run's connections are closed
+	drained     chan struct{}
+	drainedOnce sync.Once
+
+	// wrapListener, when set, wraps the remote listener before Run accepts
+	// on it, so tests can inject accept errors
+	wrapListener func(net.Listener) net.Listener
 }
 
 // Config for Tun
@@ -21,95 +76,753 @@ type Config struct {
 	SSHServer        string
 	SuccessHook      func()
 
+	// SSHClientConfig authenticates to SSHServer. The host key is not
+	// verified when its HostKeyCallback is nil.
 	SSHClientConfig *ssh.ClientConfig
 
-	Logger *slog.Logger
+	// Dialer is used to connect to SSHServer. A net.Dialer honoring
+	// SSHClientConfig.Timeout is used when nil.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger receives the tunnel logs, they are discarded when nil
+	Logger Logger
+
+	// NextRemoteListenAddr is called when listening on the current remote
+	// address fails, to get a new address to retry with in the same session.
+	// Listening is not retried when nil.
+	NextRemoteListenAddr func() (string, error)
+	// ListenRetries is the maximum number of listen retries
+	ListenRetries int
+
+	// AcceptProxyProtocol, when set, reads the PROXY protocol v1 or v2
+	// header the punch-hole server sends before the client data, so logs,
+	// connection listings and ProxyProtocol carry the original client address
+	AcceptProxyProtocol bool
+
+	// TraceBytes, when set, logs a hex dump of the first TraceBytes bytes,
+	// at most 4096, of both directions of every connection at debug level
+	TraceBytes int
+
+	// MaxConnectionsPerSource, when set, limits the concurrent connections
+	// from a single source ip, further ones are closed. The source is the
+	// client address with AcceptProxyProtocol, the server's otherwise.
+	MaxConnectionsPerSource int
+
+	// LocalDialRetries is the number of times dialing the local target is
+	// retried, with a short backoff, before the connection is dropped
+	LocalDialRetries int
+
+	// AcceptBacklog is the number of accepted connections that may wait
+	// for the local target at once, the accept loop waits when it is
+	// reached. defaultAcceptBacklog is used when zero.
+	AcceptBacklog int
+
+	// ProxyProtocol, when set, writes a PROXY protocol header with the
+	// original client address to the local target before any data
+	ProxyProtocol ProxyProtocol
+
+	// Compression compresses the stream to the punch-hole server, which
+	// must use the same compression
+	Compression Compression
+
+	// Forwards are further remote listeners opened on the same SSH
+	// connection, each forwarding to its own local target. Routes and
+	// NextRemoteListenAddr only apply to RemoteListenAddr.
+	Forwards []Forward
+
+	// Routes maps a TLS SNI or HTTP Host name to the local target serving
+	// it, connections for other names go to LocalTarget. Routing reads the
+	// first bytes sent by the client, so it only suits client-first
+	// protocols.
+	Routes map[string]string
+
+	// HealthCheckTimeout, when set, delays SuccessHook until the local
+	// target accepts a connection, failing Run if it does not within the timeout
+	HealthCheckTimeout time.Duration
+
+	// OperationDeadline, when set, closes a forwarded connection once a
+	// single read or write on either end takes longer than the duration.
+	// The deadline is renewed before every operation.
+	OperationDeadline time.Duration
+
+	// ConnectionDeadline, when set, closes forwarded connections that are
+	// still open after the duration, however active they are
+	ConnectionDeadline time.Duration
+
+	// DrainTimeout is how long in-flight connections may take to finish
+	// once Run's context is done. They are closed immediately when zero.
+	DrainTimeout time.Duration
+
+	// DrainConnectionTimeout, when set, closes a connection once it has been
+	// draining for the duration, so a stuck connection does not hold the
+	// drain up to DrainTimeout
+	DrainConnectionTimeout time.Duration
+
+	// DrainInBackground makes Run return as soon as its context is done,
+	// the in-flight connections then drain on the old SSH connection so a
+	// new tunnel can be established meanwhile. Drained reports when they
+	// are done.
+	DrainInBackground bool
+
+	// TracerProvider creates the spans of the connect sequence and of every
+	// forwarded connection. The global provider is used when nil.
+	TracerProvider trace.TracerProvider
+
+	// Stats receives the connection counters, so they can be shared across
+	// reconnects. A new Stats is used when nil.
+	Stats *Stats
+}
+
+// Forward is a remote listener and the local target its connections go to
+type Forward struct {
+	RemoteListenAddr string
+	LocalTarget      string
 }
 
 // New tun.
 func New(config Config) (*SSHR, error) {
-	config.SSHClientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	if config.SSHClientConfig.HostKeyCallback == nil {
+		config.SSHClientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	if config.Stats == nil {
+		config.Stats = &Stats{}
+	}
+	// a nil *slog.Logger makes a non nil Logger that panics on first use
+	if l, ok := config.Logger.(*slog.Logger); config.Logger == nil || (ok && l == nil) {
+		config.Logger = nopLogger{}
+	}
+	if err := config.Compression.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Dialer == nil {
+		config.Dialer = (&net.Dialer{Timeout: config.SSHClientConfig.Timeout}).DialContext
+	}
 
-	return &SSHR{config: config}, nil
+	if config.TracerProvider == nil {
+		config.TracerProvider = otel.GetTracerProvider()
+	}
+
+	s := &SSHR{
+		config:        config,
+		tracer:        config.TracerProvider.Tracer("github.com/projectdiscovery/tunnelx/sshr"),
+		stopAccepting: make(chan struct{}),
+		drained:       make(chan struct{}),
+	}
+	backlog := config.AcceptBacklog
+	if backlog <= 0 {
+		backlog = defaultAcceptBacklog
+	}
+	s.pending = make(chan struct{}, backlog)
+	s.localTarget.Store(config.LocalTarget)
+	return s, nil
 }
 
+// StopAccepting closes the remote listener so no new connections are
+// forwarded. In-flight connections and the SSH connection stay up until
+// Run's context is done, which then drains them as usual.
+func (s *SSHR) StopAccepting() {
+	s.stopOnce.Do(func() {
+		close(s.stopAccepting)
+	})
+}
+
+// Drained returns a channel closed once the connections forwarded by Run
+// are all closed, when Run returns unless DrainInBackground is set
+func (s *SSHR) Drained() <-chan struct{} {
+	return s.drained
+}
+
+// SetLocalTarget changes the local address new connections are forwarded to
+func (s *SSHR) SetLocalTarget(addr string) {
+	s.localTarget.Store(addr)
+}
+
+// Stats returns the connection counters of the tunnel
+func (s *SSHR) Stats() *Stats {
+	return s.config.Stats
+}
+
+// Run establishes the tunnel and forwards connections until ctx is done or
+// the tunnel fails. Once ctx is done no new connections are accepted and
+// in-flight ones are given DrainTimeout to finish before being closed.
 func (s *SSHR) Run(ctx context.Context) error {
-	conn, err := ssh.Dial("tcp", s.config.SSHServer, s.config.SSHClientConfig)
+	// the connect span covers dialing, listening and the success hook
+	_, span := s.tracer.Start(ctx, "tunnel.connect", trace.WithAttributes(
+		attribute.String("ssh_server", s.config.SSHServer),
+	))
+	failed := func(err error) error {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return err
+	}
+
+	// set once the connections drain in the background, which then closes
+	// the SSH connection itself
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			s.drainedOnce.Do(func() {
+				close(s.drained)
+			})
+		}
+	}()
+
+	conn, err := s.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("error dialing [%s]: %v", s.config.SSHServer, err)
+		return failed(fmt.Errorf("error dialing [%s]: %v", s.config.SSHServer, err))
 	}
+	span.AddEvent("dialed")
 	defer func() {
-		_ = conn.Close()
+		if !handedOff {
+			_ = conn.Close()
+		}
+	}()
+	connClosed := make(chan struct{})
+	var connErr error
+	go func() {
+		connErr = conn.Wait()
+		close(connClosed)
 	}()
 
-	listener, err := conn.Listen("tcp", s.config.RemoteListenAddr)
+	listener, err := s.listen(ctx, conn)
 	if err != nil {
-		return err
+		return failed(err)
 	}
+	if s.wrapListener != nil {
+		listener = s.wrapListener(listener)
+	}
+	span.AddEvent("listening", trace.WithAttributes(attribute.String("remote_addr", listener.Addr().String())))
+	listeners := []net.Listener{listener}
 	defer func() {
-		_ = listener.Close()
+		for _, l := range listeners {
+			_ = l.Close()
+		}
 	}()
+	for _, forward := range s.config.Forwards {
+		l, err := conn.Listen("tcp", forward.RemoteListenAddr)
+		if err != nil {
+			return failed(fmt.Errorf("error listening on [%s]: %v", forward.RemoteListenAddr, err))
+		}
+		span.AddEvent("listening", trace.WithAttributes(attribute.String("remote_addr", l.Addr().String())))
+		listeners = append(listeners, l)
+	}
+	closeListeners := func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}
+	// unblock Accept once ctx is done or StopAccepting is called
+	stopAccept := context.AfterFunc(ctx, closeListeners)
+	defer stopAccept()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stopAccepting:
+			closeListeners()
+		case <-done:
+		}
+	}()
+
+	// forwarded connections outlive ctx while draining, connCtx closes them
+	connCtx, closeConns := context.WithCancel(context.WithoutCancel(ctx))
+	defer func() {
+		if !handedOff {
+			closeConns()
+		}
+	}()
+	var active sync.WaitGroup
+	for i, forward := range s.config.Forwards {
+		// the loop counts as active so no connection is added to a drained group
+		active.Add(1)
+		go func() {
+			defer active.Done()
+			s.acceptForward(connCtx, listeners[i+1], forward.LocalTarget, &active)
+		}()
+	}
+	// finish drains the in-flight connections once ctx is done, in the
+	// background with DrainInBackground
+	finish := func() {
+		if !s.config.DrainInBackground {
+			s.drain(&active)
+			return
+		}
+		handedOff = true
+		go func() {
+			s.drain(&active)
+			closeConns()
+			_ = conn.Close()
+			s.drainedOnce.Do(func() {
+				close(s.drained)
+			})
+		}()
+	}
 
+	if s.config.HealthCheckTimeout > 0 {
+		if err := s.waitLocalTarget(ctx); err != nil {
+			return failed(err)
+		}
+	}
 	if s.config.SuccessHook != nil {
 		s.config.SuccessHook()
 	}
+	span.End()
 
+	var guard acceptGuard
 	for {
-		select {
-		case <-ctx.Done():
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			// a connection accepted as ctx was done is not forwarded
+			if err == nil {
+				_ = conn.Close()
+			}
+			finish()
 			return nil
-		default:
 		}
-		conn, err := listener.Accept()
 		if err != nil {
-			return fmt.Errorf("error accepting connection: %v", err)
+			if s.acceptingStopped() {
+				// keep forwarding in-flight connections until ctx is done
+				select {
+				case <-ctx.Done():
+					finish()
+				case <-connClosed:
+				}
+				return nil
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				// the listener is closed as the connection goes down, give
+				// Wait a moment to report it
+				select {
+				case <-connClosed:
+					if connErr != nil {
+						return fmt.Errorf("%w: %v", ErrConnectionClosed, connErr)
+					}
+					return ErrConnectionClosed
+				case <-time.After(time.Second):
+				}
+				return fmt.Errorf("error accepting connection: %v", err)
+			}
+			s.config.Stats.acceptErrors.Add(1)
+			s.config.Logger.Error("error accepting connection",
+				slog.String("error", err.Error()),
+			)
+			if delay := guard.failure(time.Now()); delay > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+			}
+			continue
 		}
+		guard.success()
 
-		err = s.handleConn(conn)
+		err = s.handleConn(connCtx, conn, &active)
 		if err != nil {
 			s.config.Logger.Error("error handling connection",
 				slog.String("remote_addr", conn.RemoteAddr().String()),
 				slog.String("error", err.Error()),
 			)
+			_ = conn.Close()
 			continue
 		}
 	}
 }
 
-func (s *SSHR) handleConn(conn net.Conn) error {
-	s.config.Logger.Info("forwarding connection",
-		slog.String("remote_addr", conn.RemoteAddr().String()),
-		slog.String("local_target", s.config.LocalTarget),
-	)
-	proxyConn, err := net.Dial("tcp", s.config.LocalTarget)
+// acceptForward forwards the connections of listener, one of Forwards, to
+// target until listener is closed
+func (s *SSHR) acceptForward(ctx context.Context, listener net.Listener, target string, active *sync.WaitGroup) {
+	var guard acceptGuard
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.config.Stats.acceptErrors.Add(1)
+			if delay := guard.failure(time.Now()); delay > 0 {
+				time.Sleep(delay)
+			}
+			continue
+		}
+		guard.success()
+		active.Add(1)
+		go func() {
+			defer active.Done()
+			if err := s.handleForwardConn(ctx, conn, target, active); err != nil {
+				s.config.Logger.Error("error handling connection",
+					slog.String("remote_addr", conn.RemoteAddr().String()),
+					slog.String("local_target", target),
+					slog.String("error", err.Error()),
+				)
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// handleForwardConn forwards conn, accepted by one of Forwards, to target
+func (s *SSHR) handleForwardConn(ctx context.Context, conn net.Conn, target string, active *sync.WaitGroup) error {
+	if s.config.AcceptProxyProtocol {
+		proxied, err := s.acceptProxyHeader(conn)
+		if err != nil {
+			return err
+		}
+		conn = proxied
+	}
+	remoteReader, remoteWriter, err := compressStreams(s.config.Compression, conn)
+	if err != nil {
+		return err
+	}
+	release, ok := s.acquireSource(conn)
+	if !ok {
+		_ = conn.Close()
+		return nil
+	}
+	proxyConn, err := s.dialTarget(ctx, conn, target)
 	if err != nil {
+		release()
 		return err
 	}
+	s.startForward(ctx, conn, proxyConn, remoteReader, remoteWriter, active, release)
+	return nil
+}
 
-	go func() {
-		_, err := io.Copy(proxyConn, conn)
-		if err != nil && err != io.EOF {
-			s.config.Logger.Error("copy data error",
-				slog.String("direction", "punch-hole -> tunnelx -> proxy"),
-				slog.String("error", err.Error()),
-			)
+// waitLocalTarget waits up to HealthCheckTimeout for the local target to
+// accept a tcp connection
+func (s *SSHR) waitLocalTarget(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.HealthCheckTimeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	for {
+		target := s.localTarget.Load().(string)
+		conn, err := dialer.DialContext(ctx, "tcp", target)
+		if err == nil {
+			_ = conn.Close()
+			return nil
 		}
-		s.config.Logger.Info("closed connection",
-			slog.String("direction", "punch-hole -> tunnelx -> proxy"),
+		s.config.Logger.Debug("local target is not ready",
+			slog.String("local_target", target),
+			slog.String("error", err.Error()),
 		)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("local target [%s] not ready within %s: %v", target, s.config.HealthCheckTimeout, err)
+		case <-time.After(healthCheckInterval):
+		}
+	}
+}
+
+// acceptingStopped reports whether StopAccepting was called
+func (s *SSHR) acceptingStopped() bool {
+	select {
+	case <-s.stopAccepting:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits up to DrainTimeout for the active connections to finish
+func (s *SSHR) drain(active *sync.WaitGroup) {
+	if s.config.DrainTimeout <= 0 {
+		return
+	}
+	drained := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(drained)
 	}()
+	if s.config.DrainConnectionTimeout > 0 {
+		go s.closeDrainingConnections(drained)
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(s.config.DrainTimeout):
+		s.config.Logger.Warn("drain timeout exceeded, closing remaining connections",
+			slog.Int64("active_connections", s.config.Stats.activeConnections.Load()),
+		)
+	}
+}
+
+// dial connects to the SSH server, honoring ctx for the TCP connection and
+// SSHClientConfig.Timeout for both the TCP connection and the handshake
+func (s *SSHR) dial(ctx context.Context) (*ssh.Client, error) {
+	netConn, err := s.config.Dialer(ctx, "tcp", s.config.SSHServer)
+	if err != nil {
+		return nil, err
+	}
+	// bound the handshake so a server accepting tcp but never answering
+	// does not hang the dial
+	if timeout := s.config.SSHClientConfig.Timeout; timeout > 0 {
+		_ = netConn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, s.config.SSHServer, s.config.SSHClientConfig)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
+// listen requests the remote listener, retrying with a new remote address
+// and a growing backoff when the server rejects the current one, up to
+// ListenRetries times.
+func (s *SSHR) listen(ctx context.Context, conn *ssh.Client) (net.Listener, error) {
+	addr := s.config.RemoteListenAddr
+	listener, err := conn.Listen("tcp", addr)
+	if err == nil {
+		return listener, nil
+	}
+	if s.config.NextRemoteListenAddr == nil || s.config.ListenRetries <= 0 {
+		return nil, fmt.Errorf("error listening on [%s]: %v", addr, err)
+	}
+	for attempt := 1; attempt <= s.config.ListenRetries; attempt++ {
+		s.config.Logger.Warn("error listening on remote address, retrying",
+			slog.String("remote_addr", addr),
+			slog.String("error", err.Error()),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * listenRetryBackoff):
+		}
+		var nextErr error
+		addr, nextErr = s.config.NextRemoteListenAddr()
+		if nextErr != nil {
+			return nil, fmt.Errorf("error getting new remote listen address: %v", nextErr)
+		}
+		listener, err = conn.Listen("tcp", addr)
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: last address [%s]: %v", ErrListenRetriesExhausted, addr, err)
+}
+
+// handleConn forwards conn to the local target until either side closes or
+// ctx is done. active tracks the connection until both directions finish.
+// Reading the proxy header, routing and dialing the local target happen off
+// the accept loop, up to AcceptBacklog connections at once.
+func (s *SSHR) handleConn(ctx context.Context, conn net.Conn, active *sync.WaitGroup) error {
+	select {
+	case s.pending <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	active.Add(1)
 	go func() {
-		_, err := io.Copy(conn, proxyConn)
-		if err != nil && err != io.EOF {
-			s.config.Logger.Error("copy data error",
-				slog.String("direction", "proxy -> tunnelx -> punch-hole"),
+		defer active.Done()
+		err := s.forwardConn(ctx, conn, active)
+		<-s.pending
+		if err != nil {
+			s.config.Logger.Error("error handling connection",
+				slog.String("remote_addr", conn.RemoteAddr().String()),
 				slog.String("error", err.Error()),
 			)
+			_ = conn.Close()
 		}
-		s.config.Logger.Info("closed connection",
-			slog.String("direction", "proxy -> tunnelx -> punch-hole"),
-		)
 	}()
 	return nil
 }
+
+// forwardConn connects conn to its local target and starts forwarding,
+// it returns once the forward goroutines are started
+func (s *SSHR) forwardConn(ctx context.Context, conn net.Conn, active *sync.WaitGroup) error {
+	if s.config.AcceptProxyProtocol {
+		proxied, err := s.acceptProxyHeader(conn)
+		if err != nil {
+			return err
+		}
+		conn = proxied
+	}
+	remoteReader, remoteWriter, err := compressStreams(s.config.Compression, conn)
+	if err != nil {
+		return err
+	}
+	target, reader := s.localTarget.Load().(string), remoteReader
+	if len(s.config.Routes) > 0 {
+		var ok bool
+		if target, reader, ok = s.route(conn, remoteReader); !ok {
+			return nil
+		}
+	}
+	release, ok := s.acquireSource(conn)
+	if !ok {
+		_ = conn.Close()
+		return nil
+	}
+	proxyConn, err := s.dialTarget(ctx, conn, target)
+	if err != nil {
+		release()
+		return err
+	}
+	s.startForward(ctx, conn, proxyConn, reader, remoteWriter, active, release)
+	return nil
+}
+
+// dialTarget connects to target on behalf of conn, retrying up to
+// LocalDialRetries times
+func (s *SSHR) dialTarget(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	if s.debugEnabled() {
+		s.config.Logger.Debug("forwarding connection",
+			slog.String("remote_addr", conn.RemoteAddr().String()),
+			slog.String("local_target", target),
+		)
+	}
+	var dialer net.Dialer
+	proxyConn, err := dialer.DialContext(ctx, "tcp", target)
+	for attempt := 1; err != nil && attempt <= s.config.LocalDialRetries; attempt++ {
+		s.config.Logger.Debug("retrying local target dial",
+			slog.String("local_target", target),
+			slog.Int("attempt", attempt),
+			slog.String("error", err.Error()),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(attempt) * localDialRetryBackoff):
+		}
+		proxyConn, err = dialer.DialContext(ctx, "tcp", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := writeProxyHeader(proxyConn, s.config.ProxyProtocol, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+		_ = proxyConn.Close()
+		return nil, fmt.Errorf("error writing proxy protocol header: %v", err)
+	}
+	return proxyConn, nil
+}
+
+// startForward forwards conn and proxyConn in the background
+func (s *SSHR) startForward(ctx context.Context, conn, proxyConn net.Conn, remoteReader io.Reader, remoteWriter io.WriteCloser, active *sync.WaitGroup, release func()) {
+	active.Add(1)
+	stats := s.config.Stats
+	stats.totalConnections.Add(1)
+	stats.activeConnections.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	c := s.trackConnection(conn.RemoteAddr().String(), proxyConn.RemoteAddr().String(), cancel)
+	go func() {
+		defer active.Done()
+		defer release()
+		defer stats.activeConnections.Add(-1)
+		defer s.connections.Delete(c.id)
+		defer cancel()
+
+		ctx, span := s.tracer.Start(ctx, "tunnel.connection", trace.WithAttributes(
+			attribute.String("id", c.id),
+			attribute.String("remote_addr", c.remoteAddr),
+			attribute.String("local_target", c.localTarget),
+		))
+		// both directions log their own result
+		err := s.forward(ctx, c, conn, proxyConn, remoteReader, remoteWriter)
+		span.SetAttributes(
+			attribute.Int64("bytes_in", int64(c.bytesIn.Load())),
+			attribute.Int64("bytes_out", int64(c.bytesOut.Load())),
+			attribute.Int64("duration_ms", time.Since(c.started).Milliseconds()),
+		)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+}
+
+// forward copies data in both directions until both are done and returns
+// the first error. A failing direction tears the other one down, while a
+// clean EOF only half-closes the peer so the other direction can finish.
+// Both connections are closed on return.
+func (s *SSHR) forward(ctx context.Context, c *connection, conn, proxyConn net.Conn, remoteReader io.Reader, remoteWriter io.WriteCloser) error {
+	// a hard limit, unlike OperationDeadline it is not extended by traffic
+	if s.config.ConnectionDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, s.config.ConnectionDeadline, errConnectionDeadline)
+		defer cancel()
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	stop := context.AfterFunc(gctx, func() {
+		_ = conn.Close()
+		_ = proxyConn.Close()
+	})
+	defer func() {
+		stop()
+		_ = conn.Close()
+		_ = proxyConn.Close()
+	}()
+
+	var remoteDst, proxyDst io.Writer = remoteWriter, proxyConn
+	var remoteSrc, proxySrc io.Reader = remoteReader, proxyConn
+	if timeout := s.config.OperationDeadline; timeout > 0 {
+		remoteDst = &deadlineWriter{Writer: remoteWriter, deadline: operationDeadline{conn: conn, timeout: timeout}}
+		proxyDst = &deadlineWriter{Writer: proxyConn, deadline: operationDeadline{conn: proxyConn, timeout: timeout}}
+		remoteSrc = &deadlineReader{Reader: remoteReader, deadline: operationDeadline{conn: conn, timeout: timeout}}
+		proxySrc = &deadlineReader{Reader: proxyConn, deadline: operationDeadline{conn: proxyConn, timeout: timeout}}
+	}
+
+	stats := s.config.Stats
+	g.Go(func() error {
+		const direction = "punch-hole -> tunnelx -> proxy"
+		w, flushTrace := s.traceWriter(&countingWriter{Writer: proxyDst, n: &c.bytesIn, total: &stats.bytesIn}, c.id, direction)
+		_, reason, err := copyConn(gctx, w, remoteSrc)
+		flushTrace()
+		if reason == CloseReasonWriteError && isReset(err) {
+			reason = CloseReasonTargetReset
+		}
+		closeWrite(proxyConn)
+		s.logClose(c.id, direction, reason, err)
+		return err
+	})
+	g.Go(func() error {
+		const direction = "proxy -> tunnelx -> punch-hole"
+		w, flushTrace := s.traceWriter(&countingWriter{Writer: remoteDst, n: &c.bytesOut, total: &stats.bytesOut}, c.id, direction)
+		_, reason, err := copyConn(gctx, w, proxySrc)
+		flushTrace()
+		if reason == CloseReasonReadError && isReset(err) {
+			reason = CloseReasonTargetReset
+		}
+		_ = remoteWriter.Close()
+		closeWrite(conn)
+		s.logClose(c.id, direction, reason, err)
+		return err
+	})
+	return g.Wait()
+}
+
+// closeWrite half-closes c so the peer sees EOF while the other direction
+// keeps flowing, connections without half-close support are left as is
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+func (s *SSHR) logClose(id, direction string, reason CloseReason, err error) {
+	switch {
+	case reason == CloseReasonTargetReset:
+		s.config.Stats.targetResets.Add(1)
+		s.config.Logger.Warn("local target reset the connection",
+			slog.String("id", id),
+			slog.String("direction", direction),
+			slog.String("local_target", s.localTarget.Load().(string)),
+			slog.String("error", err.Error()),
+		)
+	case err != nil && reason != CloseReasonShutdown && reason != CloseReasonDeadline:
+		s.config.Logger.Error("copy data error",
+			slog.String("id", id),
+			slog.String("direction", direction),
+			slog.String("reason", string(reason)),
+			slog.String("error", err.Error()),
+		)
+	}
+	if s.debugEnabled() {
+		s.config.Logger.Debug("closed connection",
+			slog.String("id", id),
+			slog.String("direction", direction),
+			slog.String("reason", string(reason)),
+		)
+	}
+}
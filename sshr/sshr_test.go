@@ -0,0 +1,350 @@
+package sshr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startNamedServer runs a local target writing name to every connection
+func startNamedServer(t *testing.T, name string) string {
+	t.Helper()
+	return startNamedServerOn(t, "127.0.0.1:0", name)
+}
+
+// startNamedServerOn runs a local target writing name on addr
+func startNamedServerOn(t *testing.T, addr, name string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(name))
+			_ = conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readAll(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestForwards(t *testing.T) {
+	srv := startTestServer(t)
+	config := testConfig(srv, startNamedServer(t, "socks5"))
+	config.Forwards = []Forward{{RemoteListenAddr: "127.0.0.1:0", LocalTarget: startNamedServer(t, "http")}}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	primary, extra := srv.nextForward(), srv.nextForward()
+
+	for range 3 {
+		if got := readAll(t, primary); got != "socks5" {
+			t.Fatalf("primary listener reached %q, want socks5", got)
+		}
+		if got := readAll(t, extra); got != "http" {
+			t.Fatalf("extra listener reached %q, want http", got)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after cancel", err)
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	srv := startTestServer(t)
+	config := testConfig(srv, startNamedServer(t, "socks5"))
+	config.SSHClientConfig.HostKeyCallback = func(string, net.Addr, ssh.PublicKey) error {
+		return errors.New("unknown host key")
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err == nil || !strings.Contains(err.Error(), "unknown host key") {
+		t.Fatalf("Run returned %v, want the host key rejected", err)
+	}
+}
+
+func TestListenRetry(t *testing.T) {
+	srv := startTestServer(t)
+	srv.rejectForwards = 1
+	config := testConfig(srv, startEchoServer(t))
+	config.ListenRetries = 2
+	var requested int
+	config.NextRemoteListenAddr = func() (string, error) {
+		requested++
+		return "127.0.0.1:0", nil
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	echo(t, srv.nextForward(), "hello")
+	if requested != 1 {
+		t.Fatalf("requested %d new remote addresses, want 1", requested)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after cancel", err)
+	}
+}
+
+func TestListenRetriesExhausted(t *testing.T) {
+	srv := startTestServer(t)
+	srv.rejectForwards = 2
+	config := testConfig(srv, startEchoServer(t))
+	config.ListenRetries = 1
+	config.NextRemoteListenAddr = func() (string, error) {
+		return "127.0.0.1:0", nil
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); !errors.Is(err, ErrListenRetriesExhausted) {
+		t.Fatalf("Run returned %v, want ErrListenRetriesExhausted", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// the server accepts tcp connections and never completes the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+		}
+	}()
+
+	config := testConfig(&testServer{listener: listener}, startEchoServer(t))
+	config.SSHClientConfig.Timeout = 200 * time.Millisecond
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	err = s.Run(context.Background())
+	if err == nil {
+		t.Fatal("Run succeeded against a server never completing the handshake")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("dial gave up after %s with a %s timeout", elapsed, config.SSHClientConfig.Timeout)
+	}
+}
+
+func TestRunReportsConnectionClosed(t *testing.T) {
+	srv := startTestServer(t)
+	s, err := New(testConfig(srv, startEchoServer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(context.Background())
+	}()
+	echo(t, srv.nextForward(), "hello")
+
+	srv.closeConns()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Fatalf("Run returned %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run still running after the server closed the connection")
+	}
+}
+
+func TestHealthCheckWaitsForLocalTarget(t *testing.T) {
+	// reserve an address the local target listens on later
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := reserved.Addr().String()
+	_ = reserved.Close()
+
+	srv := startTestServer(t)
+	config := testConfig(srv, target)
+	config.HealthCheckTimeout = 10 * time.Second
+	registered := make(chan time.Time, 1)
+	config.SuccessHook = func() {
+		registered <- time.Now()
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	addr := srv.nextForward()
+
+	select {
+	case <-registered:
+		t.Fatal("SuccessHook called before the local target was up")
+	case <-time.After(2 * healthCheckInterval):
+	}
+	up := time.Now()
+	startNamedServerOn(t, target, "socks5")
+
+	select {
+	case at := <-registered:
+		if at.Before(up) {
+			t.Fatal("SuccessHook called before the local target was up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SuccessHook not called once the local target was up")
+	}
+	if got := readAll(t, addr); got != "socks5" {
+		t.Fatalf("tunnel reached %q, want the local target", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned %v after cancel", err)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := reserved.Addr().String()
+	_ = reserved.Close()
+
+	srv := startTestServer(t)
+	config := testConfig(srv, target)
+	config.HealthCheckTimeout = 200 * time.Millisecond
+	config.SuccessHook = func() {
+		t.Error("SuccessHook called without a local target")
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Run(ctx); err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("Run returned %v, want the local target not ready", err)
+	}
+}
+
+func TestLocalDialRetry(t *testing.T) {
+	for _, retries := range []int{0, 2} {
+		reserved, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := reserved.Addr().String()
+		_ = reserved.Close()
+
+		srv := startTestServer(t)
+		logger := &recordingLogger{}
+		config := testConfig(srv, target)
+		config.LocalDialRetries = retries
+		config.Logger = logger
+		s, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			_ = s.Run(ctx)
+		}()
+		conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		reply := func() string {
+			defer func() {
+				_ = conn.Close()
+			}()
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+
+		if retries == 0 {
+			if got := reply(); got != "" {
+				t.Fatalf("read %q without a local target", got)
+			}
+			if found := logger.find("retrying local target dial"); len(found) != 0 {
+				t.Fatalf("local dial retried %d times with LocalDialRetries 0", len(found))
+			}
+			cancel()
+			continue
+		}
+		// the local target comes up after the first dial failed
+		logger.wait(t, "retrying local target dial", 1)
+		startNamedServerOn(t, target, "socks5")
+		if got := reply(); got != "socks5" {
+			t.Fatalf("read %q, want the connection served once the local target is up", got)
+		}
+		cancel()
+	}
+}
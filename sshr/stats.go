@@ -0,0 +1,56 @@
+package sshr
+
+import "sync/atomic"
+
+// Stats holds the connection counters of a tunnel.
+// It is safe for concurrent use.
+type Stats struct {
+	activeConnections   atomic.Int64
+	totalConnections    atomic.Uint64
+	bytesIn             atomic.Uint64
+	bytesOut            atomic.Uint64
+	acceptErrors        atomic.Uint64
+	targetResets        atomic.Uint64
+	rejectedConnections atomic.Uint64
+}
+
+// StatsSnapshot is a point-in-time copy of Stats
+type StatsSnapshot struct {
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	// BytesIn is the number of bytes received from the remote side and written to the local target
+	BytesIn uint64 `json:"bytes_in"`
+	// BytesOut is the number of bytes read from the local target and sent to the remote side
+	BytesOut uint64 `json:"bytes_out"`
+	// AcceptErrors is the number of failed accepts on the remote listener
+	AcceptErrors uint64 `json:"accept_errors"`
+	// TargetResets is the number of connections reset by the local target
+	TargetResets uint64 `json:"target_resets"`
+	// RejectedConnections is the number of connections closed for exceeding the per source limit
+	RejectedConnections uint64 `json:"rejected_connections"`
+}
+
+// Snapshot returns the current value of the counters
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		ActiveConnections:   s.activeConnections.Load(),
+		TotalConnections:    s.totalConnections.Load(),
+		BytesIn:             s.bytesIn.Load(),
+		BytesOut:            s.bytesOut.Load(),
+		AcceptErrors:        s.acceptErrors.Load(),
+		TargetResets:        s.targetResets.Load(),
+		RejectedConnections: s.rejectedConnections.Load(),
+	}
+}
+
+// Reset sets the cumulative counters back to zero. ActiveConnections is a
+// gauge and is kept. Each counter is reset atomically, updates racing the
+// reset are counted either before or after it.
+func (s *Stats) Reset() {
+	s.totalConnections.Store(0)
+	s.bytesIn.Store(0)
+	s.bytesOut.Store(0)
+	s.acceptErrors.Store(0)
+	s.targetResets.Store(0)
+	s.rejectedConnections.Store(0)
+}
@@ -0,0 +1,145 @@
+package sshr
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsCountOpenConnections(t *testing.T) {
+	srv := startTestServer(t)
+	s, err := New(testConfig(srv, startEchoServer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+
+	conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := []byte("counted while open")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the echo is back, both directions were written, the connection is open
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := s.Stats().Snapshot()
+		if stats.BytesIn == uint64(len(msg)) && stats.BytesOut == uint64(len(msg)) {
+			if stats.ActiveConnections != 1 {
+				t.Fatalf("%d active connections, want the open one", stats.ActiveConnections)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counted %d bytes in and %d out on an open connection, want %d", stats.BytesIn, stats.BytesOut, len(msg))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	srv := startTestServer(t)
+	s, err := New(testConfig(srv, startEchoServer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+
+	conn, err := net.DialTimeout("tcp", srv.nextForward(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// the connection keeps incrementing the byte counters during the resets
+	stop := make(chan struct{})
+	streamed := make(chan error, 1)
+	go func() {
+		chunk := make([]byte, 1024)
+		for {
+			select {
+			case <-stop:
+				streamed <- nil
+				return
+			default:
+			}
+			if _, err := conn.Write(chunk); err != nil {
+				streamed <- err
+				return
+			}
+			if _, err := io.ReadFull(conn, chunk); err != nil {
+				streamed <- err
+				return
+			}
+		}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Snapshot().BytesIn < 64*1024; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not streaming")
+		}
+	}
+
+	before := s.Stats().Snapshot()
+	s.Stats().Reset()
+	after := s.Stats().Snapshot()
+	if after.TotalConnections != 0 || after.BytesIn >= before.BytesIn || after.BytesOut >= before.BytesOut {
+		t.Fatalf("counters %+v right after a reset from %+v", after, before)
+	}
+	if after.ActiveConnections != 1 {
+		t.Fatalf("%d active connections after a reset, want the streaming one kept", after.ActiveConnections)
+	}
+	close(stop)
+	if err := <-streamed; err != nil {
+		t.Fatal(err)
+	}
+
+	// once the connection is idle, its last counted writes settle and the
+	// reset brings every cumulative counter to zero
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.Stats().Reset()
+		if got := s.Stats().Snapshot(); got == (StatsSnapshot{ActiveConnections: 1}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counters %+v after a reset, want zero", s.Stats().Snapshot())
+		}
+	}
+	msg := []byte("counted from zero")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		got := s.Stats().Snapshot()
+		if got.BytesIn == uint64(len(msg)) && got.BytesOut == uint64(len(msg)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counted %d bytes in and %d out after the reset, want %d", got.BytesIn, got.BytesOut, len(msg))
+		}
+	}
+}
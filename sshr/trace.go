@@ -0,0 +1,61 @@
+package sshr
+
+import (
+	"encoding/hex"
+	"io"
+	"log/slog"
+)
+
+// maxTraceBytes caps TraceBytes so dumps never hold whole payloads
+const maxTraceBytes = 4096
+
+// byteTracer passes writes through and logs a hex dump of the first bytes
+type byteTracer struct {
+	io.Writer
+	s         *SSHR
+	id        string
+	direction string
+	limit     int
+	buf       []byte
+	logged    bool
+}
+
+// traceWriter wraps w to dump the first TraceBytes written to it, it returns
+// w and a no-op flush when tracing is off or debug logs are discarded
+func (s *SSHR) traceWriter(w io.Writer, id, direction string) (io.Writer, func()) {
+	if s.config.TraceBytes <= 0 || !s.debugEnabled() {
+		return w, func() {}
+	}
+	t := &byteTracer{
+		Writer:    w,
+		s:         s,
+		id:        id,
+		direction: direction,
+		limit:     min(s.config.TraceBytes, maxTraceBytes),
+	}
+	return t, t.flush
+}
+
+func (t *byteTracer) Write(p []byte) (int, error) {
+	if !t.logged {
+		t.buf = append(t.buf, p[:min(len(p), t.limit-len(t.buf))]...)
+		if len(t.buf) >= t.limit {
+			t.flush()
+		}
+	}
+	return t.Writer.Write(p)
+}
+
+// flush logs the bytes captured so far, once
+func (t *byteTracer) flush() {
+	if t.logged || len(t.buf) == 0 {
+		return
+	}
+	t.logged = true
+	t.s.config.Logger.Debug("traffic dump",
+		slog.String("id", t.id),
+		slog.String("direction", t.direction),
+		slog.Int("bytes", len(t.buf)),
+		slog.String("dump", hex.Dump(t.buf)),
+	)
+}
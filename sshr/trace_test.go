@@ -0,0 +1,82 @@
+package sshr
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// traceConnection echoes msg through a tunnel with traceBytes and logger and
+// waits for the connection to close
+func traceConnection(t *testing.T, traceBytes int, logger Logger, msg string) {
+	t.Helper()
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.TraceBytes = traceBytes
+	config.Logger = logger
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	echo(t, srv.nextForward(), msg)
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Snapshot().ActiveConnections > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTraceBytes(t *testing.T) {
+	logger := &recordingLogger{}
+	msg := strings.Repeat("0123456789", 10)
+	traceConnection(t, 16, logger, msg)
+	dumps := logger.wait(t, "traffic dump", 2)
+	if len(dumps) != 2 {
+		t.Fatalf("%d traffic dumps, want one per direction", len(dumps))
+	}
+	directions := make(map[string]bool)
+	for _, dump := range dumps {
+		directions[dump.attrs["direction"]] = true
+		if dump.attrs["bytes"] != "16" {
+			t.Fatalf("dumped %s bytes, want the first 16", dump.attrs["bytes"])
+		}
+		if want := hex.Dump([]byte(msg[:16])); dump.attrs["dump"] != want {
+			t.Fatalf("dump %q, want %q", dump.attrs["dump"], want)
+		}
+	}
+	if len(directions) != 2 {
+		t.Fatalf("dumps for directions %v, want both", directions)
+	}
+}
+
+func TestTraceBytesCapped(t *testing.T) {
+	logger := &recordingLogger{}
+	traceConnection(t, 2*maxTraceBytes, logger, strings.Repeat("x", 2*maxTraceBytes))
+	for _, dump := range logger.wait(t, "traffic dump", 2) {
+		if dump.attrs["bytes"] != strconv.Itoa(maxTraceBytes) {
+			t.Fatalf("dumped %s bytes, want at most %d", dump.attrs["bytes"], maxTraceBytes)
+		}
+	}
+}
+
+func TestTraceBytesOff(t *testing.T) {
+	logger := &recordingLogger{}
+	traceConnection(t, 0, logger, "hello")
+	if dumps := logger.find("traffic dump"); len(dumps) != 0 {
+		t.Fatalf("traffic dumped without TraceBytes: %v", dumps)
+	}
+
+	// nor when debug logs are discarded
+	var logs syncBuffer
+	traceConnection(t, 16, slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo})), "hello")
+	if strings.Contains(logs.String(), "traffic dump") {
+		t.Fatalf("traffic dumped at info level:\n%s", logs.String())
+	}
+}
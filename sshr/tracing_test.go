@@ -0,0 +1,102 @@
+package sshr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// endedSpans waits for count spans named name to end
+func endedSpans(t *testing.T, recorder *tracetest.SpanRecorder, name string, count int) []sdktrace.ReadOnlySpan {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var spans []sdktrace.ReadOnlySpan
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				spans = append(spans, span)
+			}
+		}
+		if len(spans) >= count {
+			return spans
+		}
+	}
+	t.Fatalf("fewer than %d %s spans ended within 5s", count, name)
+	return nil
+}
+
+// spanAttributes returns the attributes of span by key
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	srv := startTestServer(t)
+	config := testConfig(srv, startEchoServer(t))
+	config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	registered := false
+	config.SuccessHook = func() {
+		registered = true
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	echo(t, srv.nextForward(), "hello")
+
+	connect := endedSpans(t, recorder, "tunnel.connect", 1)[0]
+	if !registered {
+		t.Fatal("connect span ended before the success hook")
+	}
+	var events []string
+	for _, event := range connect.Events() {
+		events = append(events, event.Name)
+	}
+	if len(events) != 2 || events[0] != "dialed" || events[1] != "listening" {
+		t.Fatalf("connect span events %v, want dialed then listening", events)
+	}
+	if attrs := spanAttributes(connect); attrs["ssh_server"].AsString() != config.SSHServer || connect.Status().Code == codes.Error {
+		t.Fatalf("connect span %v with status %v", attrs, connect.Status())
+	}
+
+	conn := endedSpans(t, recorder, "tunnel.connection", 1)[0]
+	attrs := spanAttributes(conn)
+	if attrs["bytes_in"].AsInt64() != 5 || attrs["bytes_out"].AsInt64() != 5 {
+		t.Fatalf("connection span counted %d bytes in and %d out, want 5 each", attrs["bytes_in"].AsInt64(), attrs["bytes_out"].AsInt64())
+	}
+	if _, ok := attrs["duration_ms"]; !ok || attrs["local_target"].AsString() != config.LocalTarget || attrs["id"].AsString() == "" {
+		t.Fatalf("connection span attributes %v", attrs)
+	}
+}
+
+func TestTracingConnectError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	config := testConfig(startTestServer(t), "127.0.0.1:1")
+	config.SSHServer = "127.0.0.1:1"
+	config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded without a server")
+	}
+	connect := endedSpans(t, recorder, "tunnel.connect", 1)[0]
+	if connect.Status().Code != codes.Error || len(connect.Events()) != 1 || connect.Events()[0].Name != "exception" {
+		t.Fatalf("failed connect span with status %v and events %v, want the error recorded", connect.Status(), connect.Events())
+	}
+}
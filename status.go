@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/tunnelx/sshr"
+)
+
+const (
+	modeTunnel = "tunnel"
+	modeDirect = "direct"
+)
+
+var (
+	// agentMode is modeTunnel or modeDirect once the accessibility check ran
+	agentMode string
+
+	// publicEndpoint is the address clients reach the proxy on
+	publicEndpoint atomic.Value
+)
+
+// agentStatus is the runtime state of the agent
+type agentStatus struct {
+	AgentID   string `json:"agent_id"`
+	AgentName string `json:"agent_name"`
+	// AgentNameSource is where AgentName comes from, see agentNameSource
+	AgentNameSource string             `json:"agent_name_source"`
+	Version         string             `json:"version"`
+	Mode            string             `json:"mode"`
+	Connected       bool               `json:"connected"`
+	Endpoint        string             `json:"endpoint,omitempty"`
+	Server          string             `json:"server,omitempty"`
+	Uptime          string             `json:"uptime"`
+	Stats           sshr.StatsSnapshot `json:"stats"`
+	// Destinations counts CONNECT destinations with -log-destinations
+	Destinations map[string]uint64 `json:"destinations,omitempty"`
+}
+
+func currentStatus() agentStatus {
+	endpoint, _ := publicEndpoint.Load().(string)
+	var server string
+	if agentMode == modeTunnel {
+		server = activeHost()
+	}
+	return agentStatus{
+		AgentID:         currentAgentID(),
+		AgentName:       AgentName,
+		AgentNameSource: agentNameSource,
+		Version:         version,
+		Mode:            agentMode,
+		Connected:       agentMode == modeDirect || tunnelConnected.Load(),
+		Endpoint:        endpoint,
+		Server:          server,
+		Uptime:          time.Since(startedAt).Round(time.Second).String(),
+		Stats:           tunnelStats.Snapshot(),
+		Destinations:    destinationCounts(),
+	}
+}
+
+// resetStats resets the tunnel counters for the reset-stats control command
+// and POST /reset-stats
+func resetStats() {
+	tunnelStats.Reset()
+	gologger.Info().Msg("Connection and byte counters reset")
+}
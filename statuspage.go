@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/projectdiscovery/gologger"
+)
+
+// statusAddr is the address of the http status server, disabled when empty
+var statusAddr string
+
+// statusPageRefresh is how often the index page reloads itself, in seconds
+const statusPageRefresh = 5
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>tunnelx - {{.Status.AgentName}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td { padding: 0.2em 1em 0.2em 0; }
+.connected { color: green; }
+.disconnected { color: red; }
+</style>
+</head>
+<body>
+<h1>tunnelx</h1>
+<table>
+<tr><td>Status</td><td>{{if .Status.Connected}}<span class="connected">connected</span>{{else}}<span class="disconnected">disconnected</span>{{end}}</td></tr>
+<tr><td>Agent name</td><td>{{.Status.AgentName}}</td></tr>
+<tr><td>Agent id</td><td>{{.Status.AgentID}}</td></tr>
+<tr><td>Mode</td><td>{{.Status.Mode}}</td></tr>
+<tr><td>Endpoint</td><td>{{.Status.Endpoint}}</td></tr>
+{{if .Status.Server}}<tr><td>Server</td><td>{{.Status.Server}}</td></tr>{{end}}
+<tr><td>Version</td><td>{{.Status.Version}}</td></tr>
+<tr><td>Uptime</td><td>{{.Status.Uptime}}</td></tr>
+<tr><td>Active connections</td><td>{{.Status.Stats.ActiveConnections}}</td></tr>
+<tr><td>Total connections</td><td>{{.Status.Stats.TotalConnections}}</td></tr>
+<tr><td>Bytes in</td><td>{{.Status.Stats.BytesIn}}</td></tr>
+<tr><td>Bytes out</td><td>{{.Status.Stats.BytesOut}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// serveStatusPage serves a human readable index page on / and the agent
+// status as json on /status, POST /reset-stats resets the counters
+func serveStatusPage(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           statusHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			gologger.Warning().Msgf("status server stopped: %v", err)
+		}
+	}()
+	gologger.Info().Msgf("Serving the status page on http://%s", listener.Addr())
+	return nil
+}
+
+// statusHandler routes the status server requests
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", handleStatusIndex)
+	mux.HandleFunc("GET /status", handleStatusJSON)
+	mux.HandleFunc("POST /reset-stats", handleResetStats)
+	return mux
+}
+
+func handleStatusIndex(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Refresh int
+		Status  agentStatus
+	}{statusPageRefresh, currentStatus()}
+	if err := statusPage.Execute(w, data); err != nil {
+		gologger.Debug().Msgf("could not render the status page: %v", err)
+	}
+}
+
+func handleStatusJSON(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentStatus())
+}
+
+func handleResetStats(w http.ResponseWriter, _ *http.Request) {
+	resetStats()
+	handleStatusJSON(w, nil)
+}
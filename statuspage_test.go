@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusPage(t *testing.T) {
+	server := httptest.NewServer(statusHandler())
+	defer server.Close()
+	setAgentIDForTest(t, "agent-1")
+	setForTest(t, &AgentName, "scanner-<1>")
+	setForTest(t, &agentMode, modeTunnel)
+	setForTest(t, &failoverHosts, nil)
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	for _, connected := range []bool{false, true} {
+		tunnelConnected.Store(connected)
+		resp, body := get("/")
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("/ answered %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		want := `<span class="disconnected">disconnected</span>`
+		if connected {
+			want = `<span class="connected">connected</span>`
+		}
+		// the name is escaped
+		for _, s := range []string{want, "scanner-&lt;1&gt;", "agent-1", `http-equiv="refresh"`} {
+			if !strings.Contains(body, s) {
+				t.Fatalf("/ does not contain %q:\n%s", s, body)
+			}
+		}
+	}
+	tunnelConnected.Store(false)
+
+	resp, body := get("/status")
+	var status agentStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil || resp.StatusCode != http.StatusOK || status.AgentName != "scanner-<1>" {
+		t.Fatalf("/status answered %d with %s: %v", resp.StatusCode, body, err)
+	}
+	if resp, _ := get("/unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("/unknown answered %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/goflags"
+)
+
+var (
+	// tlsMinVersion is the lowest tls version of the control plane calls
+	tlsMinVersion string
+	// tlsCiphers restricts the tls 1.2 cipher suites of the control plane calls
+	tlsCiphers goflags.StringSlice
+	// tlsServerName is the server name verified on control plane calls, the
+	// host of the request when empty
+	tlsServerName string
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configureTLS applies -insecure, -tls-min-version and -tls-ciphers to tlsConfig
+func configureTLS() error {
+	tlsConfig.InsecureSkipVerify = insecureSkipVerify
+
+	version, ok := tlsVersions[tlsMinVersion]
+	if !ok {
+		return errors.Errorf("invalid -tls-min-version %q: must be 1.0, 1.1, 1.2 or 1.3", tlsMinVersion)
+	}
+	tlsConfig.MinVersion = version
+
+	if len(tlsCiphers) == 0 {
+		return nil
+	}
+	// tls 1.3 suites are not configurable, only the secure suites are allowed
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range tlsCiphers {
+		id, ok := suites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return errors.Errorf("unknown or insecure tls cipher suite %q", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return nil
+}
+
+// controlPlaneTLSConfig is tlsConfig with -tls-server-name applied. Other
+// https calls, such as public ip detection, keep verifying their own host.
+func controlPlaneTLSConfig() *tls.Config {
+	if tlsServerName == "" {
+		return tlsConfig
+	}
+	config := tlsConfig.Clone()
+	config.ServerName = tlsServerName
+	return config
+}
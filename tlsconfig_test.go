@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTLSServer runs an https server accepting at most maxVersion and
+// points tlsConfig at a fresh config trusting its certificate
+func startTLSServer(t *testing.T, maxVersion uint16) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: maxVersion}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	setForTest(t, &tlsConfig, &tls.Config{RootCAs: pool})
+	setForTest(t, &insecureSkipVerify, false)
+	setForTest(t, &tlsCiphers, nil)
+	setForTest(t, &tlsServerName, "")
+	return server
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	server := startTLSServer(t, tls.VersionTLS11)
+	setForTest(t, &tlsMinVersion, "1.2")
+	if err := configureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := newHTTPClient().Get(server.URL); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("tls 1.1 server accepted with -tls-min-version 1.2")
+	}
+
+	server = startTLSServer(t, tls.VersionTLS11)
+	setForTest(t, &tlsMinVersion, "1.1")
+	if err := configureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newHTTPClient().Get(server.URL)
+	if err != nil {
+		t.Fatalf("tls 1.1 server rejected with -tls-min-version 1.1: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestConfigureTLS(t *testing.T) {
+	setForTest(t, &tlsConfig, &tls.Config{})
+	setForTest(t, &tlsMinVersion, "1.2")
+	setForTest(t, &tlsCiphers, []string{"tls_ecdhe_rsa_with_aes_128_gcm_sha256"})
+	if err := configureTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tlsConfig.CipherSuites; len(got) != 1 || got[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("cipher suites %v, want only TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", got)
+	}
+
+	for _, c := range []struct {
+		version string
+		ciphers []string
+	}{
+		{version: "1.4"},
+		{version: "1.2", ciphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+	} {
+		setForTest(t, &tlsConfig, &tls.Config{})
+		setForTest(t, &tlsMinVersion, c.version)
+		setForTest(t, &tlsCiphers, c.ciphers)
+		if err := configureTLS(); err == nil {
+			t.Errorf("-tls-min-version %q -tls-ciphers %v accepted", c.version, c.ciphers)
+		}
+	}
+}
+
+// certificateFor returns a self-signed certificate valid only for name
+func certificateFor(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestTLSServerName(t *testing.T) {
+	certificate, cert := certificateFor(t, "tunnel.example")
+	var mu sync.Mutex
+	var serverNames []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		mu.Lock()
+		serverNames = append(serverNames, hello.ServerName)
+		mu.Unlock()
+		return &certificate, nil
+	}}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	setForTest(t, &tlsConfig, &tls.Config{RootCAs: pool})
+
+	// the control plane is dialed by ip, the certificate names the host
+	setForTest(t, &tlsServerName, "")
+	if resp, err := newHTTPClient().Get(server.URL); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("certificate for tunnel.example verified for the ip")
+	}
+
+	setForTest(t, &tlsServerName, "tunnel.example")
+	resp, err := newHTTPClient().Get(server.URL)
+	if err != nil {
+		t.Fatalf("certificate for tunnel.example not verified with -tls-server-name: %v", err)
+	}
+	_ = resp.Body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if got := serverNames[len(serverNames)-1]; got != "tunnel.example" {
+		t.Fatalf("tls handshake sent server name %q, want -tls-server-name", got)
+	}
+	// other https calls keep verifying their own host
+	if tlsConfig.ServerName != "" {
+		t.Fatalf("-tls-server-name leaked into the shared tls config: %q", tlsConfig.ServerName)
+	}
+}
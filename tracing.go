@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracingFlushTimeout bounds exporting the remaining spans on shutdown
+const tracingFlushTimeout = 5 * time.Second
+
+var (
+	// otelEndpoint is the OTLP/HTTP endpoint spans are exported to, tracing is disabled when empty
+	otelEndpoint string
+
+	// flushTracing exports the remaining spans, it is a no-op without tracing
+	flushTracing = func() {}
+)
+
+// setupTracing installs the global tracer provider exporting to otelEndpoint.
+// Without it the global provider is a no-op and spans cost nothing.
+func setupTracing() error {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(otelEndpoint))
+	if err != nil {
+		return errors.Wrap(err, "could not create otlp exporter")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "tunnelx"),
+			attribute.String("service.version", version),
+			attribute.String("tunnelx.agent_id", currentAgentID()),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	flushTracing = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+		defer cancel()
+		_ = provider.Shutdown(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	// upstreamSocks is the socks5 proxy, socks5://[user:password@]host:port,
+	// the ssh connection to the punch-hole server is made through
+	upstreamSocks string
+
+	// sshDialer dials the punch-hole ssh server, through upstreamSocks when set
+	sshDialer proxy.ContextDialer = &net.Dialer{}
+)
+
+// setupSSHDialer builds sshDialer from -upstream-socks and -ssh-timeout
+func setupSSHDialer() error {
+	direct := &net.Dialer{Timeout: sshTimeout}
+	if upstreamSocks == "" {
+		sshDialer = direct
+		return nil
+	}
+
+	u, err := parseUpstreamSocks(upstreamSocks)
+	if err != nil {
+		return err
+	}
+	dialer, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return errors.Wrap(err, "invalid -upstream-socks")
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return errors.New("socks5 dialer does not support contexts")
+	}
+	sshDialer = contextDialer
+	gologger.Info().Msgf("Connecting to the punch-hole server through the socks5 proxy %s", u.Host)
+	return nil
+}
+
+// parseUpstreamSocks accepts a socks5:// url or a bare host:port
+func parseUpstreamSocks(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "socks5://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -upstream-socks")
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, errors.Errorf("invalid -upstream-socks scheme %q, must be socks5", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.Wrapf(err, "invalid -upstream-socks address %q", u.Host)
+	}
+	return u, nil
+}
+
+// redactURL hides the password of a url value
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/projectdiscovery/gologger"
+)
+
+// heartbeatWatchdog is how long the heartbeat loop may go without a
+// successful heartbeat before the tunnel is re-established, disabled when zero
+var heartbeatWatchdog time.Duration
+
+// lastHeartbeat is the unix time in nanoseconds of the last successful
+// heartbeat, or of the start of the current heartbeat loop
+var lastHeartbeat atomic.Int64
+
+// markHeartbeat records a successful heartbeat, or the start of a heartbeat loop
+func markHeartbeat() {
+	lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// runHeartbeatWatchdog re-establishes the tunnel whenever the heartbeat loop
+// of a connected session stalls for longer than heartbeatWatchdog, e.g. on
+// a call that never returns, until ctx is done
+func runHeartbeatWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(max(heartbeatWatchdog/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !tunnelConnected.Load() {
+				continue
+			}
+			stalled := now.Sub(time.Unix(0, lastHeartbeat.Load()))
+			if stalled < heartbeatWatchdog {
+				continue
+			}
+			gologger.Warning().Msgf("no heartbeat for %s, re-establishing the tunnel", stalled.Round(time.Second))
+			// the new session starts its own heartbeat loop
+			markHeartbeat()
+			requestReconnect()
+		}
+	}
+}
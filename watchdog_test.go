@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatWatchdog(t *testing.T) {
+	setForTest(t, &heartbeatWatchdog, 2*time.Second)
+	previous := lastHeartbeat.Load()
+	setTunnelConnected(true)
+	t.Cleanup(func() {
+		setTunnelConnected(false)
+		lastHeartbeat.Store(previous)
+	})
+	sessionCtx, sessionCancel := context.WithCancel(context.Background())
+	defer sessionCancel()
+	setForTest(t, &cancelSession, sessionCancel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runHeartbeatWatchdog(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the watchdog checks every second, a recent heartbeat is left alone
+	markHeartbeat()
+	select {
+	case <-sessionCtx.Done():
+		t.Fatal("tunnel re-established while heartbeats were recent")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// the heartbeat loop hangs, no heartbeat is marked anymore
+	select {
+	case <-sessionCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not re-established once heartbeats stopped")
+	}
+	if stalled := time.Since(time.Unix(0, lastHeartbeat.Load())); stalled > time.Second {
+		t.Fatalf("watchdog left the heartbeat %s old, the new session would be re-established again", stalled)
+	}
+}